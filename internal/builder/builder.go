@@ -23,112 +23,115 @@ package builder
 
 import (
 	"context"
-	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/negativa-ai/BLAFS/internal/elfdeps"
+	"github.com/negativa-ai/BLAFS/internal/engine"
 	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/journal"
+	"github.com/negativa-ai/BLAFS/internal/license"
 	"github.com/negativa-ai/BLAFS/internal/mount"
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+	"github.com/negativa-ai/BLAFS/internal/profile"
+	"github.com/negativa-ai/BLAFS/internal/report"
+	"github.com/negativa-ai/BLAFS/internal/rules"
+	"github.com/negativa-ai/BLAFS/internal/sbom"
+	"github.com/negativa-ai/BLAFS/internal/state"
+	"github.com/negativa-ai/BLAFS/internal/surface"
 	"github.com/negativa-ai/BLAFS/internal/util"
+	"github.com/negativa-ai/BLAFS/internal/version"
+	"github.com/negativa-ai/BLAFS/internal/vuln"
 	log "github.com/sirupsen/logrus"
 )
 
-// extractLayerNames extracts layer names from graph driver.
-// It returns a list of layer names.
-func extractLayerNames(graphDriver types.GraphDriverData) []string {
-	var allLayers []string
-	upper := graphDriver.Data["UpperDir"]
-	allLayers = append(allLayers, upper)
-	if lower, ok := graphDriver.Data["LowerDir"]; ok {
-		allLowers := strings.Split(lower, ":")
-		allLayers = append(allLayers, allLowers...)
-	}
-
-	var layerNames []string
-	for _, layer := range allLayers {
-		tmp := strings.Split(layer, "/")
-		layerName := tmp[len(tmp)-2]
-		layerNames = append(layerNames, layerName)
-	}
-	return layerNames
-}
-
-// generateChainId generates a chain id from previous chain id and diff id.
-// See https://www.baeldung.com/linux/docker-image-storage-host
-// It returns a chain id.
-func generateChainId(preChainId string, diffId string) string {
-	str := preChainId + " " + diffId
-	chainId := fmt.Sprintf("%x", sha256.Sum256([]byte(str)))
-	return chainId
-
-}
-
-// ExtractLayersInfo extracts layer info from image inspect, from top to bottom.
-// It returns a list of layer info.
-func ExtractLayersInfo(imgInfo *types.ImageInspect, overlayPath string, dockerRootDir string) []image.LayerInfo {
-	layerNames := extractLayerNames(imgInfo.GraphDriver)
-	// there should only return image inspect dirs
-	// after modified, frist test cold run, then warm run
-	layerInfos := []image.LayerInfo{}
-	for _, p := range layerNames {
-		l := image.NewLayerInfo(filepath.Join(overlayPath, p))
-		layerInfos = append(layerInfos, *l)
-	}
-
-	rootfsLayers := imgInfo.RootFS.Layers
-	chainId := rootfsLayers[0]
-
-	// generate layer meta info for each layer
-	count := 1
-	for {
-		dirName := strings.Split(chainId, ":")[1]
-		// read layer size
-		layerDir := filepath.Join(dockerRootDir, "image/overlay2/layerdb/sha256", dirName)
-		cacheIdDir := filepath.Join(layerDir, "cache-id")
-		cacheId, err := os.ReadFile(cacheIdDir)
-		if err != nil {
-			panic(err)
+// ExtractLayersInfo resolves the layers of an image with their metadata, from top to bottom.
+func ExtractLayersInfo(eng engine.Engine, imgInfo engine.Image) []image.LayerInfo {
+	layerInfos, err := eng.Layers(imgInfo)
+	if err != nil {
+		panic(err)
+	}
+	return layerInfos
+}
+
+// layerKey returns the key of a layer in the state.
+func layerKey(l image.LayerInfo) string {
+	return state.Key(filepath.Base(l.GetLayerPath()))
+}
+
+// isShadowLayer tells if a layer of an inspected image is a shadow layer, i.e., its cache-id points to the shadow layer.
+func isShadowLayer(l image.LayerInfo) bool {
+	return strings.HasPrefix(filepath.Base(l.GetLayerPath()), "shadow_")
+}
+
+// isShadowed tells if the state records an image as shadowed.
+func isShadowed(imgID string, db *state.DB) bool {
+	rec := db.Image(imgID)
+	return rec != nil && rec.Status == state.Shadowed
+}
+
+// layerRecords returns the records of the layers of an inspected image, from the top layer to the bottom one.
+func layerRecords(imgInfo engine.Image, layerInfos []image.LayerInfo) []state.Layer {
+	diffIds := imgInfo.DiffIDs
+	var layers []state.Layer
+	for i, l := range layerInfos {
+		key := layerKey(l)
+		dir := filepath.Dir(l.GetLayerPath())
+		layer := state.Layer{
+			Key:      key,
+			Original: filepath.Join(dir, key),
+			Shadow:   filepath.Join(dir, "shadow_"+key),
 		}
-		cacheIdStr := string(cacheId)
-		expectedAbsDir := filepath.Join(overlayPath, cacheIdStr)
+		layer.MountPoint = filepath.Join(layer.Shadow, "diff")
+		if i < len(diffIds) {
+			layer.DiffID = diffIds[len(diffIds)-1-i]
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
 
-		// find corresponsding original layer
-		i := 0
-		for ; i < len(layerInfos); i++ {
-			log.Debug("layer path: ", layerInfos[i].GetLayerPath(), " expected path: ", expectedAbsDir)
-			if layerInfos[i].GetLayerPath() == expectedAbsDir {
-				break
+// AdoptShadowedImages records the images shadowed before the state existed, recognized by their upper dir.
+// It does nothing once the state is saved.
+func AdoptShadowedImages(db *state.DB, workDir string, eng engine.Engine, ctx *context.Context) {
+	if db.Exists() {
+		return
+	}
+	images, err := eng.List(*ctx)
+	if err != nil {
+		panic(err)
+	}
+	for _, imgInfo := range images {
+		if !checkIfShadowed(imgInfo) {
+			continue
+		}
+		log.Info("Recording image ", imgInfo.Names, ", shadowed by an older version")
+		layerInfos := ExtractLayersInfo(eng, imgInfo)
+		rec := &state.Image{ID: imgInfo.ID, Names: imgInfo.Names, Status: state.Shadowed, Layers: layerRecords(imgInfo, layerInfos)}
+		for _, name := range imgInfo.Names {
+			if backup := backupPath(workDir, name); util.PathExist(backup) {
+				rec.Backup = backup
 			}
 		}
-
-		layerInfos[i].SetMetaPath(layerDir)
-		layerInfos[i].SetCacheIdPath(cacheIdDir)
-		layerInfos[i].SetCacheId(cacheIdStr)
-		layerInfos[i].SetSizePath(filepath.Join(layerDir, "size"))
-
-		if count >= len(rootfsLayers) {
-			break
+		db.Put(rec)
+		for _, l := range rec.Layers {
+			db.Acquire(l.Key, imgInfo.ID)
 		}
-		// generate new chain_id
-		diffId := rootfsLayers[count]
-		chainId = generateChainId(chainId, diffId)
-		chainId = "sha256:" + chainId
-		count++
 	}
-	return layerInfos
 }
 
-// checkIfShadowed checks if the image is already shadowed.
-func checkIfShadowed(graphDriver types.GraphDriverData) bool {
-	return strings.Contains(graphDriver.Data["UpperDir"], "shadow")
+// checkIfShadowed checks if the image is already shadowed, from its upper dir.
+// It is only used for images shadowed before the state existed, see AdoptShadowedImages.
+func checkIfShadowed(imgInfo engine.Image) bool {
+	return len(imgInfo.Layers) > 0 && strings.Contains(filepath.Base(imgInfo.Layers[0]), "shadow")
 }
 
 // generateTarFileName generates a tar file name from image name.
@@ -153,53 +156,87 @@ func generateLowers(layers []image.ShadowLayer) []string {
 }
 
 // saveImage saves the original image to a tar file.
-func saveImage(workDir string, cli *client.Client, ctx *context.Context, imgName string) {
+func saveImage(workDir string, eng engine.Engine, ctx *context.Context, imgName string, j *journal.Journal) {
 	// bak up the original image
-	reader, err := cli.ImageSave(*ctx, []string{imgName})
-	if err != nil {
-		panic(err)
-	}
-	imgTarPath := filepath.Join(workDir, generateTarFileName(imgName))
+	imgTarPath := backupPath(workDir, imgName)
 	log.Debug("original img backup path: ", imgTarPath)
+	j.Record(journal.Create(imgTarPath))
 	out, err := os.OpenFile(imgTarPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		panic(err)
 	}
-	_, err = io.Copy(out, reader)
-	if err != nil {
+	defer out.Close()
+	if err := eng.Save(*ctx, imgName, out); err != nil {
 		panic(err)
 	}
-	reader.Close()
+}
+
+// backupPath returns the path of the original image tar saved in the work dir when the image is shadowed.
+func backupPath(workDir string, imgName string) string {
+	return filepath.Join(workDir, generateTarFileName(imgName))
 }
 
 // ShadowImage shadows the image. For each original layer, it creates a shadow layer in memory.
-// It does not create anything on the filesystem.
-// It returns if shadowed, original layers, shadow layers.
-func ShadowImage(imgName string, workDir string, overlayPath string,
-	dockerRootDir string, cli *client.Client, ctx *context.Context, optimize string) (bool, []image.OriginalLayer, []image.ShadowLayer) {
-	imgInfo, _, err := cli.ImageInspectWithRaw(*ctx, imgName)
+// Layers already shadowed for another image are shared: they are only referenced by the image in the state db.
+// It does not create anything on the filesystem, except the backup of the original image, which is recorded in the journal j.
+// The image is recorded as shadowed in db.
+// It returns if shadowed, original layers, shadow layers and the shadow layers to create, i.e., not referenced by any image before.
+func ShadowImage(imgName string, workDir string, eng engine.Engine, ctx *context.Context, optimize string, db *state.DB, j *journal.Journal) (bool, []image.OriginalLayer, []image.ShadowLayer, []image.ShadowLayer) {
+	imgInfo, err := eng.Inspect(*ctx, imgName)
 	if err != nil {
 		panic(err)
 	}
 	var originalLayers []image.OriginalLayer
 	var shadowLayers []image.ShadowLayer
-	layerInfos := ExtractLayersInfo(&imgInfo, overlayPath, dockerRootDir)
-	shadowed := checkIfShadowed(imgInfo.GraphDriver)
+	var newLayers []image.ShadowLayer
+	layerInfos := ExtractLayersInfo(eng, imgInfo)
+	shadowed := isShadowed(imgInfo.ID, db)
 	if !shadowed {
 		log.Debug("shadowing container")
-		saveImage(workDir, cli, ctx, imgName)
+		var shared []string
+		for _, l := range layerInfos {
+			if isShadowLayer(l) {
+				shared = append(shared, layerKey(l))
+			}
+		}
+		if len(shared) > 0 {
+			// docker save reads the shared layers through debloated_fs, which keeps all their files
+			log.Warn("Image ", imgName, " shares ", len(shared), " layers with shadowed images, all files of these layers are kept when saving it. ",
+				"Shadow images sharing layers in the same run to avoid it")
+		}
+		saveImage(workDir, eng, ctx, imgName, j)
 
 		for _, l := range layerInfos {
-			originalLayer := image.OriginalLayer{LayerInfo: l}
-			originalLayers = append(originalLayers, originalLayer)
-			shadowLayers = append(shadowLayers, originalLayer.Shadow())
+			if isShadowLayer(l) {
+				shadowLayer := image.NewShadowLayer(l)
+				originalLayers = append(originalLayers, shadowLayer.Original())
+				shadowLayers = append(shadowLayers, shadowLayer)
+			} else {
+				originalLayer := image.OriginalLayer{LayerInfo: l}
+				originalLayers = append(originalLayers, originalLayer)
+				shadowLayers = append(shadowLayers, originalLayer.Shadow())
+			}
 		}
 		allShadowLowers := generateLowers(shadowLayers)
 		// we should not set lowers for the bottom layer
 		for i := 0; i < len(shadowLayers)-1; i++ {
 			shadowLayers[i].SetLowers(allShadowLowers[i])
 		}
+		for i, l := range layerInfos {
+			if db.Acquire(layerKey(l), imgInfo.ID) {
+				newLayers = append(newLayers, shadowLayers[i])
+			}
+		}
+		db.Put(&state.Image{
+			ID:         imgInfo.ID,
+			Names:      []string{imgName},
+			Status:     state.Shadowed,
+			ShadowedAt: time.Now(),
+			Backup:     backupPath(workDir, imgName),
+			Layers:     layerRecords(imgInfo, layerInfos),
+		})
 	} else {
+		db.Image(imgInfo.ID).AddName(imgName)
 		for _, l := range layerInfos {
 			shadowLayer := image.NewShadowLayer(l)
 			shadowLayers = append(shadowLayers, shadowLayer)
@@ -207,7 +244,7 @@ func ShadowImage(imgName string, workDir string, overlayPath string,
 		}
 	}
 	log.Debug("total layers: ", len(originalLayers))
-	return shadowed, originalLayers, shadowLayers
+	return shadowed, originalLayers, shadowLayers, newLayers
 }
 
 // createMount creates a mount in memory abstraction, not create anything on the filesystem.
@@ -231,35 +268,256 @@ func CreateMounts(fsExePath string, originalLayers []image.OriginalLayer, shadow
 	return mounts
 }
 
-func umount(mountPoint string, mountType string) {
+// umount unmounts a layer, it fails if the layer is still mounted afterwards, e.g., busy with a running container.
+// Removing files from a layer still mounted with debloated_fs removes them from the original layer.
+func umount(mountPoint string, mountType string) error {
 	cmd := exec.Command("umount", "-f", "-A", "-t", mountType, mountPoint)
 	log.Debug("umount layer: ", cmd)
-	cmd.Output()
+	out, err := cmd.CombinedOutput()
+	if mount.IsMountedWithType(mountPoint, mountType) {
+		return fmt.Errorf("%s is still mounted: %v: %s", mountPoint, err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
-func umountAllLayers(graphDriver types.GraphDriverData, mountType string) {
-	allLowers := strings.Split(graphDriver.Data["LowerDir"], ":")
-	// umount all lower shadow layers
-	for _, lower := range allLowers {
-		umount(lower, mountType)
+// DebloatedTarPath returns the path of the debloated image tar file exported by ExportImg.
+func DebloatedTarPath(imgName string) string {
+	return filepath.Join("/tmp/", generateTarFileName(imgName)+".debloated")
+}
+
+// untarImg extracts an image tar file to a directory.
+func untarImg(imgTarPath string, untarPath string) {
+	cmd := exec.Command("tar", "-xf", imgTarPath, "-C", untarPath)
+	log.Debug("untar image tar file: ", cmd)
+	if _, err := cmd.Output(); err != nil {
+		panic(err)
 	}
-	shadowDiffPath := graphDriver.Data["UpperDir"]
-	umount(shadowDiffPath, mountType)
+}
+
+// copyKept copies the real dir of a shadow layer to dir and makes the copy its kept dir,
+// so that the drop rules and package database rewrites of an export leave the real dir of a mounted layer untouched.
+func copyKept(l *image.ShadowLayer, dir string) {
+	keptCopy := filepath.Join(dir, layerKey(l.LayerInfo))
+	cmd := exec.Command("cp", "-a", l.GetRealPath(), keptCopy)
+	log.Debug("copy kept files: ", cmd)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		panic(fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))))
+	}
+	l.SetKeptPath(keptCopy)
+}
+
+// ExportOptions controls which layers and files ExportImg keeps.
+type ExportOptions struct {
+	TopN         int         `json:"top"`           // only export the top n layers, -1 for all
+	Rules        rules.Rules `json:"rules"`         // keep and drop rules applied to every layer
+	KeepDirs     bool        `json:"keep_dirs"`     // keep all directories of the original layers
+	NoELF        bool        `json:"no_elf"`        // do not keep shared libraries needed by kept ELF files
+	RewritePkgDB bool        `json:"rewrite_pkgdb"` // rewrite the dpkg and apk databases to list only the kept files, rpm databases are rejected
+	SBOM         bool        `json:"sbom"`          // write SPDX and CycloneDX SBOMs of the debloated image
+	Licenses     bool        `json:"licenses"`      // keep the license files of packages and directories with kept files
+	OSV          string      `json:"osv"`           // directory of OSV vulnerabilities matched against the debloated image, empty for none
+}
+
+// An ExportReport records why the files of a debloated image are kept:
+// accessed during profiling, or added by static analysis.
+type ExportReport struct {
+	Image    string               `json:"image"`
+	Profiled []string             `json:"profiled"` // accessed during profiling
+	Dirs     []string             `json:"dirs"`     // directories of the original layers
+	Rules    []string             `json:"rules"`    // matched by keep rules
+	Symlinks []string             `json:"symlinks"` // symlinks and targets of kept symlinks
+	ELF      []elfdeps.Dependency `json:"elf"`      // interpreters and libraries of kept ELF files
+	Licenses []string             `json:"licenses"` // license files kept in compliance mode
+	Dropped  []string             `json:"dropped"`  // removed by drop rules
+
+	manifest license.Manifest // licenses of the debloated image in compliance mode
+}
 
+// LicenseManifestPath returns the path of the license manifest of an image, next to its debloated image tar.
+func LicenseManifestPath(imgName string) string {
+	return DebloatedTarPath(imgName) + ".licenses.json"
+}
+
+// HTMLReportPath returns the path of the html report of an image, next to its debloated image tar.
+func HTMLReportPath(imgName string) string {
+	return DebloatedTarPath(imgName) + ".html"
+}
+
+// WriteHTMLReport writes the html report of the shadow layers of an image, from the top layer to the bottom one.
+func WriteHTMLReport(dst string, shadowLayers []image.ShadowLayer, diffIds []string, m report.Metadata) {
+	r := report.New(m.Image, shadowLayers, diffIds, 10)
+	f, err := os.Create(dst)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := report.WriteHTML(f, r, report.NewTree(shadowLayers), m); err != nil {
+		panic(err)
+	}
+}
+
+// exportedStack returns the stack of the shadow layers of an image as exported: only the top n layers are debloated,
+// -1 for all, the files of the other layers are exported unchanged.
+func exportedStack(shadowLayers []image.ShadowLayer, topN int) image.LayerStack {
+	stack := image.NewLayerStack(shadowLayers)
+	if topN != -1 {
+		for i := topN; i < len(stack); i++ {
+			stack[i].Kept = stack[i].Origin
+		}
+	}
+	return stack
+}
+
+// SurfacePath returns the path of the attack surface of an image, next to its debloated image tar.
+func SurfacePath(imgName string) string {
+	return DebloatedTarPath(imgName) + ".surface.json"
+}
+
+// WriteSurface classifies the files of the shadow layers of an image, logs the categories kept and writes them to dst.
+func WriteSurface(dst string, shadowLayers []image.ShadowLayer, topN int) {
+	s := surface.Classify(exportedStack(shadowLayers, topN))
+	for _, line := range s.Summary() {
+		log.Info("Attack surface ", line)
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := s.WriteJSON(f); err != nil {
+		panic(err)
+	}
+}
+
+// VulndiffPath returns the path of the vulnerabilities no longer reachable in an image, next to its debloated image tar.
+func VulndiffPath(imgName string) string {
+	return DebloatedTarPath(imgName) + ".vulndiff.json"
+}
+
+// WriteVulndiff matches the vulnerabilities in osvDir against the packages of the shadow layers of an image as exported,
+// logs how many are no longer reachable and writes the diff to dst.
+func WriteVulndiff(dst string, imgName string, shadowLayers []image.ShadowLayer, topN int, osvDir string) {
+	vulns, err := vuln.Load(osvDir)
+	if err != nil {
+		panic(err)
+	}
+	d := vuln.New(imgName, exportedStack(shadowLayers, topN), vulns)
+	log.Info("Vulnerabilities: ", d.Original, " in the original image, ", d.Unreachable, " no longer reachable")
+	f, err := os.Create(dst)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := d.WriteJSON(f); err != nil {
+		panic(err)
+	}
+}
+
+// SPDXPath returns the path of the SPDX SBOM of an image, next to its debloated image tar.
+func SPDXPath(imgName string) string {
+	return DebloatedTarPath(imgName) + ".spdx.json"
+}
+
+// CycloneDXPath returns the path of the CycloneDX SBOM of an image, next to its debloated image tar.
+func CycloneDXPath(imgName string) string {
+	return DebloatedTarPath(imgName) + ".cdx.json"
+}
+
+// WriteSBOM writes the SPDX and CycloneDX SBOMs of the shadow layers of an image, from the top layer to the bottom one.
+func WriteSBOM(imgName string, shadowLayers []image.ShadowLayer, topN int, m report.Metadata) {
+	s := sbom.New(exportedStack(shadowLayers, topN), m)
+	log.Info("SBOM of ", m.DebloatedImage, ": ", len(s.Packages), " packages, ", len(s.Files), " files")
+	writers := map[string]func(io.Writer) error{SPDXPath(imgName): s.WriteSPDX, CycloneDXPath(imgName): s.WriteCycloneDX}
+	for dst, write := range writers {
+		f, err := os.Create(dst)
+		if err != nil {
+			panic(err)
+		}
+		if err := write(f); err != nil {
+			panic(err)
+		}
+		if err := f.Close(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// ExportReportPath returns the path of the export report of an image, next to its debloated image tar.
+func ExportReportPath(imgName string) string {
+	return DebloatedTarPath(imgName) + ".kept.json"
+}
+
+// keepClosure completes the kept files of a stack with static analysis and applies the keep and drop rules.
+// The kept dirs are changed, shared layers must be given a copy of their real dir, see copyKept.
+func keepClosure(imgName string, shadowLayers []image.ShadowLayer, opts ExportOptions) ExportReport {
+	exportReport := ExportReport{Image: imgName}
+	profiled := map[string]bool{}
+	for _, l := range shadowLayers {
+		for _, f := range l.AccessedFiles() {
+			profiled[f] = true
+		}
+	}
+	for f := range profiled {
+		exportReport.Profiled = append(exportReport.Profiled, f)
+	}
+	sort.Strings(exportReport.Profiled)
+
+	stack := image.NewLayerStack(shadowLayers)
+	// packages and licenses are checked against the layers exported unchanged as they are, only the others are changed
+	exported := exportedStack(shadowLayers, opts.TopN)
+	if opts.KeepDirs {
+		exportReport.Dirs = stack.KeepSkeleton()
+	}
+	exportReport.Rules = opts.Rules.ApplyKeep(stack)
+	exportReport.Symlinks = stack.SymlinkClosure()
+	if !opts.NoELF {
+		exportReport.ELF = elfdeps.Closure(stack)
+	}
+	if opts.Licenses {
+		exportReport.manifest, exportReport.Licenses = license.Retain(exported)
+		exportReport.manifest.Image = imgName
+	}
+	// drop wins over keep, whatever the reason
+	exportReport.Dropped = opts.Rules.ApplyDrop(stack)
+	exportReport.manifest.Prune(exported)
+	if opts.RewritePkgDB {
+		statuses := pkgdb.Check(exported, pkgdb.Read(exported))
+		count := pkgdb.Count(statuses)
+		log.Info("Rewriting package databases: ", count[pkgdb.StateKept], " packages kept, ", count[pkgdb.StatePartlyRemoved],
+			" partly removed, ", count[pkgdb.StateRemoved], " removed")
+		pkgdb.Rewrite(exported, statuses)
+	}
+
+	log.Info("Kept ", len(exportReport.Profiled), " files accessed during profiling, added ", len(exportReport.Dirs), " directories, ",
+		len(exportReport.Rules), " files by rules, ", len(exportReport.Symlinks), " by symlinks, ", len(exportReport.ELF), " by ELF dependencies, ",
+		len(exportReport.Licenses), " license files, dropped ", len(exportReport.Dropped), " files by rules")
+	return exportReport
 }
 
 // ExportImg exports the debloated image to a tar file.
-// It returns if exported, target tar path, shadow layers.
-func ExportImg(imgName string, workDir string, overlayPath string, dockerRootDir string, cli *client.Client, ctx *context.Context, topN int) (bool, string, []image.ShadowLayer) {
-	imgInfo, _, err := cli.ImageInspectWithRaw(*ctx, imgName)
+// Changes to the docker storage are recorded in the journal j before they happen.
+// It returns if exported, target tar path, shadow layers no longer referenced by any image.
+func ExportImg(imgName string, workDir string, eng engine.Engine, ctx *context.Context, opts ExportOptions, db *state.DB, j *journal.Journal) (bool, string, []image.ShadowLayer) {
+	imgInfo, err := eng.Inspect(*ctx, imgName)
 	if err != nil {
 		panic(err)
 	}
 
-	if !checkIfShadowed(imgInfo.GraphDriver) {
+	if !isShadowed(imgInfo.ID, db) {
 		log.Info("Container not shadowed, cannot perform debloating")
 		return false, "", make([]image.ShadowLayer, 0)
 	}
+	layerInfos := ExtractLayersInfo(eng, imgInfo)
+	if opts.RewritePkgDB {
+		// reject the image before the docker storage is changed
+		var shadowLayers []image.ShadowLayer
+		for _, l := range layerInfos {
+			shadowLayers = append(shadowLayers, image.NewShadowLayer(l))
+		}
+		if err := pkgdb.Rewritable(image.NewLayerStack(shadowLayers)); err != nil {
+			panic(fmt.Errorf("cannot rewrite the package databases of %s: %w", imgName, err))
+		}
+	}
 
 	// export original image to reuse the structure
 	tarName := generateTarFileName(imgName)
@@ -270,36 +528,50 @@ func ExportImg(imgName string, workDir string, overlayPath string, dockerRootDir
 			panic(err)
 		}
 	}
-	cmd := exec.Command("tar", "-xf", originalImgPath, "-C", untarPath)
-	log.Debug("untar image tar file: ", cmd)
-	_, err = cmd.Output()
-	if err != nil {
-		panic(err)
-	}
+	untarImg(originalImgPath, untarPath)
 	imgsTarFs := image.ParseImgTarFs(untarPath)
 	for _, l := range imgsTarFs.GetLayers() {
 		log.Debug("layer tar path: ", l.GetLayerTarPath())
 		l.RmLayerTar()
 	}
 
-	// copy file from real path to diff path
-	layerInfos := ExtractLayersInfo(&imgInfo, overlayPath, dockerRootDir)
+	// copy file from real path to diff path, layers shared with other images stay mounted and are tarred from a copy of the real path
+	keptCopies, err := os.MkdirTemp("", "baffs-kept-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(keptCopies)
 	shadowLayers := []image.ShadowLayer{}
+	var exclusive []image.ShadowLayer
 	for _, l := range layerInfos {
 		shadowLayer := image.NewShadowLayer(l)
+		if db.Shared(layerKey(l), imgInfo.ID) {
+			log.Info("Layer ", layerKey(l), " is shared with ", len(db.Referencing(layerKey(l)))-1, " other images, it stays shadowed")
+			copyKept(&shadowLayer, keptCopies)
+			shadowLayers = append(shadowLayers, shadowLayer)
+			continue
+		}
 		shadowLayers = append(shadowLayers, shadowLayer)
+		exclusive = append(exclusive, shadowLayer)
+	}
+	for _, l := range exclusive {
+		j.Record(journal.Umount(l.GetDiffPath()))
+		if err := umount(l.GetDiffPath(), mount.MountType); err != nil {
+			panic(err)
+		}
 	}
-	umountAllLayers(imgInfo.GraphDriver, "fuse.debloated_fs")
 	time.Sleep(1 * time.Second)
 	log.Debug("Total layers: ", len(shadowLayers))
-	for _, l := range shadowLayers {
+	for _, l := range exclusive {
 		if !util.PathExist(l.GetRealPath()) {
 			log.Debug("real path not exist, this layer might already be exported: ", l.GetRealPath())
 			continue
 		} else {
+			j.Record(journal.Rmdir(l.GetDiffPath()))
 			if err := os.RemoveAll(l.GetDiffPath()); err != nil {
 				panic(err)
 			} else {
+				j.Record(journal.Move(l.GetRealPath(), l.GetDiffPath()))
 				if err := util.Move(l.GetRealPath(), l.GetDiffPath()); err != nil {
 					log.Error("failed to move from: ", l.GetRealPath(), " to: ", l.GetDiffPath())
 					panic(err)
@@ -309,6 +581,9 @@ func ExportImg(imgName string, workDir string, overlayPath string, dockerRootDir
 
 	}
 
+	// the real dir only holds what was accessed, complete it so that kept paths still resolve
+	exportReport := keepClosure(imgName, shadowLayers, opts)
+
 	// tar diff file to untarpath & update layer diff ids
 	if len(shadowLayers) != len(imgsTarFs.GetLayers()) {
 		panic("number of shadow layers should be equal to img tar fs layers")
@@ -319,10 +594,10 @@ func ExportImg(imgName string, workDir string, overlayPath string, dockerRootDir
 		shadow := shadowLayers[i]
 		tarFsLayer := imgsTarFs.GetLayers()[layerLen-1-i]
 		shadow.TarDiff(tarFsLayer.GetLayerTarPath())
-		imgsTarFs.GetImageJson().Rootfs.DiffIds[layerLen-1-i] = "sha256:" + tarFsLayer.LayerTarSha256Sum()
+		imgsTarFs.UpdateLayer(layerLen - 1 - i)
 		count++
-		if topN != -1 && count >= topN {
-			log.Debug("Only export top ", topN, " layers.")
+		if opts.TopN != -1 && count >= opts.TopN {
+			log.Debug("Only export top ", opts.TopN, " layers.")
 			break
 		}
 	}
@@ -332,29 +607,280 @@ func ExportImg(imgName string, workDir string, overlayPath string, dockerRootDir
 	imgsTarFs.GetManifest()[0].RepoTags[0] = imgsTarFs.GetManifest()[0].RepoTags[0] + "-baffs"
 	imgsTarFs.DumpManifest()
 
+	var diffIds []string
+	for i := len(imgInfo.DiffIDs) - 1; i >= 0; i-- {
+		diffIds = append(diffIds, imgInfo.DiffIDs[i])
+	}
+	metadata := report.Metadata{
+		Image:           imgName,
+		OriginalDigest:  imgInfo.ID,
+		DebloatedImage:  imgsTarFs.GetManifest()[0].RepoTags[0],
+		DebloatedDigest: imgsTarFs.ConfigDigest(),
+		Version:         version.Version,
+		Time:            time.Now().Format(time.RFC3339),
+		Rules:           opts.Rules,
+	}
+	WriteHTMLReport(HTMLReportPath(imgName), shadowLayers, diffIds, metadata)
+	if opts.SBOM {
+		WriteSBOM(imgName, shadowLayers, opts.TopN, metadata)
+	}
+	WriteSurface(SurfacePath(imgName), shadowLayers, opts.TopN)
+	if opts.OSV != "" {
+		WriteVulndiff(VulndiffPath(imgName), imgName, shadowLayers, opts.TopN, opts.OSV)
+	}
+
 	// tar the image fs
-	targetTarPath := filepath.Join("/tmp/", tarName+".debloated")
+	targetTarPath := DebloatedTarPath(imgName)
 	log.Debug("target tar path: ", targetTarPath)
 	imgsTarFs.TarWholeFs(targetTarPath)
 
-	return true, targetTarPath, shadowLayers
+	data, err := json.MarshalIndent(exportReport, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(ExportReportPath(imgName), data, 0644); err != nil {
+		panic(err)
+	}
+	if opts.Licenses {
+		f, err := os.Create(LicenseManifestPath(imgName))
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		if err := exportReport.manifest.WriteJSON(f); err != nil {
+			panic(err)
+		}
+	}
+
+	rec := db.Image(imgInfo.ID)
+	rec.AddName(imgName)
+	rec.Status = state.Debloated
+	rec.Export = &state.Export{
+		Time:            time.Now(),
+		Tar:             targetTarPath,
+		DebloatedImage:  metadata.DebloatedImage,
+		DebloatedDigest: metadata.DebloatedDigest,
+		Outputs:         exportOutputs(imgName, opts),
+	}
+	return true, targetTarPath, releaseLayers(imgInfo.ID, shadowLayers, db)
 }
 
-// LoadImage loads the generated image tar file.
-func LoadImage(imgTarPath string, cli *client.Client) {
-	// load the generated image tar file
-	imageFile, err := os.Open(imgTarPath)
+// exportOutputs returns the paths of the reports and SBOMs written by ExportImg.
+func exportOutputs(imgName string, opts ExportOptions) []string {
+	outputs := []string{ExportReportPath(imgName), HTMLReportPath(imgName), SurfacePath(imgName)}
+	if opts.SBOM {
+		outputs = append(outputs, SPDXPath(imgName), CycloneDXPath(imgName))
+	}
+	if opts.Licenses {
+		outputs = append(outputs, LicenseManifestPath(imgName))
+	}
+	if opts.OSV != "" {
+		outputs = append(outputs, VulndiffPath(imgName))
+	}
+	return outputs
+}
+
+// releaseLayers drops the references of an image to its shadow layers in the state.
+// It returns the shadow layers no longer referenced by any image.
+func releaseLayers(imgID string, shadowLayers []image.ShadowLayer, db *state.DB) []image.ShadowLayer {
+	var released []image.ShadowLayer
+	for _, l := range shadowLayers {
+		if db.Release(layerKey(l.LayerInfo), imgID) {
+			released = append(released, l)
+		}
+	}
+	return released
+}
+
+// RestoreImg unmounts the debloated_fs layers of a shadowed image that no other shadowed image shares, so that they can be restored.
+// It records the image as restored in db.
+// If a layer cannot be unmounted, the image stays shadowed and an error is returned.
+// Unmounting is recorded in the journal j.
+// It returns if shadowed, shadow layers no longer referenced by any image.
+func RestoreImg(imgName string, eng engine.Engine, ctx *context.Context, db *state.DB, j *journal.Journal) (bool, []image.ShadowLayer, error) {
+	imgInfo, err := eng.Inspect(*ctx, imgName)
 	if err != nil {
 		panic(err)
 	}
-	defer imageFile.Close()
-	imageResponse, err := cli.ImageLoad(context.Background(), imageFile, false)
+
+	if !isShadowed(imgInfo.ID, db) {
+		log.Info("Image ", imgName, " not shadowed, nothing to restore")
+		return false, make([]image.ShadowLayer, 0), nil
+	}
+
+	layerInfos := ExtractLayersInfo(eng, imgInfo)
+	shadowLayers := []image.ShadowLayer{}
+	for _, l := range layerInfos {
+		shadowLayers = append(shadowLayers, image.NewShadowLayer(l))
+	}
+	for _, l := range shadowLayers {
+		if db.Shared(layerKey(l.LayerInfo), imgInfo.ID) {
+			continue
+		}
+		j.Record(journal.Umount(l.GetDiffPath()))
+		if err := umount(l.GetDiffPath(), mount.MountType); err != nil {
+			return true, nil, fmt.Errorf("cannot restore image %s: %w", imgName, err)
+		}
+	}
+	released := releaseLayers(imgInfo.ID, shadowLayers, db)
+	rec := db.Image(imgInfo.ID)
+	rec.Status = state.Restored
+	rec.Backup = ""
+	for i := range rec.Layers {
+		rec.Layers[i].MountPID = 0
+	}
+	if len(released) < len(shadowLayers) {
+		log.Info(len(shadowLayers)-len(released), " layers of image ", imgName, " are shared with other shadowed images, they stay shadowed")
+	}
+	time.Sleep(1 * time.Second)
+	return true, released, nil
+}
+
+// RemoveShadowLayers removes the shadow layers of a restored image that no image references anymore.
+// It is called once the engine is reloaded, with the original layers restored.
+func RemoveShadowLayers(imgName string, eng engine.Engine, ctx *context.Context, db *state.DB) {
+	imgInfo, err := eng.Inspect(*ctx, imgName)
 	if err != nil {
 		panic(err)
 	}
-	defer imageResponse.Body.Close()
-	_, err = io.Copy(os.Stdout, imageResponse.Body)
+	for _, l := range ExtractLayersInfo(eng, imgInfo) {
+		if isShadowLayer(l) || len(db.Referencing(layerKey(l))) > 0 {
+			continue
+		}
+		original := image.NewOriginalLayer(l)
+		shadowLayer := original.Shadow()
+		if util.PathExist(shadowLayer.GetLayerPath()) {
+			shadowLayer.Remove()
+		}
+	}
+}
+
+// RemoveBackup removes the original image tar saved in the work dir when the image was shadowed.
+func RemoveBackup(imgName string, workDir string) {
+	if err := os.Remove(backupPath(workDir, imgName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		panic(err)
+	}
+}
+
+// ExportProfile collects the files accessed in each shadow layer of a shadowed image, keyed by layer diff id.
+// It does not change the filesystem.
+// It returns if shadowed, the profile.
+func ExportProfile(imgName string, eng engine.Engine, ctx *context.Context, db *state.DB) (bool, profile.Profile) {
+	imgInfo, err := eng.Inspect(*ctx, imgName)
 	if err != nil {
 		panic(err)
 	}
+	p := profile.NewProfile(imgName)
+	if !isShadowed(imgInfo.ID, db) {
+		log.Info("Image ", imgName, " not shadowed, no profile to export")
+		return false, p
+	}
+
+	// layer infos are from top to bottom, diff ids are from bottom to top
+	layerInfos := ExtractLayersInfo(eng, imgInfo)
+	diffIds := imgInfo.DiffIDs
+	if len(layerInfos) != len(diffIds) {
+		panic("number of shadow layers should be equal to diff ids")
+	}
+	for i, l := range layerInfos {
+		shadowLayer := image.NewShadowLayer(l)
+		p.AddLayer(diffIds[len(diffIds)-1-i], shadowLayer.AccessedFiles())
+	}
+	return true, p
+}
+
+// ShadowLayersOf returns the shadow layers of a shadowed or debloated image and their diff ids,
+// both from the top layer to the bottom one. It returns false if the image has no shadow layers.
+// Images debloated before the state existed are recognized by the shadow layers left next to the original ones.
+func ShadowLayersOf(imgName string, eng engine.Engine, ctx *context.Context, db *state.DB) (bool, []image.ShadowLayer, []string) {
+	imgInfo, err := eng.Inspect(*ctx, imgName)
+	if err != nil {
+		panic(err)
+	}
+	shadowed := isShadowed(imgInfo.ID, db)
+	if rec := db.Image(imgInfo.ID); rec != nil && rec.Status == state.Restored {
+		log.Info("Image ", imgName, " is restored, its shadow layers are removed")
+		return false, nil, nil
+	}
+	layerInfos := ExtractLayersInfo(eng, imgInfo)
+	diffIds := imgInfo.DiffIDs
+	if len(layerInfos) != len(diffIds) {
+		panic("number of layers should be equal to diff ids")
+	}
+
+	var shadowLayers []image.ShadowLayer
+	var topFirstDiffIds []string
+	for i, l := range layerInfos {
+		var shadowLayer image.ShadowLayer
+		if shadowed {
+			shadowLayer = image.NewShadowLayer(l)
+		} else {
+			// the cache-ids of a debloated image are restored, its shadow layers are left next to the original ones
+			original := image.NewOriginalLayer(l)
+			shadowLayer = original.Shadow()
+			if !util.PathExist(shadowLayer.GetLayerPath()) {
+				log.Info("Image ", imgName, " is neither shadowed nor debloated")
+				return false, nil, nil
+			}
+		}
+		shadowLayers = append(shadowLayers, shadowLayer)
+		topFirstDiffIds = append(topFirstDiffIds, diffIds[len(diffIds)-1-i])
+	}
+	return true, shadowLayers, topFirstDiffIds
+}
+
+// ApplyProfile debloats an image tar file offline, keeping only the files recorded in the profile.
+// It does not need docker, the debloated image is written to dst and tagged with a "-baffs" suffix.
+func ApplyProfile(imgTarPath string, p profile.Profile, dst string) {
+	untarPath, err := os.MkdirTemp("", "baffs-apply-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(untarPath)
+	untarImg(imgTarPath, untarPath)
+	imgsTarFs := image.ParseImgTarFs(untarPath)
+
+	// some images have multiple same layers, they are rewritten only once
+	rewritten := map[string]int{}
+	for i, l := range imgsTarFs.GetLayers() {
+		layerTarPath := l.GetLayerTarPath()
+		if j, ok := rewritten[layerTarPath]; ok {
+			imgsTarFs.ShareLayer(i, j)
+			continue
+		}
+		rewritten[layerTarPath] = i
+
+		diffId := imgsTarFs.GetImageJson().Rootfs.DiffIds[i]
+		kept, ok := p.Kept(diffId)
+		if !ok {
+			log.Warn("Layer ", diffId, " is not profiled, keep it unchanged")
+			continue
+		}
+		filteredPath := layerTarPath + ".filtered"
+		profile.FilterLayerTar(layerTarPath, filteredPath, kept)
+		if err := util.Move(filteredPath, layerTarPath); err != nil {
+			panic(err)
+		}
+		imgsTarFs.UpdateLayer(i)
+	}
+	imgsTarFs.DumpImgJson()
+
+	imgsTarFs.GetManifest()[0].RepoTags[0] = imgsTarFs.GetManifest()[0].RepoTags[0] + "-baffs"
+	imgsTarFs.DumpManifest()
+
+	log.Debug("target tar path: ", dst)
+	imgsTarFs.TarWholeFs(dst)
+}
+
+// LoadImage loads the generated image tar file.
+func LoadImage(imgTarPath string, eng engine.Engine, ctx *context.Context) {
+	// load the generated image tar file
+	imageFile, err := os.Open(imgTarPath)
+	if err != nil {
+		panic(err)
+	}
+	defer imageFile.Close()
+	if err := eng.Load(*ctx, imageFile); err != nil {
+		panic(err)
+	}
 }
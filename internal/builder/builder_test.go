@@ -22,24 +22,302 @@
 package builder
 
 import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
-	"github.com/docker/docker/api/types"
+	"github.com/negativa-ai/BLAFS/internal/engine"
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/profile"
+	"github.com/negativa-ai/BLAFS/internal/rules"
+	"github.com/negativa-ai/BLAFS/internal/state"
+	"github.com/negativa-ai/BLAFS/internal/util"
+	"github.com/negativa-ai/BLAFS/internal/vuln"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestExtractLayerName(t *testing.T) {
+func TestApplyProfile(t *testing.T) {
+	// a legacy image tar with a single layer
+	imgDir := t.TempDir()
+	rootfs := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc", "hosts"), []byte("127.0.0.1"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(imgDir, "abc"), 0755))
+	layerTar := filepath.Join(imgDir, "abc", "layer.tar")
+	util.TarFiles(rootfs, layerTar)
+	diffId, err := util.Sha256Sum(layerTar)
+	assert.NoError(t, err)
+	config := fmt.Sprintf(`{"rootfs":{"type":"layers","diff_ids":["sha256:%s"]}}`, diffId)
+	assert.NoError(t, os.WriteFile(filepath.Join(imgDir, "cfg.json"), []byte(config), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(imgDir, "manifest.json"),
+		[]byte(`[{"Config":"cfg.json","RepoTags":["a:b"],"Layers":["abc/layer.tar"]}]`), 0644))
+	imgTar := filepath.Join(t.TempDir(), "img.tar")
+	util.TarFiles(imgDir, imgTar)
 
-	mocked := types.GraphDriverData{
-		Data: map[string]string{
-			"MergedDir": "/var/lib/docker/overlay2/02bbe40378a44f8a88293229da146a33578eedbb9d7947808503722480e00505/merged",
-			"UpperDir":  "/var/lib/docker/overlay2/02bbe40378a44f8a88293229da146a33578eedbb9d7947808503722480e00505/diff",
-			"WorkDir":   "/var/lib/docker/overlay2/02bbe40378a44f8a88293229da146a33578eedbb9d7947808503722480e00505/work",
-		},
-		Name: "overlay2",
+	p := profile.NewProfile("a:b")
+	p.AddLayer("sha256:"+diffId, []string{"etc", "etc/hosts"})
+	dst := filepath.Join(t.TempDir(), "img.tar.debloated")
+
+	ApplyProfile(imgTar, p, dst)
+
+	outDir := t.TempDir()
+	_, err = exec.Command("tar", "-xf", dst, "-C", outDir).Output()
+	assert.NoError(t, err)
+	imgTarFs := image.ParseImgTarFs(outDir)
+	assert.Equal(t, "a:b-baffs", imgTarFs.GetManifest()[0].RepoTags[0])
+	newLayerTar := imgTarFs.GetLayers()[0].GetLayerTarPath()
+	newDiffId, err := util.Sha256Sum(newLayerTar)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+newDiffId, imgTarFs.GetImageJson().Rootfs.DiffIds[0])
+
+	f, err := os.Open(newLayerTar)
+	assert.NoError(t, err)
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, h.Name)
+	}
+	assert.Equal(t, []string{"./", "etc/", "etc/hosts"}, names)
+}
+
+func TestShadowImageSharedLayers(t *testing.T) {
+	ctx := context.Background()
+	workDir := t.TempDir()
+	eng := engine.NewFake(t.TempDir())
+	base := map[string]string{"etc/os-release": "ID=debian\n"}
+	app1 := eng.Build("app:1", base, map[string]string{"app/one": "1"})
+	app2 := eng.Build("app:2", base, map[string]string{"app/two": "2"})
+	db, err := state.Open(workDir)
+	assert.NoError(t, err)
+
+	shadowed, originalLayers, shadowLayers, newLayers := ShadowImage("app:1", workDir, eng, &ctx, "", db, nil)
+	assert.False(t, shadowed)
+	assert.Len(t, originalLayers, 2)
+	assert.Len(t, shadowLayers, 2)
+	assert.Len(t, newLayers, 2)
+	for _, l := range newLayers {
+		l.Dump(nil)
+	}
+	assert.Equal(t, state.Shadowed, db.Image(app1.ID).Status)
+	assert.FileExists(t, db.Image(app1.ID).Backup)
+
+	// the base layer is already shadowed, only the top layer of app:2 is created
+	shadowed, _, shadowLayers, newLayers = ShadowImage("app:2", workDir, eng, &ctx, "", db, nil)
+	assert.False(t, shadowed)
+	assert.Len(t, shadowLayers, 2)
+	assert.Len(t, newLayers, 1)
+	assert.Equal(t, shadowLayers[0].GetLayerPath(), newLayers[0].GetLayerPath())
+	for _, l := range newLayers {
+		l.Dump(nil)
+	}
+	baseKey := db.Image(app1.ID).Layers[1].Key
+	assert.Equal(t, baseKey, db.Image(app2.ID).Layers[1].Key)
+	assert.ElementsMatch(t, []string{app1.ID, app2.ID}, db.Referencing(baseKey))
+	assert.Equal(t, []string{"app:1", "app:2"}, eng.Saved)
+
+	shadowed, _, _, newLayers = ShadowImage("app:1", workDir, eng, &ctx, "", db, nil)
+	assert.True(t, shadowed)
+	assert.Empty(t, newLayers)
+
+	// images shadowed by an older version are recorded from their layers
+	legacy, err := state.Open(t.TempDir())
+	assert.NoError(t, err)
+	AdoptShadowedImages(legacy, workDir, eng, &ctx)
+	assert.Equal(t, state.Shadowed, legacy.Image(app2.ID).Status)
+	assert.ElementsMatch(t, []string{app1.ID, app2.ID}, legacy.Referencing(baseKey))
+}
+
+func TestKeepClosureSharedLayer(t *testing.T) {
+	ctx := context.Background()
+	workDir := t.TempDir()
+	eng := engine.NewFake(t.TempDir())
+	base := map[string]string{"etc/os-release": "ID=debian\n", "usr/share/doc/base/README": "doc"}
+	eng.Build("app:1", base, map[string]string{"app/one": "1"})
+	eng.Build("app:2", base, map[string]string{"app/two": "2"})
+	db, err := state.Open(workDir)
+	assert.NoError(t, err)
+	var shadowLayers []image.ShadowLayer
+	for _, name := range []string{"app:1", "app:2"} {
+		var newLayers []image.ShadowLayer
+		_, _, shadowLayers, newLayers = ShadowImage(name, workDir, eng, &ctx, "", db, nil)
+		for _, l := range newLayers {
+			l.Dump(nil)
+		}
+	}
+	shared := &shadowLayers[1]
+	realDoc := filepath.Join(shared.GetRealPath(), "usr/share/doc/base/README")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(realDoc), 0755))
+	assert.NoError(t, os.WriteFile(realDoc, []byte("doc"), 0644))
+
+	copyKept(shared, t.TempDir())
+	exportReport := keepClosure("app:2", shadowLayers, ExportOptions{TopN: -1, NoELF: true, Rules: rules.Rules{Drop: []string{"usr/share/doc/**"}}})
+
+	// the copy is exported without the dropped files, the real dir still mounted for app:1 is unchanged
+	assert.Equal(t, []string{"usr/share/doc"}, exportReport.Dropped)
+	assert.NoDirExists(t, filepath.Join(shared.GetKeptPath(), "usr/share/doc"))
+	assert.FileExists(t, realDoc)
+}
+
+func TestKeepClosureTopN(t *testing.T) {
+	ctx := context.Background()
+	workDir := t.TempDir()
+	eng := engine.NewFake(t.TempDir())
+	base := map[string]string{
+		"var/lib/dpkg/status":        "Package: foo\nStatus: install ok installed\nArchitecture: amd64\nVersion: 1\n",
+		"var/lib/dpkg/info/foo.list": "/usr/bin/foo\n",
+		"usr/bin/foo":                "foo",
+	}
+	top := map[string]string{
+		"var/lib/dpkg/status": "Package: foo\nStatus: install ok installed\nArchitecture: amd64\nVersion: 1\n\n" +
+			"Package: bar\nStatus: install ok installed\nArchitecture: amd64\nVersion: 1\n",
+		"var/lib/dpkg/info/bar.list": "/usr/bin/bar\n",
+		"usr/bin/bar":                "bar",
 	}
+	eng.Build("app:1", base, top)
+	db, err := state.Open(workDir)
+	assert.NoError(t, err)
+	_, _, shadowLayers, newLayers := ShadowImage("app:1", workDir, eng, &ctx, "", db, nil)
+	for _, l := range newLayers {
+		l.Dump(nil)
+	}
+	// only the dpkg status copied up to the top layer was accessed
+	status := filepath.Join(shadowLayers[0].GetRealPath(), "var/lib/dpkg/status")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(status), 0755))
+	assert.NoError(t, os.WriteFile(status, []byte(top["var/lib/dpkg/status"]), 0644))
+
+	keepClosure("app:1", shadowLayers, ExportOptions{TopN: 1, NoELF: true, RewritePkgDB: true})
+
+	// foo is shipped in full by the base layer, which is exported unchanged
+	data, err := os.ReadFile(status)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "Package: foo\n")
+	assert.NotContains(t, string(data), "Package: bar\n")
+	original := shadowLayers[1].Original()
+	data, err = os.ReadFile(filepath.Join(original.GetDiffPath(), "var/lib/dpkg/status"))
+	assert.NoError(t, err)
+	assert.Equal(t, base["var/lib/dpkg/status"], string(data))
+}
+
+func TestKeepClosureLicensesTopN(t *testing.T) {
+	ctx := context.Background()
+	workDir := t.TempDir()
+	eng := engine.NewFake(t.TempDir())
+	base := map[string]string{
+		"var/lib/dpkg/status":         "Package: foo\nStatus: install ok installed\nArchitecture: amd64\nVersion: 1\n",
+		"var/lib/dpkg/info/foo.list":  "/usr/bin/foo\n/usr/share/doc/foo/copyright\n",
+		"usr/bin/foo":                 "foo",
+		"usr/share/doc/foo/copyright": "old",
+	}
+	eng.Build("app:1", base, map[string]string{"usr/share/doc/foo/copyright": "new"})
+	db, err := state.Open(workDir)
+	assert.NoError(t, err)
+	_, _, shadowLayers, newLayers := ShadowImage("app:1", workDir, eng, &ctx, "", db, nil)
+	for _, l := range newLayers {
+		l.Dump(nil)
+	}
+
+	exportReport := keepClosure("app:1", shadowLayers, ExportOptions{TopN: 1, NoELF: true, Licenses: true})
+
+	// foo is shipped in full by the base layer, which is exported unchanged, its copyright in the top layer is kept
+	assert.Equal(t, []string{"usr/share/doc/foo/copyright"}, exportReport.Licenses)
+	assert.FileExists(t, filepath.Join(shadowLayers[0].GetKeptPath(), "usr/share/doc/foo/copyright"))
+	assert.Len(t, exportReport.manifest.Entries, 1)
+	assert.Equal(t, []string{"usr/share/doc/foo/copyright"}, exportReport.manifest.Entries[0].Files)
+	assert.NoFileExists(t, filepath.Join(shadowLayers[1].GetKeptPath(), "usr/bin/foo"))
+}
 
-	layerNames := extractLayerNames(mocked)
+func TestWriteVulndiff(t *testing.T) {
+	ctx := context.Background()
+	workDir := t.TempDir()
+	eng := engine.NewFake(t.TempDir())
+	base := map[string]string{
+		"etc/os-release":             "ID=debian\nVERSION_ID=12\n",
+		"var/lib/dpkg/status":        "Package: foo\nStatus: install ok installed\nArchitecture: amd64\nVersion: 1\n",
+		"var/lib/dpkg/info/foo.list": "/usr/bin/foo\n",
+		"usr/bin/foo":                "foo",
+	}
+	eng.Build("app:1", base, map[string]string{"app/one": "1"})
+	db, err := state.Open(workDir)
+	assert.NoError(t, err)
+	_, _, shadowLayers, newLayers := ShadowImage("app:1", workDir, eng, &ctx, "", db, nil)
+	for _, l := range newLayers {
+		l.Dump(nil)
+	}
+	osvDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(osvDir, "DSA-1.json"),
+		[]byte(`{"id": "DSA-1", "affected": [{"package": {"ecosystem": "Debian", "name": "foo"}, "versions": ["1"]}]}`), 0644))
+	read := func(dst string) vuln.Diff {
+		data, err := os.ReadFile(dst)
+		assert.NoError(t, err)
+		var d vuln.Diff
+		assert.NoError(t, json.Unmarshal(data, &d))
+		return d
+	}
+
+	// foo is not kept when all layers are debloated, but shipped in full when only the top layer is
+	dst := filepath.Join(t.TempDir(), "vulndiff.json")
+	WriteVulndiff(dst, "app:1", shadowLayers, -1, osvDir)
+	d := read(dst)
+	assert.Equal(t, 1, d.Original)
+	assert.Equal(t, 1, d.Unreachable)
+	WriteVulndiff(dst, "app:1", shadowLayers, 1, osvDir)
+	d = read(dst)
+	assert.Equal(t, 1, d.Original)
+	assert.Equal(t, 0, d.Unreachable)
+}
 
-	assert.Equal(t, len(layerNames), 1)
+func TestShadowImageLive(t *testing.T) {
+	ctx := context.Background()
+	workDir := t.TempDir()
+	eng := engine.NewFake(t.TempDir())
+	eng.Live = true
+	app := eng.Build("app:1", map[string]string{"etc/os-release": "ID=debian\n"}, map[string]string{"app/one": "1"})
+	original, err := eng.Inspect(ctx, "app:1")
+	assert.NoError(t, err)
+	db, err := state.Open(workDir)
+	assert.NoError(t, err)
+
+	_, _, shadowLayers, newLayers := ShadowImage("app:1", workDir, eng, &ctx, "", db, nil)
+	assert.Len(t, newLayers, 2)
+	for _, l := range newLayers {
+		l.Dump(nil)
+		assert.NoError(t, eng.Redirect(l, nil))
+	}
+	// the shadow layers are found through the l/ links, the cache-ids are unchanged
+	img, err := eng.Inspect(ctx, "app:1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{shadowLayers[0].GetLayerPath(), shadowLayers[1].GetLayerPath()}, img.Layers)
+	backups, err := filepath.Glob(filepath.Join(eng.RootDir, "image/overlay2/layerdb/sha256/*/cache-id.bak"))
+	assert.NoError(t, err)
+	assert.Empty(t, backups)
+
+	shadowed, released, err := RestoreImg("app:1", eng, &ctx, db, nil)
+	assert.NoError(t, err)
+	assert.True(t, shadowed)
+	assert.Len(t, released, 2)
+	for _, l := range released {
+		l.Restore(nil)
+		assert.NoError(t, eng.Unredirect(l, nil))
+	}
+	RemoveShadowLayers("app:1", eng, &ctx, db)
+	for _, l := range shadowLayers {
+		assert.NoDirExists(t, l.GetLayerPath())
+	}
+	img, err = eng.Inspect(ctx, "app:1")
+	assert.NoError(t, err)
+	assert.Equal(t, original.Layers, img.Layers)
+	assert.Equal(t, state.Restored, db.Image(app.ID).Status)
 }
@@ -0,0 +1,283 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package elfdeps
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Dependency is a file kept because a kept ELF file needs it.
+type Dependency struct {
+	Path     string `json:"path"`      // kept path, relative to the image root
+	Name     string `json:"name"`      // DT_NEEDED entry or interpreter
+	NeededBy string `json:"needed_by"` // ELF file needing it
+}
+
+// an object is an ELF file in the merged view of a stack
+type object struct {
+	name string // resolved path, relative to the image root
+	file *elf.File
+}
+
+// analyzer resolves dependencies of ELF files as ld.so does, against the original layers of a stack.
+type analyzer struct {
+	stack       image.LayerStack
+	defaultDirs []string
+	visited     map[string]bool
+	queue       []string
+	deps        []Dependency
+}
+
+// Closure keeps the interpreters and DT_NEEDED libraries of all kept ELF files of a stack, recursively.
+// Libraries are searched in RPATH, RUNPATH, ld.so.conf (or the musl path file) and the default dirs.
+// Libraries loaded with dlopen cannot be found statically. It returns the dependencies newly kept.
+func Closure(stack image.LayerStack) []Dependency {
+	a := &analyzer{stack: stack, visited: map[string]bool{}}
+	a.defaultDirs = a.searchDirs()
+	stack.WalkKept(func(l image.StackLayer, relPath string, d fs.DirEntry) {
+		// empty files are either placeholders of files never opened, or no ELF files
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+			a.queue = append(a.queue, relPath)
+		}
+	})
+	for len(a.queue) > 0 {
+		name := a.queue[0]
+		a.queue = a.queue[1:]
+		a.analyze(name)
+	}
+	return a.deps
+}
+
+// open opens an ELF file of the merged view, it returns nil if the file is missing or not an ELF file.
+func (a *analyzer) open(name string) *object {
+	realPath, ok := a.stack.Realpath(name)
+	if !ok {
+		return nil
+	}
+	originPath, ok := a.stack.OriginPath(realPath)
+	if !ok {
+		return nil
+	}
+	f, err := elf.Open(originPath)
+	if err != nil {
+		return nil
+	}
+	return &object{name: realPath, file: f}
+}
+
+func (a *analyzer) analyze(name string) {
+	o := a.open(name)
+	if o == nil {
+		return
+	}
+	defer o.file.Close()
+	if a.visited[o.name] {
+		return
+	}
+	a.visited[o.name] = true
+
+	if interp := interpreter(o.file); interp != "" {
+		a.keep(interp, interp, o.name)
+	}
+	needed, err := o.file.ImportedLibraries()
+	if err != nil {
+		log.Debug("cannot read dynamic section of ", o.name, ": ", err)
+		return
+	}
+	for _, lib := range needed {
+		if libPath := a.find(o, lib); libPath != "" {
+			a.keep(libPath, lib, o.name)
+		} else {
+			log.Warn("library ", lib, " needed by /", o.name, " not found in image")
+		}
+	}
+}
+
+// keep keeps a dependency with its symlinks, and queues it for analysis.
+func (a *analyzer) keep(depPath string, name string, neededBy string) {
+	depPath = strings.TrimPrefix(depPath, "/")
+	for _, p := range a.stack.KeepResolved(depPath) {
+		a.deps = append(a.deps, Dependency{Path: p, Name: name, NeededBy: neededBy})
+	}
+	a.queue = append(a.queue, depPath)
+}
+
+// find returns the path of a library needed by an object, or "" if not found.
+func (a *analyzer) find(o *object, lib string) string {
+	if strings.Contains(lib, "/") {
+		return lib
+	}
+	var dirs []string
+	runpath, _ := o.file.DynString(elf.DT_RUNPATH)
+	if len(runpath) == 0 {
+		rpath, _ := o.file.DynString(elf.DT_RPATH)
+		dirs = append(dirs, a.expand(o, rpath)...)
+	}
+	dirs = append(dirs, a.expand(o, runpath)...)
+	dirs = append(dirs, a.defaultDirs...)
+	for _, dir := range dirs {
+		candidate := path.Join(dir, lib)
+		if c := a.open(candidate); c != nil {
+			compatible := c.file.Class == o.file.Class && c.file.Machine == o.file.Machine
+			c.file.Close()
+			if compatible {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// expand splits RPATH or RUNPATH entries and substitutes $ORIGIN and $LIB.
+func (a *analyzer) expand(o *object, entries []string) []string {
+	lib := "lib"
+	if o.file.Class == elf.ELFCLASS64 {
+		lib = "lib64"
+	}
+	var dirs []string
+	for _, entry := range entries {
+		for _, dir := range strings.Split(entry, ":") {
+			if dir == "" {
+				continue
+			}
+			dir = strings.NewReplacer(
+				"${ORIGIN}", "/"+path.Dir(o.name), "$ORIGIN", "/"+path.Dir(o.name),
+				"${LIB}", lib, "$LIB", lib,
+			).Replace(dir)
+			if strings.Contains(dir, "$") {
+				// $PLATFORM depends on the host
+				continue
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// searchDirs returns the dirs configured in ld.so.conf and musl path files, followed by the default dirs.
+func (a *analyzer) searchDirs() []string {
+	var dirs []string
+	for _, conf := range a.glob("etc/ld-musl-*.path") {
+		for _, line := range a.readLines(conf) {
+			dirs = append(dirs, strings.Split(line, ":")...)
+		}
+	}
+	dirs = append(dirs, a.ldSoConf("etc/ld.so.conf", 0)...)
+	return append(dirs, "/lib", "/usr/lib", "/lib64", "/usr/lib64", "/usr/local/lib")
+}
+
+// ldSoConf parses an ld.so.conf file and its includes.
+func (a *analyzer) ldSoConf(conf string, depth int) []string {
+	if depth > 8 {
+		return nil
+	}
+	var dirs []string
+	for _, line := range a.readLines(conf) {
+		fields := strings.Fields(line)
+		if fields[0] == "include" {
+			for _, pattern := range fields[1:] {
+				if !path.IsAbs(pattern) {
+					pattern = path.Join(path.Dir("/"+conf), pattern)
+				}
+				for _, included := range a.glob(pattern) {
+					dirs = append(dirs, a.ldSoConf(included, depth+1)...)
+				}
+			}
+			continue
+		}
+		dirs = append(dirs, fields...)
+	}
+	return dirs
+}
+
+// glob returns the paths of the merged view matching a pattern, in lexical order.
+func (a *analyzer) glob(pattern string) []string {
+	pattern = strings.TrimPrefix(pattern, "/")
+	set := map[string]bool{}
+	for _, l := range a.stack {
+		matches, _ := filepath.Glob(filepath.Join(l.Origin, pattern))
+		for _, m := range matches {
+			if relPath, err := filepath.Rel(l.Origin, m); err == nil && a.stack.Lookup(relPath) != -1 {
+				set[relPath] = true
+			}
+		}
+	}
+	paths := make([]string, 0, len(set))
+	for p := range set {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// readLines returns the non-empty lines of a file of the merged view without comments.
+func (a *analyzer) readLines(name string) []string {
+	realPath, ok := a.stack.Realpath(strings.TrimPrefix(name, "/"))
+	if !ok {
+		return nil
+	}
+	originPath, ok := a.stack.OriginPath(realPath)
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(originPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// interpreter returns the program interpreter of an ELF file, or "" for static binaries and libraries.
+func interpreter(f *elf.File) string {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return ""
+		}
+		return string(bytes.TrimRight(data, "\x00"))
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package elfdeps
+
+import (
+	"debug/elf"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image/imagetest"
+	"github.com/negativa-ai/BLAFS/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// hostLib returns the path of a shared library of the host, or "" if not found.
+func hostLib(name string) string {
+	dirs, _ := filepath.Glob("/lib/*-linux-gnu")
+	usrDirs, _ := filepath.Glob("/usr/lib/*-linux-gnu")
+	dirs = append(append(dirs, usrDirs...), "/lib64", "/usr/lib64", "/lib", "/usr/lib")
+	for _, dir := range dirs {
+		if p, err := filepath.EvalSymlinks(filepath.Join(dir, name)); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+func copyHostFile(t *testing.T, src string, dst string) {
+	real, err := filepath.EvalSymlinks(src)
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(dst), 0755))
+	util.CopyFile(real, dst)
+}
+
+func TestClosure(t *testing.T) {
+	f, err := elf.Open("/bin/ls")
+	if err != nil {
+		t.Skip("no ELF binary on host: ", err)
+	}
+	interp := interpreter(f)
+	f.Close()
+	if interp == "" {
+		t.Skip("/bin/ls is static")
+	}
+
+	stack := imagetest.NewStack(t, 2)
+	top, bottom := stack[0], stack[1]
+	copyHostFile(t, "/bin/ls", filepath.Join(top.Origin, "bin/ls"))
+	copyHostFile(t, "/bin/ls", filepath.Join(top.Kept, "bin/ls"))
+
+	// libraries live in /opt/lib, found through ld.so.conf, the interpreter is a symlink to it
+	imagetest.WriteFile(t, filepath.Join(bottom.Origin, "etc/ld.so.conf"), "include /etc/ld.so.conf.d/*.conf\n")
+	imagetest.WriteFile(t, filepath.Join(bottom.Origin, "etc/ld.so.conf.d/opt.conf"), "# opt\n/opt/lib\n")
+	copyHostFile(t, interp, filepath.Join(bottom.Origin, "opt/lib", path.Base(interp)))
+	assert.NoError(t, os.MkdirAll(filepath.Join(bottom.Origin, path.Dir(interp)), 0755))
+	assert.NoError(t, os.Symlink("/opt/lib/"+path.Base(interp), filepath.Join(bottom.Origin, interp)))
+	expected := []string{path.Join("opt/lib", path.Base(interp)), interp[1:]}
+	queue := []string{"/bin/ls"}
+	for len(queue) > 0 {
+		f, err := elf.Open(queue[0])
+		assert.NoError(t, err)
+		queue = queue[1:]
+		libs, err := f.ImportedLibraries()
+		f.Close()
+		assert.NoError(t, err)
+		for _, lib := range libs {
+			dst := filepath.Join(bottom.Origin, "opt/lib", lib)
+			if util.PathExist(dst) {
+				continue
+			}
+			src := hostLib(lib)
+			if src == "" {
+				t.Skip("library not found on host: ", lib)
+			}
+			copyHostFile(t, src, dst)
+			expected = append(expected, path.Join("opt/lib", lib))
+			queue = append(queue, src)
+		}
+	}
+	// an unused library is not kept
+	copyHostFile(t, interp, filepath.Join(bottom.Origin, "opt/lib/unused.so"))
+
+	deps := Closure(stack)
+
+	var kept []string
+	for _, d := range deps {
+		kept = append(kept, d.Path)
+	}
+	assert.ElementsMatch(t, expected, kept)
+	for _, p := range expected {
+		_, err := os.Lstat(filepath.Join(bottom.Kept, p))
+		assert.NoError(t, err)
+	}
+	assert.NoFileExists(t, filepath.Join(bottom.Kept, "opt/lib/unused.so"))
+	assert.Empty(t, Closure(stack))
+}
+
+func TestExpand(t *testing.T) {
+	f, err := elf.Open("/bin/ls")
+	if err != nil {
+		t.Skip("no ELF binary on host: ", err)
+	}
+	defer f.Close()
+	a := &analyzer{}
+	o := &object{name: "usr/bin/app", file: f}
+
+	dirs := a.expand(o, []string{"$ORIGIN/../lib:/opt/${LIB}:/p/$PLATFORM", ""})
+
+	lib := "lib"
+	if f.Class == elf.ELFCLASS64 {
+		lib = "lib64"
+	}
+	assert.Equal(t, []string{"/usr/bin/../lib", "/opt/" + lib}, dirs)
+}
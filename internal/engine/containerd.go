@@ -0,0 +1,385 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/journal"
+	"github.com/negativa-ai/BLAFS/internal/util"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultContainerdRoot is the root of the overlayfs snapshotter of containerd.
+const DefaultContainerdRoot = "/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs"
+
+/*
+Containerd is the containerd engine with the overlayfs snapshotter, organized as follows:
+
+	{root_dir}/
+		snapshots/{id}/fs
+		baffs/
+			{id}/diff -> ../../snapshots/{id}/fs
+			{id}/link
+			shadow_{id}/diff, real, link, lower
+			l/{id} -> ../{id}/diff
+
+The snapshot of a layer is named by its chain id, but its directory by an id only known to the snapshotter,
+so images and snapshots are resolved with ctr. baffs/ holds the layers as seen by baffs, next to their shadow layers:
+containerd removes unknown directories from snapshots/.
+Redirect moves the files of a snapshot to baffs/{id}/diff and links snapshots/{id}/fs to the shadow layer instead.
+containerd computes the mounts of each new container from the snapshot ids, so redirecting takes effect without reloading.
+*/
+type Containerd struct {
+	address   string
+	namespace string
+	rootDir   string
+	ctr       func(args ...string) ([]byte, error) // runs ctr and returns its output
+}
+
+// NewContainerd returns the containerd engine listening on address, for images in namespace,
+// with the overlayfs snapshotter rooted at rootDir.
+func NewContainerd(address string, namespace string, rootDir string) *Containerd {
+	c := &Containerd{address: address, namespace: namespace, rootDir: rootDir}
+	c.ctr = c.run
+	return c
+}
+
+// run runs a ctr command on the namespace.
+func (c *Containerd) run(args ...string) ([]byte, error) {
+	cmd := exec.Command("ctr", append([]string{"--address", c.address, "--namespace", c.namespace}, args...)...)
+	log.Debug(cmd)
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("ctr %s: %w: %s", strings.Join(args, " "), err, exitErr.Stderr)
+	}
+	return out, err
+}
+
+func (c *Containerd) Name() string {
+	return "containerd"
+}
+
+func (c *Containerd) StorageDir() string {
+	return filepath.Join(c.rootDir, "baffs")
+}
+
+// fsPath returns the directory of a snapshot mounted by containerd.
+func (c *Containerd) fsPath(id string) string {
+	return filepath.Join(c.rootDir, "snapshots", id, "fs")
+}
+
+// images lists the images of the namespace, without their layers. Images are identified by their config digest.
+func (c *Containerd) images() ([]Image, error) {
+	out, err := c.ctr("images", "ls")
+	if err != nil {
+		return nil, err
+	}
+	var images []Image
+	byId := map[string]int{}
+	for i, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		// REF TYPE DIGEST SIZE PLATFORMS LABELS
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 3 {
+			continue
+		}
+		id, diffIds, err := c.config(fields[2])
+		if err != nil {
+			log.Debug("Skipping image ", fields[0], ": ", err)
+			continue
+		}
+		if k, ok := byId[id]; ok {
+			images[k].Names = append(images[k].Names, fields[0])
+			continue
+		}
+		byId[id] = len(images)
+		images = append(images, Image{ID: id, Names: []string{fields[0]}, DiffIDs: diffIds})
+	}
+	return images, nil
+}
+
+// config returns the config digest and the diff ids of a manifest, or of the manifest of the current platform in an index.
+func (c *Containerd) config(digest string) (string, []string, error) {
+	data, err := c.ctr("content", "get", digest)
+	if err != nil {
+		return "", nil, err
+	}
+	var m struct {
+		Manifests []ispec.Descriptor `json:"manifests"`
+		Config    ispec.Descriptor   `json:"config"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", nil, err
+	}
+	if len(m.Manifests) > 0 {
+		for _, desc := range m.Manifests {
+			if desc.Platform != nil && desc.Platform.OS == runtime.GOOS && desc.Platform.Architecture == runtime.GOARCH {
+				return c.config(desc.Digest.String())
+			}
+		}
+		return "", nil, fmt.Errorf("index %s has no manifest for %s/%s", digest, runtime.GOOS, runtime.GOARCH)
+	}
+	if data, err = c.ctr("content", "get", m.Config.Digest.String()); err != nil {
+		return "", nil, err
+	}
+	var config ispec.Image
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", nil, err
+	}
+	var diffIds []string
+	for _, diffId := range config.RootFS.DiffIDs {
+		diffIds = append(diffIds, diffId.String())
+	}
+	return m.Config.Digest.String(), diffIds, nil
+}
+
+func (c *Containerd) Inspect(ctx context.Context, ref string) (Image, error) {
+	images, err := c.images()
+	if err != nil {
+		return Image{}, err
+	}
+	id := strings.TrimPrefix(ref, "sha256:")
+	for _, img := range images {
+		imgId := strings.TrimPrefix(img.ID, "sha256:")
+		if imgId == id || (len(id) >= 12 && strings.HasPrefix(imgId, id)) || matchName(img.Names, ref) {
+			return img, c.resolve(&img)
+		}
+	}
+	return Image{}, fmt.Errorf("image %s not found in namespace %s", ref, c.namespace)
+}
+
+func (c *Containerd) List(ctx context.Context) ([]Image, error) {
+	images, err := c.images()
+	if err != nil {
+		return nil, err
+	}
+	var result []Image
+	for _, img := range images {
+		if err := c.resolve(&img); err != nil {
+			log.Debug("Skipping image ", img.Names, ": ", err)
+			continue
+		}
+		result = append(result, img)
+	}
+	return result, nil
+}
+
+// resolve finds the snapshot of each layer of an image, from the mounts of a view of its top snapshot.
+// Redirected snapshots are resolved to their shadow layer.
+func (c *Containerd) resolve(img *Image) error {
+	if len(img.DiffIDs) == 0 {
+		return fmt.Errorf("image %s has no layers", img.ID)
+	}
+	chainId := img.DiffIDs[0]
+	for _, diffId := range img.DiffIDs[1:] {
+		chainId = "sha256:" + generateChainId(chainId, diffId)
+	}
+	key := "baffs-view-" + chainId
+	out, err := c.ctr("snapshots", "--snapshotter", "overlayfs", "view", "--mounts", key, chainId)
+	if err != nil {
+		return err
+	}
+	if _, err := c.ctr("snapshots", "--snapshotter", "overlayfs", "rm", key); err != nil {
+		log.Warn("Cannot remove snapshot ", key, ": ", err)
+	}
+	var mounts []struct {
+		Type    string
+		Source  string
+		Options []string
+	}
+	if err := json.Unmarshal(out, &mounts); err != nil {
+		return err
+	}
+	// a single layer is bind mounted, the lowerdir of several layers lists them from the top layer to the bottom one
+	var dirs []string
+	for _, m := range mounts {
+		if m.Type == "bind" {
+			dirs = append(dirs, m.Source)
+		}
+		for _, opt := range m.Options {
+			if lowers, ok := strings.CutPrefix(opt, "lowerdir="); ok {
+				dirs = append(dirs, strings.Split(lowers, ":")...)
+			}
+		}
+	}
+	if len(dirs) != len(img.DiffIDs) {
+		return fmt.Errorf("image %s has %d layers but %d snapshots", img.ID, len(img.DiffIDs), len(dirs))
+	}
+	img.Layers = nil
+	for _, dir := range dirs {
+		id := filepath.Base(filepath.Dir(dir))
+		layerDir := filepath.Join(c.StorageDir(), id)
+		if target, err := os.Readlink(c.fsPath(id)); err == nil {
+			layerDir = filepath.Join(c.StorageDir(), filepath.Base(filepath.Dir(target)))
+		}
+		img.Layers = append(img.Layers, layerDir)
+	}
+	return nil
+}
+
+// Layers returns the layers of an image in baffs/, which are created the first time the image is seen.
+func (c *Containerd) Layers(img Image) ([]image.LayerInfo, error) {
+	var layerInfos []image.LayerInfo
+	for _, dir := range img.Layers {
+		if !strings.HasPrefix(filepath.Base(dir), "shadow_") {
+			if err := c.view(filepath.Base(dir)); err != nil {
+				return nil, err
+			}
+		}
+		layerInfos = append(layerInfos, *image.NewLayerInfo(dir))
+	}
+	return layerInfos, nil
+}
+
+// view creates the layer of a snapshot in baffs/, its diff links to the snapshot.
+func (c *Containerd) view(id string) error {
+	dir := filepath.Join(c.StorageDir(), id)
+	if util.PathExist(filepath.Join(dir, "link")) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(c.StorageDir(), "l"), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := c.linkSnapshot(id, nil); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	if err := os.Symlink(filepath.Join("..", id, "diff"), filepath.Join(c.StorageDir(), "l", id)); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "link"), []byte(id), 0644)
+}
+
+// linkSnapshot links the diff of a layer in baffs/ to its snapshot.
+func (c *Containerd) linkSnapshot(id string, j *journal.Journal) error {
+	diffPath := filepath.Join(c.StorageDir(), id, "diff")
+	target, err := filepath.Rel(filepath.Dir(diffPath), c.fsPath(id))
+	if err != nil {
+		return err
+	}
+	j.Record(journal.Symlink(diffPath))
+	return os.Symlink(target, diffPath)
+}
+
+// Save writes an image exported by ctr, an OCI layout with the manifest.json of docker save.
+func (c *Containerd) Save(ctx context.Context, ref string, w io.Writer) error {
+	tmp, err := os.MkdirTemp("", "baffs-containerd-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	archive := filepath.Join(tmp, "image.tar")
+	if _, err := c.ctr("images", "export", archive, ref); err != nil {
+		return err
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Load imports an image tar into the content store and unpacks it, it is named by the RepoTags of its manifest.json.
+func (c *Containerd) Load(ctx context.Context, r io.Reader) error {
+	tmp, err := os.MkdirTemp("", "baffs-containerd-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	archive := filepath.Join(tmp, "image.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	out, err := c.ctr("images", "import", archive)
+	log.Info(strings.TrimSpace(string(out)))
+	return err
+}
+
+// Redirect moves the files of the snapshot of the original layer to its diff in baffs/,
+// and links the snapshot to the diff of the shadow layer.
+func (c *Containerd) Redirect(l image.ShadowLayer, j *journal.Journal) error {
+	original := l.Original()
+	fsPath := c.fsPath(filepath.Base(original.GetLayerPath()))
+	if _, err := os.Readlink(fsPath); err == nil {
+		return nil
+	}
+	j.Record(journal.Relink(original.GetDiffPath()))
+	if err := os.Remove(original.GetDiffPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	j.Record(journal.Move(fsPath, original.GetDiffPath()))
+	if err := util.Move(fsPath, original.GetDiffPath()); err != nil {
+		return err
+	}
+	target, err := filepath.Rel(filepath.Dir(fsPath), l.GetDiffPath())
+	if err != nil {
+		return err
+	}
+	j.Record(journal.Symlink(fsPath))
+	return os.Symlink(target, fsPath)
+}
+
+// Unredirect moves the files of the original layer back to its snapshot, it is the counterpart of Redirect.
+func (c *Containerd) Unredirect(l image.ShadowLayer, j *journal.Journal) error {
+	original := l.Original()
+	id := filepath.Base(original.GetLayerPath())
+	fsPath := c.fsPath(id)
+	if _, err := os.Readlink(fsPath); err != nil {
+		return nil
+	}
+	j.Record(journal.Relink(fsPath))
+	if err := os.Remove(fsPath); err != nil {
+		return err
+	}
+	j.Record(journal.Move(original.GetDiffPath(), fsPath))
+	if err := util.Move(original.GetDiffPath(), fsPath); err != nil {
+		return err
+	}
+	return c.linkSnapshot(id, j)
+}
+
+// Reload does nothing, containerd reads the redirected snapshots when mounting them.
+func (c *Containerd) Reload(ctx context.Context) error {
+	return nil
+}
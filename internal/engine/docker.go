@@ -0,0 +1,299 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	dockerimage "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/journal"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Docker is the docker engine with the overlay2 storage driver.
+Layers are under {root_dir}/overlay2, their metadata under {root_dir}/image/overlay2/layerdb.
+
+Docker keeps the cache-ids of layers in memory, a layer redirected by its cache-id is only found once docker is restarted.
+A live engine redirects the l/ link of a layer instead, as podman, leaving its cache-id unchanged:
+docker resolves the links when mounting each new container, without restarting.
+*/
+type Docker struct {
+	cli       *client.Client
+	rootDir   string
+	restarter Restarter
+	timeout   time.Duration // time to wait for docker to be healthy once restarted
+	live      bool
+}
+
+// NewDocker returns the docker engine served by the client, which is restarted by restarter when reloading.
+// If live is set, layers are redirected by their l/ links and docker is never restarted.
+func NewDocker(ctx context.Context, cli *client.Client, restarter Restarter, timeout time.Duration, live bool) (*Docker, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Docker{cli: cli, rootDir: info.DockerRootDir, restarter: restarter, timeout: timeout, live: live}, nil
+}
+
+func (d *Docker) Name() string {
+	return "docker"
+}
+
+func (d *Docker) StorageDir() string {
+	return filepath.Join(d.rootDir, "overlay2")
+}
+
+func (d *Docker) Inspect(ctx context.Context, ref string) (Image, error) {
+	imgInfo, _, err := d.cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return Image{}, err
+	}
+	if imgInfo.GraphDriver.Name != "overlay2" {
+		return Image{}, fmt.Errorf("image %s is stored by %q, only overlay2 is supported, "+
+			"images in the containerd image store are handled by the containerd engine", ref, imgInfo.GraphDriver.Name)
+	}
+	img := Image{ID: imgInfo.ID, Names: imgInfo.RepoTags, DiffIDs: imgInfo.RootFS.Layers}
+	for _, name := range extractLayerNames(imgInfo.GraphDriver) {
+		// docker resolves the l/ links of the lower dirs, but not of the upper dir
+		img.Layers = append(img.Layers, linkedLayer(d.StorageDir(), filepath.Join(d.StorageDir(), name)))
+	}
+	return img, nil
+}
+
+func (d *Docker) List(ctx context.Context) ([]Image, error) {
+	summaries, err := d.cli.ImageList(ctx, dockerimage.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var images []Image
+	for _, summary := range summaries {
+		img, err := d.Inspect(ctx, summary.ID)
+		if err != nil {
+			log.Debug("Skipping image ", summary.RepoTags, ": ", err)
+			continue
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func (d *Docker) Layers(img Image) ([]image.LayerInfo, error) {
+	return resolveLayers(img, d.StorageDir(), filepath.Join(d.rootDir, "image/overlay2/layerdb/sha256"), d.live)
+}
+
+func (d *Docker) Save(ctx context.Context, ref string, w io.Writer) error {
+	reader, err := d.cli.ImageSave(ctx, []string{ref})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+func (d *Docker) Load(ctx context.Context, r io.Reader) error {
+	imageResponse, err := d.cli.ImageLoad(ctx, r, false)
+	if err != nil {
+		return err
+	}
+	defer imageResponse.Body.Close()
+	_, err = io.Copy(os.Stdout, imageResponse.Body)
+	return err
+}
+
+// Redirect points the l/ link of the original layer to the diff of the shadow layer if the engine is live.
+// Otherwise it does nothing, the cache-id of the layer is redirected by image.ShadowLayer.Dump.
+func (d *Docker) Redirect(l image.ShadowLayer, j *journal.Journal) error {
+	if !d.live {
+		return nil
+	}
+	return redirectLink(d.StorageDir(), l, j)
+}
+
+// Unredirect points the l/ link of the original layer back to its diff, if it points to the shadow layer.
+// The cache-id of the layer is restored by image.ShadowLayer.Restore.
+func (d *Docker) Unredirect(l image.ShadowLayer, j *journal.Journal) error {
+	return unredirectLink(d.StorageDir(), l, j)
+}
+
+// Reload restarts docker and waits until it answers pings again, unless the engine is live.
+// Running containers are reported first, docker stops them unless live-restore is enabled.
+func (d *Docker) Reload(ctx context.Context) error {
+	if d.live {
+		log.Debug("Not restarting docker, layers are redirected by their l/ links")
+		return nil
+	}
+	d.reportRunning(ctx)
+	log.Info("Restarting docker")
+	if err := d.restarter.Restart(); err != nil {
+		return fmt.Errorf("restart docker: %w", err)
+	}
+	return d.waitHealthy(ctx)
+}
+
+// reportRunning warns about the containers running before docker is restarted.
+func (d *Docker) reportRunning(ctx context.Context) {
+	containers, err := d.cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		log.Warn("Cannot list running containers: ", err)
+		return
+	}
+	if len(containers) == 0 {
+		return
+	}
+	liveRestore := false
+	if info, err := d.cli.Info(ctx); err == nil {
+		liveRestore = info.LiveRestoreEnabled
+	}
+	for _, c := range containers {
+		log.Warn("Container ", strings.TrimPrefix(strings.Join(c.Names, ","), "/"), " (", c.Image, ") is running")
+	}
+	if liveRestore {
+		log.Warn(len(containers), " containers keep running with live-restore, but still use the layers they were started with")
+	} else {
+		log.Warn(len(containers), " containers are stopped by restarting docker")
+	}
+}
+
+// waitHealthy pings docker until it answers, or the timeout expires.
+func (d *Docker) waitHealthy(ctx context.Context) error {
+	deadline := time.Now().Add(d.timeout)
+	for {
+		_, err := d.cli.Ping(ctx)
+		if err == nil {
+			log.Debug("Docker is healthy")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("docker is not healthy %s after restarting: %w", d.timeout, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// extractLayerNames extracts the overlay2 directory names of the layers of an image, from top to bottom.
+func extractLayerNames(graphDriver types.GraphDriverData) []string {
+	var allLayers []string
+	upper := graphDriver.Data["UpperDir"]
+	allLayers = append(allLayers, upper)
+	if lower, ok := graphDriver.Data["LowerDir"]; ok {
+		allLowers := strings.Split(lower, ":")
+		allLayers = append(allLayers, allLowers...)
+	}
+
+	var layerNames []string
+	for _, layer := range allLayers {
+		tmp := strings.Split(layer, "/")
+		layerName := tmp[len(tmp)-2]
+		layerNames = append(layerNames, layerName)
+	}
+	return layerNames
+}
+
+// generateChainId generates a chain id from previous chain id and diff id.
+// See https://www.baeldung.com/linux/docker-image-storage-host
+// It returns a chain id.
+func generateChainId(preChainId string, diffId string) string {
+	str := preChainId + " " + diffId
+	chainId := fmt.Sprintf("%x", sha256.Sum256([]byte(str)))
+	return chainId
+
+}
+
+// resolveLayers finds the layerdb entry of each layer of an image, by the chain ids of its diff ids.
+// A layer redirected by its l/ link is found by the cache-id of its original layer, which Dump and Restore leave unchanged.
+// It returns the layer infos from top to bottom.
+func resolveLayers(img Image, overlayPath string, layerdbPath string, live bool) ([]image.LayerInfo, error) {
+	layerInfos := []image.LayerInfo{}
+	for _, p := range img.Layers {
+		l := image.NewLayerInfo(p)
+		layerInfos = append(layerInfos, *l)
+	}
+	if len(img.DiffIDs) == 0 {
+		return nil, fmt.Errorf("image %s has no layers", img.ID)
+	}
+
+	rootfsLayers := img.DiffIDs
+	chainId := rootfsLayers[0]
+
+	// generate layer meta info for each layer
+	count := 1
+	for {
+		dirName := strings.Split(chainId, ":")[1]
+		// read layer size
+		layerDir := filepath.Join(layerdbPath, dirName)
+		cacheIdDir := filepath.Join(layerDir, "cache-id")
+		cacheId, err := os.ReadFile(cacheIdDir)
+		if err != nil {
+			return nil, err
+		}
+		cacheIdStr := string(cacheId)
+		expectedAbsDir := filepath.Join(overlayPath, cacheIdStr)
+
+		// find corresponsding original layer
+		i := 0
+		linked := false
+		for ; i < len(layerInfos); i++ {
+			log.Debug("layer path: ", layerInfos[i].GetLayerPath(), " expected path: ", expectedAbsDir)
+			if layerInfos[i].GetLayerPath() == expectedAbsDir {
+				break
+			}
+			if layerInfos[i].GetLayerPath() == filepath.Join(overlayPath, "shadow_"+cacheIdStr) {
+				linked = true
+				break
+			}
+		}
+		if i == len(layerInfos) {
+			return nil, fmt.Errorf("layer %s of image %s not found", expectedAbsDir, img.ID)
+		}
+
+		layerInfos[i].SetMetaPath(layerDir)
+		// a live engine does not redirect cache-ids, unless they were redirected before
+		if !linked && (!live || strings.HasPrefix(cacheIdStr, "shadow_")) {
+			layerInfos[i].SetCacheIdPath(cacheIdDir)
+		}
+		layerInfos[i].SetCacheId(cacheIdStr)
+		layerInfos[i].SetSizePath(filepath.Join(layerDir, "size"))
+
+		if count >= len(rootfsLayers) {
+			break
+		}
+		// generate new chain_id
+		diffId := rootfsLayers[count]
+		chainId = generateChainId(chainId, diffId)
+		chainId = "sha256:" + chainId
+		count++
+	}
+	return layerInfos, nil
+}
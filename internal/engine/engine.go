@@ -0,0 +1,117 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/journal"
+)
+
+// An Image is an image as seen by a container engine.
+type Image struct {
+	ID      string   // digest of the image config
+	Names   []string // tags of the image
+	DiffIDs []string // from the bottom layer to the top one
+	Layers  []string // directory of each layer in the storage, from the top layer to the bottom one
+}
+
+/*
+An Engine is a container engine storing images in overlay layers, e.g., docker with the overlay2 storage driver.
+The shadowing logic only goes through an Engine, so that it does not depend on where and how an engine stores images.
+
+Layers of an image are resolved into image.LayerInfo. An engine finds a layer either by its metadata, e.g., the cache-id
+of docker, which image.ShadowLayer.Dump redirects to the shadow layer, or by other means redirected by Redirect.
+Redirecting a layer only takes effect once the engine is reloaded.
+*/
+type Engine interface {
+	// Name returns the name of the engine.
+	Name() string
+	// StorageDir returns the directory holding the layers of all images.
+	StorageDir() string
+	// Inspect returns an image by name or id.
+	Inspect(ctx context.Context, ref string) (Image, error)
+	// List returns all images.
+	List(ctx context.Context) ([]Image, error)
+	// Layers resolves the layers of an image with their metadata, from the top layer to the bottom one.
+	Layers(img Image) ([]image.LayerInfo, error)
+	// Save writes an image to w as a tar, in the format of docker save.
+	Save(ctx context.Context, ref string, w io.Writer) error
+	// Load loads an image tar, e.g., a debloated image.
+	Load(ctx context.Context, r io.Reader) error
+	// Redirect points the engine from the original layer to the shadow layer, once the shadow layer is dumped.
+	// Each mutation is recorded in the journal j before it happens.
+	Redirect(l image.ShadowLayer, j *journal.Journal) error
+	// Unredirect points the engine back to the original layer, it is the counterpart of Redirect.
+	Unredirect(l image.ShadowLayer, j *journal.Journal) error
+	// Reload restarts the engine so that it reads the layer metadata again.
+	Reload(ctx context.Context) error
+}
+
+// redirectLink points the l/ link of the original layer of a shadow layer in storageDir to the diff of the shadow layer.
+func redirectLink(storageDir string, l image.ShadowLayer, j *journal.Journal) error {
+	original := l.Original()
+	return relink(storageDir, original.GetlinkContent(), filepath.Base(l.GetLayerPath()), j)
+}
+
+// unredirectLink points the l/ link of the original layer back to its diff, if it points to the shadow layer.
+func unredirectLink(storageDir string, l image.ShadowLayer, j *journal.Journal) error {
+	original := l.Original()
+	if linkedLayer(storageDir, original.GetLayerPath()) != l.GetLayerPath() {
+		return nil
+	}
+	return relink(storageDir, original.GetlinkContent(), filepath.Base(original.GetLayerPath()), j)
+}
+
+// relink points the l/ link of a layer in storageDir to the diff of another layer, e.g., its shadow layer.
+func relink(storageDir string, link string, layerName string, j *journal.Journal) error {
+	linkPath := filepath.Join(storageDir, "l", link)
+	target := filepath.Join("..", layerName, "diff")
+	if current, err := os.Readlink(linkPath); err == nil && current == target {
+		return nil
+	}
+	j.Record(journal.Relink(linkPath))
+	if err := os.Remove(linkPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Symlink(target, linkPath)
+}
+
+// linkedLayer returns the directory of the layer the l/ link of a layer in storageDir points to.
+// It returns the layer itself if it has no link.
+func linkedLayer(storageDir string, dir string) string {
+	link, err := os.ReadFile(filepath.Join(dir, "link"))
+	if err != nil {
+		return dir
+	}
+	target, err := os.Readlink(filepath.Join(storageDir, "l", strings.TrimSpace(string(link))))
+	if err != nil {
+		return dir
+	}
+	return filepath.Join(storageDir, filepath.Base(filepath.Dir(target)))
+}
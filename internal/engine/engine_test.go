@@ -0,0 +1,266 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/journal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractLayerName(t *testing.T) {
+
+	mocked := types.GraphDriverData{
+		Data: map[string]string{
+			"MergedDir": "/var/lib/docker/overlay2/02bbe40378a44f8a88293229da146a33578eedbb9d7947808503722480e00505/merged",
+			"UpperDir":  "/var/lib/docker/overlay2/02bbe40378a44f8a88293229da146a33578eedbb9d7947808503722480e00505/diff",
+			"WorkDir":   "/var/lib/docker/overlay2/02bbe40378a44f8a88293229da146a33578eedbb9d7947808503722480e00505/work",
+		},
+		Name: "overlay2",
+	}
+
+	layerNames := extractLayerNames(mocked)
+
+	assert.Equal(t, len(layerNames), 1)
+}
+
+func TestFake(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake(t.TempDir())
+	base := map[string]string{"etc/os-release": "ID=debian\n"}
+	app1 := f.Build("app:1", base, map[string]string{"app/one": "1"})
+	app2 := f.Build("app:2", base, map[string]string{"app/two": "2"})
+	assert.Equal(t, app1.DiffIDs[0], app2.DiffIDs[0])
+	assert.NotEqual(t, app1.ID, app2.ID)
+
+	img1, err := f.Inspect(ctx, "app:1")
+	assert.NoError(t, err)
+	img2, err := f.Inspect(ctx, app2.ID)
+	assert.NoError(t, err)
+	assert.Len(t, img1.Layers, 2)
+	// the base layer is shared, the top layer comes first
+	assert.Equal(t, img1.Layers[1], img2.Layers[1])
+	assert.NotEqual(t, img1.Layers[0], img2.Layers[0])
+	_, err = f.Inspect(ctx, "app:3")
+	assert.Error(t, err)
+
+	layers, err := f.Layers(img1)
+	assert.NoError(t, err)
+	assert.Len(t, layers, 2)
+	for _, l := range layers {
+		assert.FileExists(t, filepath.Join(l.GetDiffPath(), "..", "link"))
+	}
+	assert.FileExists(t, filepath.Join(layers[0].GetDiffPath(), "app/one"))
+	lower, err := os.ReadFile(filepath.Join(img1.Layers[0], "lower"))
+	assert.NoError(t, err)
+	assert.Equal(t, "l/"+layers[1].GetlinkContent(), string(lower))
+
+	// inspect follows the cache-ids
+	cacheIdPath := filepath.Join(f.layerdbPath(), strings.TrimPrefix(app1.DiffIDs[0], "sha256:"), "cache-id")
+	assert.NoError(t, os.WriteFile(cacheIdPath, []byte("shadow_"+filepath.Base(img1.Layers[1])), 0600))
+	img1, err = f.Inspect(ctx, "app:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "shadow_"+filepath.Base(img2.Layers[1]), filepath.Base(img1.Layers[1]))
+
+	images, err := f.List(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	assert.NoError(t, f.Save(ctx, "app:1", &strings.Builder{}))
+	assert.NoError(t, f.Load(ctx, strings.NewReader("tar")))
+	assert.NoError(t, f.Reload(ctx))
+	assert.Equal(t, []string{"app:1"}, f.Saved)
+	assert.Equal(t, [][]byte{[]byte("tar")}, f.Loaded)
+	assert.Equal(t, 1, f.Reloads)
+}
+
+func TestPodman(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	p := NewPodman(root)
+	mustWrite(filepath.Join(p.StorageDir(), "base", "diff", "etc/os-release"), "ID=alpine\n")
+	mustWrite(filepath.Join(p.StorageDir(), "base", "link"), "BASE")
+	mustWrite(filepath.Join(p.StorageDir(), "top", "diff", "app"), "app")
+	mustWrite(filepath.Join(p.StorageDir(), "top", "link"), "TOP")
+	mustWrite(filepath.Join(p.StorageDir(), "top", "lower"), "l/BASE")
+	assert.NoError(t, os.MkdirAll(filepath.Join(p.StorageDir(), "l"), 0755))
+	assert.NoError(t, os.Symlink("../base/diff", filepath.Join(p.StorageDir(), "l", "BASE")))
+	assert.NoError(t, os.Symlink("../top/diff", filepath.Join(p.StorageDir(), "l", "TOP")))
+	mustWrite(filepath.Join(root, "overlay-layers", "layers.json"),
+		`[{"id":"base","diff-digest":"sha256:b"},{"id":"top","parent":"base","diff-digest":"sha256:t"}]`)
+	mustWrite(filepath.Join(root, "overlay-images", "images.json"),
+		`[{"id":"0123456789abcdef","names":["docker.io/library/alpine:3"],"layer":"top"}]`)
+
+	for _, ref := range []string{"alpine:3", "docker.io/library/alpine:3", "sha256:0123456789abcdef", "0123456789ab"} {
+		img, err := p.Inspect(ctx, ref)
+		assert.NoError(t, err, ref)
+		assert.Equal(t, "sha256:0123456789abcdef", img.ID)
+	}
+	_, err := p.Inspect(ctx, "alpine")
+	assert.Error(t, err)
+
+	img, err := p.Inspect(ctx, "alpine:3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sha256:b", "sha256:t"}, img.DiffIDs)
+	assert.Equal(t, []string{filepath.Join(p.StorageDir(), "top"), filepath.Join(p.StorageDir(), "base")}, img.Layers)
+	layers, err := p.Layers(img)
+	assert.NoError(t, err)
+	assert.Len(t, layers, 2)
+
+	// the shadow layer is found through the redirected l/ link
+	original := image.NewOriginalLayer(layers[1])
+	shadow := original.Shadow()
+	shadow.Dump(nil)
+	assert.NoError(t, p.Redirect(shadow, nil))
+	img, err = p.Inspect(ctx, "alpine:3")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(p.StorageDir(), "shadow_base"), img.Layers[1])
+	images, err := p.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, img, images[0])
+
+	assert.NoError(t, p.Unredirect(shadow, nil))
+	img, err = p.Inspect(ctx, "alpine:3")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(p.StorageDir(), "base"), img.Layers[1])
+	assert.NoError(t, p.Reload(ctx))
+}
+
+func TestContainerd(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	c := NewContainerd("", "k8s.io", root)
+	mustWrite(filepath.Join(c.fsPath("1"), "etc/os-release"), "ID=alpine\n")
+	mustWrite(filepath.Join(c.fsPath("2"), "app"), "app")
+	platform := fmt.Sprintf(`{"os":%q,"architecture":%q}`, runtime.GOOS, runtime.GOARCH)
+	c.ctr = func(args ...string) ([]byte, error) {
+		switch strings.Join(args, " ") {
+		case "images ls":
+			return []byte("REF TYPE DIGEST SIZE PLATFORMS LABELS\n" +
+				"docker.io/library/alpine:3 application/vnd.oci.image.index.v1+json sha256:i 3.0 MiB linux/amd64 -\n"), nil
+		case "content get sha256:i":
+			return []byte(`{"manifests":[{"digest":"sha256:other","platform":{"os":"unknown","architecture":"unknown"}},` +
+				`{"digest":"sha256:m","platform":` + platform + `}]}`), nil
+		case "content get sha256:m":
+			return []byte(`{"config":{"digest":"sha256:c"}}`), nil
+		case "content get sha256:c":
+			return []byte(`{"rootfs":{"type":"layers","diff_ids":["sha256:b","sha256:t"]}}`), nil
+		}
+		if args[0] == "snapshots" && args[3] == "view" {
+			return []byte(`[{"Type":"overlay","Source":"overlay","Options":["index=off","lowerdir=` +
+				c.fsPath("2") + ":" + c.fsPath("1") + `"]}]`), nil
+		}
+		return nil, nil
+	}
+
+	for _, ref := range []string{"alpine:3", "docker.io/library/alpine:3", "sha256:c"} {
+		img, err := c.Inspect(ctx, ref)
+		assert.NoError(t, err, ref)
+		assert.Equal(t, "sha256:c", img.ID)
+	}
+	img, err := c.Inspect(ctx, "alpine:3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sha256:b", "sha256:t"}, img.DiffIDs)
+	assert.Equal(t, []string{filepath.Join(c.StorageDir(), "2"), filepath.Join(c.StorageDir(), "1")}, img.Layers)
+	layers, err := c.Layers(img)
+	assert.NoError(t, err)
+	assert.Len(t, layers, 2)
+	assert.FileExists(t, filepath.Join(layers[1].GetDiffPath(), "etc/os-release"))
+
+	// the snapshot links to the shadow layer, the files of the original layer are moved to baffs/
+	original := image.NewOriginalLayer(layers[1])
+	shadow := original.Shadow()
+	shadow.Dump(nil)
+	workDir := t.TempDir()
+	j, err := journal.Begin(workDir, journal.Header{Op: "shadow"})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Redirect(shadow, j))
+	img, err = c.Inspect(ctx, "alpine:3")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(c.StorageDir(), "shadow_1"), img.Layers[1])
+	target, err := filepath.EvalSymlinks(c.fsPath("1"))
+	assert.NoError(t, err)
+	assert.Equal(t, shadow.GetDiffPath(), target)
+	assert.FileExists(t, filepath.Join(original.GetDiffPath(), "etc/os-release"))
+	images, err := c.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, img, images[0])
+
+	// rolling back redirecting moves the files back
+	opened, err := journal.Open(workDir)
+	assert.NoError(t, err)
+	opened.Rollback()
+	assert.FileExists(t, filepath.Join(c.fsPath("1"), "etc/os-release"))
+	assert.FileExists(t, filepath.Join(original.GetDiffPath(), "etc/os-release"))
+	img, err = c.Inspect(ctx, "alpine:3")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(c.StorageDir(), "1"), img.Layers[1])
+
+	assert.NoError(t, c.Redirect(shadow, nil))
+	assert.NoError(t, c.Unredirect(shadow, nil))
+	info, err := os.Lstat(c.fsPath("1"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.FileExists(t, filepath.Join(original.GetDiffPath(), "etc/os-release"))
+	assert.NoError(t, c.Reload(ctx))
+}
+
+func TestRestarter(t *testing.T) {
+	_, err := NewRestarter(RestartOptions{Strategy: "upstart"})
+	assert.Error(t, err)
+	_, err = NewRestarter(RestartOptions{Strategy: "command"})
+	assert.Error(t, err)
+	_, err = NewRestarter(RestartOptions{Strategy: "pidfile", Signal: "NOPE"})
+	assert.Error(t, err)
+	r, err := NewRestarter(RestartOptions{Strategy: "systemd", Service: "docker"})
+	assert.NoError(t, err)
+	assert.Equal(t, CommandRestarter{Command: []string{"systemctl", "restart", "docker"}}, r)
+
+	dir := t.TempDir()
+	r, err = NewRestarter(RestartOptions{Strategy: "command", Command: "touch " + filepath.Join(dir, "restarted")})
+	assert.NoError(t, err)
+	assert.NoError(t, r.Restart())
+	assert.FileExists(t, filepath.Join(dir, "restarted"))
+
+	// the daemon is stopped by the signal, then started again
+	daemon := exec.Command("sleep", "60")
+	assert.NoError(t, daemon.Start())
+	go daemon.Wait()
+	pidfile := filepath.Join(dir, "daemon.pid")
+	mustWrite(pidfile, fmt.Sprintf("%d\n", daemon.Process.Pid))
+	r, err = NewRestarter(RestartOptions{Strategy: "pidfile", Pidfile: pidfile, Signal: "SIGTERM", Timeout: 10 * time.Second,
+		Command: "touch " + filepath.Join(dir, "started")})
+	assert.NoError(t, err)
+	assert.NoError(t, r.Restart())
+	assert.FileExists(t, filepath.Join(dir, "started"))
+	assert.Error(t, r.Restart())
+}
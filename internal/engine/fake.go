@@ -0,0 +1,218 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/journal"
+)
+
+// A Fake is an engine for tests, storing images in a directory laid out like the docker root dir.
+// Unlike docker, it reads the layer metadata on every Inspect, so it needs no reload.
+// If Live is set, layers are redirected by their l/ links, as a live Docker engine.
+type Fake struct {
+	RootDir string
+	Saved   []string // images saved
+	Loaded  [][]byte // tars loaded
+	Reloads int
+	Live    bool
+
+	images []Image
+}
+
+// NewFake returns a fake engine without images, storing them in rootDir.
+func NewFake(rootDir string) *Fake {
+	return &Fake{RootDir: rootDir}
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) StorageDir() string {
+	return filepath.Join(f.RootDir, "overlay2")
+}
+
+func (f *Fake) layerdbPath() string {
+	return filepath.Join(f.RootDir, "image/overlay2/layerdb/sha256")
+}
+
+// Build creates an image from the files of each layer, from the bottom layer to the top one.
+// Layers with the same files and parents are shared between images, as in docker.
+func (f *Fake) Build(name string, layers ...map[string]string) Image {
+	img := Image{Names: []string{name}}
+	var chainId string
+	var lowers []string
+	for i, files := range layers {
+		diffId := "sha256:" + fakeDigest(files)
+		img.DiffIDs = append(img.DiffIDs, diffId)
+		if i == 0 {
+			chainId = diffId
+		} else {
+			chainId = "sha256:" + generateChainId(chainId, diffId)
+		}
+		chain := strings.TrimPrefix(chainId, "sha256:")
+		cacheId := chain[:32]
+		link := strings.ToUpper(chain[32:58])
+		layerDir := filepath.Join(f.StorageDir(), cacheId)
+		if _, err := os.Stat(layerDir); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Join(layerDir, "diff"), 0755); err != nil {
+				panic(err)
+			}
+			for path, content := range files {
+				mustWrite(filepath.Join(layerDir, "diff", path), content)
+			}
+			mustWrite(filepath.Join(layerDir, "link"), link)
+			if len(lowers) > 0 {
+				mustWrite(filepath.Join(layerDir, "lower"), strings.Join(lowers, ":"))
+			}
+			if err := os.MkdirAll(filepath.Join(f.StorageDir(), "l"), 0755); err != nil {
+				panic(err)
+			}
+			if err := os.Symlink(filepath.Join("..", cacheId, "diff"), filepath.Join(f.StorageDir(), "l", link)); err != nil {
+				panic(err)
+			}
+			mustWrite(filepath.Join(f.layerdbPath(), chain, "cache-id"), cacheId)
+			mustWrite(filepath.Join(f.layerdbPath(), chain, "size"), "0")
+		}
+		lowers = append([]string{"l/" + link}, lowers...)
+	}
+	img.ID = "sha256:" + fakeDigest(map[string]string{"diff_ids": strings.Join(img.DiffIDs, " ")})
+	f.images = append(f.images, img)
+	return img
+}
+
+func (f *Fake) Inspect(ctx context.Context, ref string) (Image, error) {
+	for _, img := range f.images {
+		if img.ID != ref && !contains(img.Names, ref) {
+			continue
+		}
+		// the layer dirs are where the cache-ids point to, from top to bottom
+		img.Layers = nil
+		var chainId string
+		for i, diffId := range img.DiffIDs {
+			if i == 0 {
+				chainId = diffId
+			} else {
+				chainId = "sha256:" + generateChainId(chainId, diffId)
+			}
+			cacheId, err := os.ReadFile(filepath.Join(f.layerdbPath(), strings.TrimPrefix(chainId, "sha256:"), "cache-id"))
+			if err != nil {
+				return Image{}, err
+			}
+			img.Layers = append([]string{linkedLayer(f.StorageDir(), filepath.Join(f.StorageDir(), string(cacheId)))}, img.Layers...)
+		}
+		return img, nil
+	}
+	return Image{}, fmt.Errorf("image %s not found", ref)
+}
+
+func (f *Fake) List(ctx context.Context) ([]Image, error) {
+	var images []Image
+	for _, img := range f.images {
+		img, err := f.Inspect(ctx, img.ID)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func (f *Fake) Layers(img Image) ([]image.LayerInfo, error) {
+	return resolveLayers(img, f.StorageDir(), f.layerdbPath(), f.Live)
+}
+
+func (f *Fake) Save(ctx context.Context, ref string, w io.Writer) error {
+	f.Saved = append(f.Saved, ref)
+	_, err := io.WriteString(w, "saved "+ref)
+	return err
+}
+
+func (f *Fake) Load(ctx context.Context, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.Loaded = append(f.Loaded, data)
+	return nil
+}
+
+// Redirect points the l/ link of the original layer to the shadow layer if Live is set.
+// Otherwise it does nothing, the cache-id of the layer is redirected by image.ShadowLayer.Dump.
+func (f *Fake) Redirect(l image.ShadowLayer, j *journal.Journal) error {
+	if !f.Live {
+		return nil
+	}
+	return redirectLink(f.StorageDir(), l, j)
+}
+
+// Unredirect points the l/ link of the original layer back to its diff, if it points to the shadow layer.
+func (f *Fake) Unredirect(l image.ShadowLayer, j *journal.Journal) error {
+	return unredirectLink(f.StorageDir(), l, j)
+}
+
+func (f *Fake) Reload(ctx context.Context) error {
+	f.Reloads++
+	return nil
+}
+
+// fakeDigest returns a digest of files, independent of their order.
+func fakeDigest(files map[string]string) string {
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(h, "%s\x00%s\x00", path, files[path])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func mustWrite(path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		panic(err)
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
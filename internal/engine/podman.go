@@ -0,0 +1,247 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/journal"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPodmanRoot is the storage root of rootful podman.
+const DefaultPodmanRoot = "/var/lib/containers/storage"
+
+/*
+Podman is the podman engine with the overlay driver of containers-storage, organized as follows:
+
+	{root_dir}/
+		overlay/
+			{layer_id}/diff, link, lower
+			l/{link} -> ../{layer_id}/diff
+		overlay-layers/layers.json
+		overlay-images/images.json
+
+Unlike docker, a layer has no cache-id: its directory is named by its id.
+Containers find the layers of their image through the l/ links, which Redirect points to the shadow layers.
+Podman has no daemon, so redirecting takes effect for new containers without reloading.
+*/
+type Podman struct {
+	rootDir string
+}
+
+// podmanImage is an image in overlay-images/images.json.
+type podmanImage struct {
+	ID    string   `json:"id"`
+	Names []string `json:"names"`
+	Layer string   `json:"layer"` // top layer id
+}
+
+// podmanLayer is a layer in overlay-layers/layers.json.
+type podmanLayer struct {
+	ID         string `json:"id"`
+	Parent     string `json:"parent"`
+	DiffDigest string `json:"diff-digest"`
+}
+
+// NewPodman returns the podman engine storing images in rootDir.
+func NewPodman(rootDir string) *Podman {
+	return &Podman{rootDir: rootDir}
+}
+
+func (p *Podman) Name() string {
+	return "podman"
+}
+
+func (p *Podman) StorageDir() string {
+	return filepath.Join(p.rootDir, "overlay")
+}
+
+func (p *Podman) readImages() ([]podmanImage, error) {
+	var images []podmanImage
+	data, err := os.ReadFile(filepath.Join(p.rootDir, "overlay-images", "images.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return images, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return images, json.Unmarshal(data, &images)
+}
+
+func (p *Podman) readLayers() (map[string]podmanLayer, error) {
+	var layers []podmanLayer
+	data, err := os.ReadFile(filepath.Join(p.rootDir, "overlay-layers", "layers.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &layers); err != nil {
+		return nil, err
+	}
+	byId := map[string]podmanLayer{}
+	for _, l := range layers {
+		byId[l.ID] = l
+	}
+	return byId, nil
+}
+
+// matchName tells if ref names an image, short names are completed as podman does for docker.io.
+func matchName(names []string, ref string) bool {
+	for _, name := range names {
+		if name == ref || name == "docker.io/"+ref || name == "docker.io/library/"+ref || name == "localhost/"+ref {
+			return true
+		}
+		if !strings.Contains(ref, ":") && matchName([]string{name}, ref+":latest") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Podman) Inspect(ctx context.Context, ref string) (Image, error) {
+	images, err := p.readImages()
+	if err != nil {
+		return Image{}, err
+	}
+	id := strings.TrimPrefix(ref, "sha256:")
+	for _, pi := range images {
+		if pi.ID == id || (len(id) >= 12 && strings.HasPrefix(pi.ID, id)) || matchName(pi.Names, ref) {
+			return p.image(pi)
+		}
+	}
+	return Image{}, fmt.Errorf("image %s not found in %s", ref, p.rootDir)
+}
+
+// image resolves the layers of an image through their l/ links, so that redirected layers are the shadow ones.
+func (p *Podman) image(pi podmanImage) (Image, error) {
+	layers, err := p.readLayers()
+	if err != nil {
+		return Image{}, err
+	}
+	img := Image{ID: "sha256:" + pi.ID, Names: pi.Names}
+	for id := pi.Layer; id != ""; {
+		l, ok := layers[id]
+		if !ok {
+			return Image{}, fmt.Errorf("layer %s of image %s not found", id, pi.ID)
+		}
+		link, err := os.ReadFile(filepath.Join(p.StorageDir(), id, "link"))
+		if err != nil {
+			return Image{}, err
+		}
+		target, err := os.Readlink(filepath.Join(p.StorageDir(), "l", strings.TrimSpace(string(link))))
+		if err != nil {
+			return Image{}, err
+		}
+		img.Layers = append(img.Layers, filepath.Join(p.StorageDir(), filepath.Base(filepath.Dir(target))))
+		img.DiffIDs = append([]string{l.DiffDigest}, img.DiffIDs...)
+		id = l.Parent
+	}
+	return img, nil
+}
+
+func (p *Podman) List(ctx context.Context) ([]Image, error) {
+	images, err := p.readImages()
+	if err != nil {
+		return nil, err
+	}
+	var result []Image
+	for _, pi := range images {
+		img, err := p.image(pi)
+		if err != nil {
+			log.Debug("Skipping image ", pi.Names, ": ", err)
+			continue
+		}
+		result = append(result, img)
+	}
+	return result, nil
+}
+
+// Layers returns the layers of an image, without metadata: podman layers have no cache-id.
+func (p *Podman) Layers(img Image) ([]image.LayerInfo, error) {
+	var layerInfos []image.LayerInfo
+	for _, dir := range img.Layers {
+		layerInfos = append(layerInfos, *image.NewLayerInfo(dir))
+	}
+	return layerInfos, nil
+}
+
+// podman runs a podman command on the storage root.
+func (p *Podman) podman(args ...string) *exec.Cmd {
+	cmd := exec.Command("podman", append([]string{"--root", p.rootDir}, args...)...)
+	log.Debug(cmd)
+	return cmd
+}
+
+// Save writes an image as an oci-archive, which image.ParseImgTarFs reads like the OCI layout of docker save.
+func (p *Podman) Save(ctx context.Context, ref string, w io.Writer) error {
+	tmp, err := os.MkdirTemp("", "baffs-podman-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	archive := filepath.Join(tmp, "image.tar")
+	if out, err := p.podman("save", "--format", "oci-archive", "-o", archive, ref).CombinedOutput(); err != nil {
+		return fmt.Errorf("podman save %s: %w: %s", ref, err, out)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (p *Podman) Load(ctx context.Context, r io.Reader) error {
+	cmd := p.podman("load")
+	cmd.Stdin = r
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("podman load: %w", err)
+	}
+	return nil
+}
+
+// Redirect points the l/ link of the original layer to the diff of the shadow layer.
+func (p *Podman) Redirect(l image.ShadowLayer, j *journal.Journal) error {
+	return redirectLink(p.StorageDir(), l, j)
+}
+
+// Unredirect points the l/ link of the original layer back to its diff.
+func (p *Podman) Unredirect(l image.ShadowLayer, j *journal.Journal) error {
+	return unredirectLink(p.StorageDir(), l, j)
+}
+
+// Reload does nothing, podman has no daemon.
+func (p *Podman) Reload(ctx context.Context) error {
+	return nil
+}
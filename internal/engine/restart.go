@@ -0,0 +1,135 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// A Restarter restarts a daemon, e.g., dockerd, so that it reads the layer metadata again.
+// Restart returns once the daemon is stopped, it may not serve requests yet.
+type Restarter interface {
+	Restart() error
+}
+
+// RestartOptions configures how a daemon is restarted.
+type RestartOptions struct {
+	Strategy string        // systemd, sysv, openrc, pidfile or command
+	Service  string        // service of the daemon, for systemd, sysv and openrc
+	Pidfile  string        // pidfile of the daemon, for pidfile
+	Signal   string        // signal stopping the daemon, for pidfile
+	Command  string        // command restarting the daemon, or starting it again for pidfile
+	Timeout  time.Duration // time to wait for the daemon to stop, for pidfile
+}
+
+// NewRestarter returns the restarter of a strategy.
+func NewRestarter(opts RestartOptions) (Restarter, error) {
+	switch opts.Strategy {
+	case "systemd":
+		return CommandRestarter{Command: []string{"systemctl", "restart", opts.Service}}, nil
+	case "sysv":
+		return CommandRestarter{Command: []string{"service", opts.Service, "restart"}}, nil
+	case "openrc":
+		return CommandRestarter{Command: []string{"rc-service", opts.Service, "restart"}}, nil
+	case "pidfile":
+		sig := unix.SignalNum("SIG" + strings.TrimPrefix(strings.ToUpper(opts.Signal), "SIG"))
+		if sig == 0 {
+			return nil, fmt.Errorf("unknown signal %s", opts.Signal)
+		}
+		r := PidfileRestarter{Pidfile: opts.Pidfile, Signal: sig, Timeout: opts.Timeout}
+		if opts.Command != "" {
+			r.Start = []string{"sh", "-c", opts.Command}
+		}
+		return r, nil
+	case "command":
+		if opts.Command == "" {
+			return nil, errors.New("no command to restart the daemon")
+		}
+		return CommandRestarter{Command: []string{"sh", "-c", opts.Command}}, nil
+	default:
+		return nil, fmt.Errorf("unknown restart strategy %s", opts.Strategy)
+	}
+}
+
+// A CommandRestarter restarts a daemon with a command, e.g., systemctl restart docker.
+type CommandRestarter struct {
+	Command []string
+}
+
+func (r CommandRestarter) Restart() error {
+	return run(r.Command)
+}
+
+// run runs a command, its output is only logged.
+func run(command []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	log.Debug(cmd)
+	out, err := cmd.CombinedOutput()
+	log.Debug(string(out))
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd, err, out)
+	}
+	return nil
+}
+
+// A PidfileRestarter stops a daemon run without a service manager by signaling the process in its pidfile.
+// The daemon is started again by Start if set, otherwise it is left to a supervisor, e.g., supervisord.
+type PidfileRestarter struct {
+	Pidfile string
+	Signal  syscall.Signal
+	Start   []string
+	Timeout time.Duration
+}
+
+func (r PidfileRestarter) Restart() error {
+	data, err := os.ReadFile(r.Pidfile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid pidfile %s: %w", r.Pidfile, err)
+	}
+	log.Debug("Sending ", r.Signal, " to ", pid)
+	if err := syscall.Kill(pid, r.Signal); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(r.Timeout); syscall.Kill(pid, 0) == nil; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("process %d did not exit within %s after %s", pid, r.Timeout, r.Signal)
+		}
+	}
+	if len(r.Start) == 0 {
+		return nil
+	}
+	return run(r.Start)
+}
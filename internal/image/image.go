@@ -22,13 +22,22 @@
 package image
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 
+	"github.com/distribution/reference"
+	"github.com/negativa-ai/BLAFS/internal/journal"
+	"github.com/negativa-ai/BLAFS/internal/mount"
 	"github.com/negativa-ai/BLAFS/internal/util"
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -197,17 +206,72 @@ func NewOriginalLayer(layerInfo LayerInfo) OriginalLayer {
 type ShadowLayer struct {
 	LayerInfo
 	realPath string
+	keptPath string // overrides the kept dir, see SetKeptPath
 }
 
 func (l *ShadowLayer) GetRealPath() string {
 	return l.realPath
 }
 
+// GetKeptPath returns the directory holding the files kept in the shadow layer:
+// the real dir while the image is shadowed, or the diff dir once the layer is exported.
+func (l *ShadowLayer) GetKeptPath() string {
+	if l.keptPath != "" {
+		return l.keptPath
+	}
+	if util.PathExist(l.realPath) {
+		return l.realPath
+	}
+	return l.diffPath
+}
+
+// AccessedFiles returns all files kept in the shadow layer, relative to the layer root, in lexical order.
+// Empty placeholders created by debloated_fs for files that are listed but never opened are skipped.
+func (l *ShadowLayer) AccessedFiles() []string {
+	keptPath := l.GetKeptPath()
+	original := l.Original()
+	originalDiffPath := original.GetDiffPath()
+	var files []string
+	if err := filepath.WalkDir(keptPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(keptPath, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() == 0 {
+				if originalInfo, err := os.Lstat(filepath.Join(originalDiffPath, relPath)); err == nil && originalInfo.Size() > 0 {
+					return nil
+				}
+			}
+		}
+		files = append(files, filepath.ToSlash(relPath))
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	return files
+}
+
 // SetLowers replaces existing lowers to new lowers
 func (l *ShadowLayer) SetLowers(newLowers string) {
 	l.lowerContent = newLowers
 }
 
+// SetKeptPath replaces the kept dir of the shadow layer in memory, e.g., by a copy of the real dir.
+func (l *ShadowLayer) SetKeptPath(keptPath string) {
+	l.keptPath = keptPath
+}
+
 func (l *ShadowLayer) SetLayerSize(size string) {
 	l.size = size
 }
@@ -216,8 +280,9 @@ func (l *ShadowLayer) SetCacheId(cacheId string) {
 	l.cacheid = cacheId
 }
 
+// GetLayerSize returns the size of the files kept in the shadow layer, see GetKeptPath.
 func (l *ShadowLayer) GetLayerSize() int64 {
-	return util.GetDirSize(l.realPath)
+	return util.GetDirSize(l.GetKeptPath())
 }
 
 // DumpLayerSize writes the size of the layer to the size file.
@@ -229,8 +294,10 @@ func (l *ShadowLayer) DumpLayerSize(size string) {
 }
 
 // TarDiff archives the diff directory of the shadow layer to a tar file.
+// Whiteouts and opaque directories of the original layer are kept.
 func (l *ShadowLayer) TarDiff(destFile string) {
-	util.TarFiles(l.diffPath, destFile)
+	original := l.Original()
+	util.TarLayer(l.GetKeptPath(), original.GetDiffPath(), destFile)
 }
 
 // Original returns the original layer from a shadow layer in memory, not create it in the filesystem
@@ -250,23 +317,52 @@ func (l *ShadowLayer) Original() OriginalLayer {
 
 // Restore restores the filesystem of the docker image to the state before shadowing.
 // It modifies the filesystem.
-// It is the counterpart of Dump.
-func (l *ShadowLayer) Restore() {
+// It is the counterpart of Dump. Each mutation is recorded in the journal j before it happens.
+func (l *ShadowLayer) Restore(j *journal.Journal) {
+	if l.cacheidPath == "" {
+		// the engine does not find layers by cache-id, see engine.Engine.Unredirect
+		return
+	}
 	original := l.Original()
 	bakCacheIdData, err := os.ReadFile(original.cacheidPath + ".bak")
 	if err != nil {
 		panic(err)
 	}
+	j.Record(journal.Write(original.cacheidPath))
 	if err = os.WriteFile(original.cacheidPath, bakCacheIdData, 0600); err != nil {
 		panic(err)
 	}
 }
 
+// Remove deletes the shadow layer, its l/ link and the backup of the cache-id from the filesystem.
+// It should only be called after Restore, otherwise the cache-id still points to the removed layer.
+// It refuses to remove a layer still mounted with debloated_fs, which would remove files from the original layer.
+func (l *ShadowLayer) Remove() {
+	if !strings.HasPrefix(l.layerName, "shadow_") {
+		panic("refuse to remove a non-shadow layer: " + l.layerPath)
+	}
+	if mount.IsMountedWithType(l.diffPath, mount.MountType) {
+		panic("refuse to remove a mounted shadow layer: " + l.diffPath)
+	}
+	if err := os.RemoveAll(l.layerPath); err != nil {
+		panic(err)
+	}
+	if err := os.Remove(l.lLinkPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		panic(err)
+	}
+	if l.cacheidPath != "" {
+		if err := os.Remove(l.cacheidPath + ".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			panic(err)
+		}
+	}
+}
+
 // Dump creates the shadow layer in the filesystem.
-// It is the counterpart of Restore.
-func (l *ShadowLayer) Dump() {
+// It is the counterpart of Restore. Each mutation is recorded in the journal j before it happens.
+func (l *ShadowLayer) Dump(j *journal.Journal) {
 	var mode fs.FileMode = 0755
 	// create layer
+	j.Record(journal.Mkdir(l.layerPath))
 	if err := os.Mkdir(l.layerPath, mode); err != nil {
 		if errors.Is(err, os.ErrExist) {
 			log.Debug("Layer diff dir already exists")
@@ -276,6 +372,7 @@ func (l *ShadowLayer) Dump() {
 	}
 
 	// create diff dir
+	j.Record(journal.Mkdir(l.diffPath))
 	if err := os.Mkdir(l.diffPath, mode); err != nil {
 		if errors.Is(err, os.ErrExist) {
 			log.Debug("Layer diff dir already exists")
@@ -284,6 +381,7 @@ func (l *ShadowLayer) Dump() {
 		}
 	}
 	//create link file
+	j.Record(journal.Write(l.linkPath))
 	linkFile, err := os.Create(l.linkPath)
 	if err != nil {
 		if errors.Is(err, os.ErrExist) {
@@ -296,6 +394,7 @@ func (l *ShadowLayer) Dump() {
 
 	// create lower file, optionally
 	if l.lowerPath != "" {
+		j.Record(journal.Write(l.lowerPath))
 		if lower_file, err := os.Create(l.lowerPath); err != nil {
 			if errors.Is(err, os.ErrExist) {
 				log.Debug("Layer lower file already exists")
@@ -310,6 +409,7 @@ func (l *ShadowLayer) Dump() {
 
 	// create real dir
 	if l.realPath != "" {
+		j.Record(journal.Mkdir(l.realPath))
 		if err := os.Mkdir(l.realPath, mode); err != nil {
 			if errors.Is(err, os.ErrExist) {
 				log.Debug("Layer real dir already exists")
@@ -320,6 +420,7 @@ func (l *ShadowLayer) Dump() {
 	}
 
 	// create l/link_{layer_name}
+	j.Record(journal.Symlink(l.lLinkPath))
 	if err := os.Symlink(filepath.Join("../", l.layerName, "diff"), l.lLinkPath); err != nil {
 		if errors.Is(err, os.ErrExist) {
 			log.Debug("l/link file already exists")
@@ -332,8 +433,10 @@ func (l *ShadowLayer) Dump() {
 		// set cache-id
 		// back up the original cache-id firstly
 		if !util.PathExist(l.cacheidPath + ".bak") {
+			j.Record(journal.Write(l.cacheidPath + ".bak"))
 			util.CopyFile(l.cacheidPath, l.cacheidPath+".bak")
 		}
+		j.Record(journal.Write(l.cacheidPath))
 		if err := os.WriteFile(l.cacheidPath, []byte(l.cacheid), 0600); err != nil {
 			panic(err)
 		}
@@ -394,6 +497,33 @@ type ImgJson struct {
 	History interface{} `json:"history"`
 }
 
+/*
+An ImgTarFs represents the extracted filesystem of a `docker save` tar file.
+Two layouts are supported. The legacy layout (Docker < 25) is organized as follows:
+{base_path}/
+	manifest.json
+	repositories
+	{config_digest}.json
+	{layer_id}/
+		layer.tar
+		json
+		VERSION
+
+The OCI layout (Docker >= 25) is organized as follows:
+{base_path}/
+	manifest.json
+	repositories
+	index.json
+	oci-layout
+	blobs/sha256/
+		{config_digest}
+		{manifest_digest}
+		{layer_digest}
+
+In the OCI layout all blobs are content addressed, so whenever a layer or the config
+is rewritten, its blob is renamed and every reference to it is updated on dump.
+*/
+
 type ImgTarFs struct {
 	basePath        string
 	layers          []ImgTarLayer // from bottom to top
@@ -402,29 +532,147 @@ type ImgTarFs struct {
 	imgJsonPath     string
 	manifestContent []Manifest
 	imgJsonContent  ImgJson
+	// only set for the OCI layout
+	ociLayout          bool
+	ociArchive         bool // an oci-archive without manifest.json, e.g., saved by podman
+	indexPath          string
+	indexContent       ispec.Index
+	ociManifestPath    string
+	ociManifestContent ispec.Manifest
+	ociNested          []ociNestedIndex // image indexes between index.json and the image manifest
+}
+
+// An ociNestedIndex is an image index blob pointed to by index.json, e.g., saved from the containerd image store,
+// that lists the image manifests of several platforms.
+type ociNestedIndex struct {
+	path    string
+	content ispec.Index
+	pos     int // of the selected manifest in content.Manifests
 }
 
 type Manifest struct {
-	Config   string   `json:"Config"`
-	RepoTags []string `json:"RepoTags"`
-	Layers   []string `json:"Layers"` // 0->n : bottom->top
+	Config       string                 `json:"Config"`
+	RepoTags     []string               `json:"RepoTags"`
+	Layers       []string               `json:"Layers"` // 0->n : bottom->top
+	LayerSources map[string]interface{} `json:"LayerSources,omitempty"`
 }
 
+const (
+	ociLayoutFile  = "oci-layout"
+	ociIndexFile   = "index.json"
+	ociBlobsDir    = "blobs/sha256"
+	ociRefNameKey  = "org.opencontainers.image.ref.name"
+	containerdName = "io.containerd.image.name"
+
+	dockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
 func (f *ImgTarFs) GetLayers() []ImgTarLayer {
 	return f.layers
 }
 
+// IsOCILayout returns true if the image tar uses the OCI layout.
+func (f *ImgTarFs) IsOCILayout() bool {
+	return f.ociLayout
+}
+
+// blobPath returns the path of a blob in the OCI layout.
+func (f *ImgTarFs) blobPath(sum string) string {
+	return filepath.Join(f.basePath, ociBlobsDir, sum)
+}
+
+// relBlobPath returns the path of a blob relative to the base path, as referenced by manifest.json.
+func relBlobPath(sum string) string {
+	return ociBlobsDir + "/" + sum
+}
+
+// writeBlob writes data as a content addressed blob and removes the old blob if it is replaced.
+// It returns the descriptor of the new blob.
+func (f *ImgTarFs) writeBlob(data []byte, oldPath string, old ispec.Descriptor) ispec.Descriptor {
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	newPath := f.blobPath(sum)
+	if err := os.WriteFile(newPath, data, 0644); err != nil {
+		panic(err)
+	}
+	if oldPath != "" && oldPath != newPath {
+		if err := os.Remove(oldPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			panic(err)
+		}
+	}
+	old.Digest = digest.Digest("sha256:" + sum)
+	old.Size = int64(len(data))
+	return old
+}
+
+// UpdateLayer updates the diff id of the i-th layer (from bottom to top) after its layer tar is rewritten.
+// In the OCI layout, the layer blob is also renamed to its new digest.
+// It modifies the filesystem.
+func (f *ImgTarFs) UpdateLayer(i int) {
+	layer := &f.layers[i]
+	sum := layer.LayerTarSha256Sum()
+	f.imgJsonContent.Rootfs.DiffIds[i] = "sha256:" + sum
+	if !f.ociLayout {
+		return
+	}
+
+	newPath := f.blobPath(sum)
+	if err := util.Move(layer.layerTarPath, newPath); err != nil {
+		panic(err)
+	}
+	layer.layerTarPath = newPath
+	f.manifestContent[0].Layers[i] = relBlobPath(sum)
+
+	info, err := os.Stat(newPath)
+	if err != nil {
+		panic(err)
+	}
+	if i < len(f.ociManifestContent.Layers) {
+		f.ociManifestContent.Layers[i].Digest = digest.Digest("sha256:" + sum)
+		f.ociManifestContent.Layers[i].Size = info.Size()
+	}
+}
+
+// ShareLayer makes the i-th layer reuse the rewritten layer tar of the j-th layer.
+// Some images have multiple same layers, which are stored only once in the image tar.
+func (f *ImgTarFs) ShareLayer(i int, j int) {
+	f.layers[i].layerTarPath = f.layers[j].layerTarPath
+	f.imgJsonContent.Rootfs.DiffIds[i] = f.imgJsonContent.Rootfs.DiffIds[j]
+	if f.ociLayout {
+		f.manifestContent[0].Layers[i] = f.manifestContent[0].Layers[j]
+		if i < len(f.ociManifestContent.Layers) && j < len(f.ociManifestContent.Layers) {
+			f.ociManifestContent.Layers[i] = f.ociManifestContent.Layers[j]
+		}
+	}
+}
+
 func (f *ImgTarFs) DumpImgJson() {
 	data, err := json.Marshal(f.imgJsonContent)
 	if err != nil {
 		panic(err)
 	}
+	if f.ociLayout {
+		f.ociManifestContent.Config = f.writeBlob(data, f.imgJsonPath, f.ociManifestContent.Config)
+		sum := f.ociManifestContent.Config.Digest.Encoded()
+		f.imgJsonPath = f.blobPath(sum)
+		f.manifestContent[0].Config = relBlobPath(sum)
+		return
+	}
 	err = os.WriteFile(f.imgJsonPath, data, 0755)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// ConfigDigest returns the digest of the image config, i.e., the id of the image once loaded.
+func (f *ImgTarFs) ConfigDigest() string {
+	data, err := os.ReadFile(f.imgJsonPath)
+	if err != nil {
+		panic(err)
+	}
+	return digest.FromBytes(data).String()
+}
+
 func (f *ImgTarFs) GetImageJson() ImgJson {
 	return f.imgJsonContent
 }
@@ -434,14 +682,69 @@ func (f *ImgTarFs) GetManifest() []Manifest {
 }
 
 func (f *ImgTarFs) DumpManifest() {
-	data, err := json.Marshal(f.manifestContent)
+	if !f.ociArchive {
+		data, err := json.Marshal(f.manifestContent)
+		if err != nil {
+			panic(err)
+		}
+		err = os.WriteFile(f.manifestPath, data, 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if f.ociLayout {
+		f.dumpOCIManifest()
+	}
+}
+
+// dumpOCIManifest writes the OCI manifest blob, the nested image indexes and index.json, keeping them consistent with manifest.json.
+func (f *ImgTarFs) dumpOCIManifest() {
+	data, err := json.Marshal(f.ociManifestContent)
 	if err != nil {
 		panic(err)
 	}
-	err = os.WriteFile(f.manifestPath, data, 0755)
+	if len(f.indexContent.Manifests) == 0 {
+		panic("no manifest found in " + f.indexPath)
+	}
+	path := &f.ociManifestPath
+	for i := len(f.ociNested) - 1; i >= 0; i-- {
+		nested := &f.ociNested[i]
+		desc := f.writeBlob(data, *path, nested.content.Manifests[nested.pos])
+		*path = f.blobPath(desc.Digest.Encoded())
+		nested.content.Manifests[nested.pos] = desc
+		if data, err = json.Marshal(nested.content); err != nil {
+			panic(err)
+		}
+		path = &nested.path
+	}
+	desc := f.writeBlob(data, *path, f.indexContent.Manifests[0])
+	*path = f.blobPath(desc.Digest.Encoded())
+
+	if len(f.manifestContent[0].RepoTags) > 0 {
+		repoTag := f.manifestContent[0].RepoTags[0]
+		if desc.Annotations == nil {
+			desc.Annotations = map[string]string{}
+		}
+		if named, err := reference.ParseNormalizedNamed(repoTag); err != nil {
+			log.Warn("Cannot parse repo tag: ", repoTag, ", ", err)
+		} else if tagged, ok := named.(reference.Tagged); ok {
+			desc.Annotations[containerdName] = named.String()
+			desc.Annotations[ociRefNameKey] = tagged.Tag()
+			if f.ociArchive {
+				// podman names the image after the whole reference
+				desc.Annotations[ociRefNameKey] = named.String()
+			}
+		}
+	}
+	f.indexContent.Manifests[0] = desc
+
+	data, err = json.Marshal(f.indexContent)
 	if err != nil {
 		panic(err)
 	}
+	if err = os.WriteFile(f.indexPath, data, 0644); err != nil {
+		panic(err)
+	}
 }
 
 // TarWholeFs archives the whole filesystem of the image to a tar file.
@@ -449,6 +752,85 @@ func (f *ImgTarFs) TarWholeFs(dst string) {
 	util.TarFiles(f.basePath, dst)
 }
 
+// readJson decodes a json file into v.
+func readJson(path string, v interface{}) {
+	file, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	if err = json.NewDecoder(file).Decode(v); err != nil {
+		panic(err)
+	}
+}
+
+// parseOCILayout parses index.json and the image manifest it points to.
+// If index.json points to an image index, the manifest of the image is selected among those it lists, see selectManifest.
+func (f *ImgTarFs) parseOCILayout() {
+	f.indexPath = filepath.Join(f.basePath, ociIndexFile)
+	readJson(f.indexPath, &f.indexContent)
+	if len(f.indexContent.Manifests) == 0 {
+		panic("no manifest found in " + f.indexPath)
+	}
+	desc := f.indexContent.Manifests[0]
+	for desc.MediaType == ispec.MediaTypeImageIndex || desc.MediaType == dockerManifestList {
+		nested := ociNestedIndex{path: f.blobPath(desc.Digest.Encoded())}
+		readJson(nested.path, &nested.content)
+		nested.pos = f.selectManifest(nested.content, nested.path)
+		f.ociNested = append(f.ociNested, nested)
+		desc = nested.content.Manifests[nested.pos]
+	}
+	if desc.MediaType != "" && desc.MediaType != ispec.MediaTypeImageManifest && desc.MediaType != dockerManifest {
+		panic(fmt.Sprintf("unsupported media type %s of %s in %s", desc.MediaType, desc.Digest, f.indexPath))
+	}
+	f.ociManifestPath = f.blobPath(desc.Digest.Encoded())
+	readJson(f.ociManifestPath, &f.ociManifestContent)
+}
+
+// selectManifest returns the position of the manifest of the image in a nested image index.
+// Only manifests whose blob is saved are considered, attestations are skipped.
+// The manifest of the config in manifest.json is selected, or else the one of the platform baffs runs on.
+func (f *ImgTarFs) selectManifest(index ispec.Index, indexPath string) int {
+	for i, desc := range index.Manifests {
+		if desc.Platform != nil && desc.Platform.OS == "unknown" {
+			continue
+		}
+		path := f.blobPath(desc.Digest.Encoded())
+		if !util.PathExist(path) {
+			continue
+		}
+		if len(f.manifestContent) > 0 {
+			var m ispec.Manifest
+			readJson(path, &m)
+			if relBlobPath(m.Config.Digest.Encoded()) == f.manifestContent[0].Config {
+				return i
+			}
+		} else if desc.Platform == nil || (desc.Platform.OS == runtime.GOOS && desc.Platform.Architecture == runtime.GOARCH) {
+			return i
+		}
+	}
+	if len(f.manifestContent) > 0 {
+		panic("no image manifest of config " + f.manifestContent[0].Config + " found in " + indexPath)
+	}
+	panic("no image manifest of " + runtime.GOOS + "/" + runtime.GOARCH + " found in " + indexPath)
+}
+
+// ociManifest returns the manifest.json entry of an oci-archive, named after the annotations of its index.
+func (f *ImgTarFs) ociManifest() Manifest {
+	m := Manifest{Config: relBlobPath(f.ociManifestContent.Config.Digest.Encoded())}
+	for _, l := range f.ociManifestContent.Layers {
+		m.Layers = append(m.Layers, relBlobPath(l.Digest.Encoded()))
+	}
+	annotations := f.indexContent.Manifests[0].Annotations
+	if name := annotations[containerdName]; name != "" {
+		m.RepoTags = []string{name}
+	} else if name := annotations[ociRefNameKey]; strings.ContainsAny(name, ":/") {
+		// a tag alone cannot name the image
+		m.RepoTags = []string{name}
+	}
+	return m
+}
+
 // ParseImgTarFs parses the filesystem of a docker image in a tar file.
 func ParseImgTarFs(path string) ImgTarFs {
 	imgTarFs := ImgTarFs{
@@ -456,42 +838,38 @@ func ParseImgTarFs(path string) ImgTarFs {
 	}
 	imgTarFs.manifestPath = filepath.Join(path, "manifest.json")
 	imgTarFs.repoPath = filepath.Join(path, "repositories")
+	imgTarFs.ociLayout = util.PathExist(filepath.Join(path, ociLayoutFile))
 
-	manifestFile, err := os.Open(imgTarFs.manifestPath)
-	if err != nil {
-		panic(err)
-	}
-	defer manifestFile.Close()
-
-	var mf []Manifest
-	err = json.NewDecoder(manifestFile).Decode(&mf)
-	if err != nil {
-		panic(err)
+	if imgTarFs.ociLayout && !util.PathExist(imgTarFs.manifestPath) {
+		imgTarFs.ociArchive = true
+		imgTarFs.parseOCILayout()
+		imgTarFs.manifestContent = []Manifest{imgTarFs.ociManifest()}
+	} else {
+		var mf []Manifest
+		readJson(imgTarFs.manifestPath, &mf)
+		imgTarFs.manifestContent = mf
 	}
-	imgTarFs.manifestContent = mf
 
 	manifestEle := imgTarFs.manifestContent[0]
 
 	imgTarFs.imgJsonPath = filepath.Join(path, manifestEle.Config)
-	imgJsonFile, err := os.Open(imgTarFs.imgJsonPath)
-	if err != nil {
-		panic(err)
-	}
-	defer imgJsonFile.Close()
-
 	var imgJson ImgJson
-	err = json.NewDecoder(imgJsonFile).Decode(&imgJson)
-	if err != nil {
-		panic(err)
-	}
+	readJson(imgTarFs.imgJsonPath, &imgJson)
 	imgTarFs.imgJsonContent = imgJson
 
+	if imgTarFs.ociLayout && !imgTarFs.ociArchive {
+		imgTarFs.parseOCILayout()
+	}
+
 	for _, layerTar := range manifestEle.Layers {
 		imgTarLayer := ImgTarLayer{}
-		layer := layerTar[0 : len(layerTar)-len("layer.tar")]
-		imgTarLayer.jsonPath = filepath.Join(path, layer, "json")
 		imgTarLayer.layerTarPath = filepath.Join(path, layerTar)
-		imgTarLayer.versionPath = filepath.Join(path, layer, "VERSION")
+		if !imgTarFs.ociLayout {
+			// legacy layers are stored as {layer_id}/layer.tar, along with json and VERSION
+			layer := filepath.Dir(layerTar)
+			imgTarLayer.jsonPath = filepath.Join(path, layer, "json")
+			imgTarLayer.versionPath = filepath.Join(path, layer, "VERSION")
+		}
 		imgTarFs.layers = append(imgTarFs.layers, imgTarLayer)
 	}
 	return imgTarFs
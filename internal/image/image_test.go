@@ -23,12 +23,20 @@ package image
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/negativa-ai/BLAFS/internal/util"
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -67,3 +75,237 @@ func TestNewLayerInfo(t *testing.T) {
 	assert.NotEmpty(t, layerInfo.diffPath)
 	assert.NotEmpty(t, layerInfo.linkPath)
 }
+
+// writeOCIImgTarFs writes a minimal OCI layout produced by `docker save` on Docker >= 25.
+func writeOCIImgTarFs(t *testing.T, dir string) {
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	assert.NoError(t, os.MkdirAll(blobs, 0755))
+	writeBlob := func(data []byte) (string, int64) {
+		sum := fmt.Sprintf("%x", sha256.Sum256(data))
+		assert.NoError(t, os.WriteFile(filepath.Join(blobs, sum), data, 0644))
+		return sum, int64(len(data))
+	}
+
+	layerSum, layerSize := writeBlob([]byte("layer"))
+	config := fmt.Sprintf(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:%s"]}}`, layerSum)
+	configSum, configSize := writeBlob([]byte(config))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:%s","size":%d},`+
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":"sha256:%s","size":%d}]}`,
+		configSum, configSize, layerSum, layerSize)
+	manifestSum, manifestSize := writeBlob([]byte(manifest))
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json",`+
+		`"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:%s","size":%d,`+
+		`"annotations":{"io.containerd.image.name":"docker.io/library/hello-world:latest","org.opencontainers.image.ref.name":"latest"}}]}`,
+		manifestSum, manifestSize)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), []byte(index), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+	mf := fmt.Sprintf(`[{"Config":"blobs/sha256/%s","RepoTags":["hello-world:latest"],"Layers":["blobs/sha256/%s"]}]`, configSum, layerSum)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(mf), 0644))
+}
+
+func TestParseImgTarFsLegacy(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "abc"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "abc", "layer.tar"), []byte("layer"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "cfg.json"), []byte(`{"rootfs":{"type":"layers","diff_ids":["sha256:0"]}}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(`[{"Config":"cfg.json","RepoTags":["a:b"],"Layers":["abc/layer.tar"]}]`), 0644))
+
+	imgTarFs := ParseImgTarFs(dir)
+
+	assert.False(t, imgTarFs.IsOCILayout())
+	assert.Equal(t, 1, len(imgTarFs.GetLayers()))
+	assert.Equal(t, filepath.Join(dir, "abc", "json"), imgTarFs.GetLayers()[0].jsonPath)
+}
+
+func TestParseImgTarFsOCI(t *testing.T) {
+	dir := t.TempDir()
+	writeOCIImgTarFs(t, dir)
+
+	imgTarFs := ParseImgTarFs(dir)
+
+	assert.True(t, imgTarFs.IsOCILayout())
+	assert.Equal(t, 1, len(imgTarFs.GetLayers()))
+	assert.Equal(t, 1, len(imgTarFs.ociManifestContent.Layers))
+	assert.Equal(t, "sha256:"+filepath.Base(imgTarFs.GetLayers()[0].GetLayerTarPath()), imgTarFs.GetImageJson().Rootfs.DiffIds[0])
+}
+
+func TestImgTarFsOCIRewriteLayer(t *testing.T) {
+	dir := t.TempDir()
+	writeOCIImgTarFs(t, dir)
+	imgTarFs := ParseImgTarFs(dir)
+
+	layer := imgTarFs.GetLayers()[0]
+	layer.RmLayerTar()
+	assert.NoError(t, os.WriteFile(layer.GetLayerTarPath(), []byte("debloated"), 0644))
+	imgTarFs.UpdateLayer(0)
+	imgTarFs.DumpImgJson()
+	imgTarFs.GetManifest()[0].RepoTags[0] += "-baffs"
+	imgTarFs.DumpManifest()
+
+	reparsed := ParseImgTarFs(dir)
+	newSum := fmt.Sprintf("%x", sha256.Sum256([]byte("debloated")))
+	assert.Equal(t, "sha256:"+newSum, reparsed.GetImageJson().Rootfs.DiffIds[0])
+	assert.Equal(t, "blobs/sha256/"+newSum, reparsed.GetManifest()[0].Layers[0])
+	assert.Equal(t, "sha256:"+newSum, reparsed.ociManifestContent.Layers[0].Digest.String())
+	assert.Equal(t, int64(len("debloated")), reparsed.ociManifestContent.Layers[0].Size)
+
+	// the config and the manifest must be addressed by their digests
+	configSum, err := util.Sha256Sum(reparsed.imgJsonPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+configSum, reparsed.ociManifestContent.Config.Digest.String())
+	manifestSum, err := util.Sha256Sum(reparsed.ociManifestPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+manifestSum, reparsed.indexContent.Manifests[0].Digest.String())
+	assert.Equal(t, "docker.io/library/hello-world:latest-baffs", reparsed.indexContent.Manifests[0].Annotations["io.containerd.image.name"])
+
+	var index map[string]interface{}
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &index))
+	assert.Equal(t, "application/vnd.oci.image.index.v1+json", index["mediaType"])
+
+	// old blobs are removed
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+}
+
+func TestImgTarFsOCINestedIndex(t *testing.T) {
+	// docker save from the containerd image store points index.json to an image index of all platforms
+	dir := t.TempDir()
+	writeOCIImgTarFs(t, dir)
+	var index ispec.Index
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &index))
+	image := index.Manifests[0]
+	image.Annotations = nil
+	image.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+	attestation := image
+	attestation.Platform = &ispec.Platform{OS: "unknown", Architecture: "unknown"}
+	// the manifest of another platform is not saved
+	arm64 := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: digest.FromString("arm64"), Size: 5,
+		Platform: &ispec.Platform{OS: "linux", Architecture: "arm64"}}
+	nested, err := json.Marshal(ispec.Index{MediaType: ispec.MediaTypeImageIndex, Manifests: []ispec.Descriptor{arm64, attestation, image}})
+	assert.NoError(t, err)
+	nestedDigest := digest.FromBytes(nested)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "blobs", "sha256", nestedDigest.Encoded()), nested, 0644))
+	index.Manifests[0].MediaType = ispec.MediaTypeImageIndex
+	index.Manifests[0].Digest = nestedDigest
+	index.Manifests[0].Size = int64(len(nested))
+	data, err = json.Marshal(index)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), data, 0644))
+
+	imgTarFs := ParseImgTarFs(dir)
+	assert.Equal(t, 2, imgTarFs.ociNested[0].pos)
+	assert.Equal(t, 1, len(imgTarFs.ociManifestContent.Layers))
+
+	layer := imgTarFs.GetLayers()[0]
+	layer.RmLayerTar()
+	assert.NoError(t, os.WriteFile(layer.GetLayerTarPath(), []byte("debloated"), 0644))
+	imgTarFs.UpdateLayer(0)
+	imgTarFs.DumpImgJson()
+	imgTarFs.GetManifest()[0].RepoTags[0] += "-baffs"
+	imgTarFs.DumpManifest()
+
+	reparsed := ParseImgTarFs(dir)
+	newSum := fmt.Sprintf("%x", sha256.Sum256([]byte("debloated")))
+	assert.Equal(t, "sha256:"+newSum, reparsed.ociManifestContent.Layers[0].Digest.String())
+	// the manifest, the nested index and index.json must be addressed by their digests
+	manifestSum, err := util.Sha256Sum(reparsed.ociManifestPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+manifestSum, reparsed.ociNested[0].content.Manifests[2].Digest.String())
+	assert.Equal(t, "linux", reparsed.ociNested[0].content.Manifests[2].Platform.OS)
+	assert.Len(t, reparsed.ociNested[0].content.Manifests, 3)
+	nestedSum, err := util.Sha256Sum(reparsed.ociNested[0].path)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+nestedSum, reparsed.indexContent.Manifests[0].Digest.String())
+	assert.Equal(t, ispec.MediaTypeImageIndex, reparsed.indexContent.Manifests[0].MediaType)
+	assert.Equal(t, "docker.io/library/hello-world:latest-baffs", reparsed.indexContent.Manifests[0].Annotations["io.containerd.image.name"])
+	assert.NoFileExists(t, filepath.Join(dir, "blobs", "sha256", nestedDigest.Encoded()))
+}
+
+func TestImgTarFsOCINestedIndexUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	writeOCIImgTarFs(t, dir)
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	assert.NoError(t, err)
+	data = []byte(strings.Replace(string(data), `"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json"`,
+		`"manifests":[{"mediaType":"application/vnd.oci.artifact.v1+json"`, 1))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), data, 0644))
+	assert.Panics(t, func() { ParseImgTarFs(dir) })
+}
+
+func TestImgTarFsOCIArchive(t *testing.T) {
+	// an oci-archive saved by podman has no manifest.json, the index names the image after the whole reference
+	dir := t.TempDir()
+	writeOCIImgTarFs(t, dir)
+	assert.NoError(t, os.Remove(filepath.Join(dir, "manifest.json")))
+	index, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	assert.NoError(t, err)
+	index = []byte(strings.Replace(string(index), `"io.containerd.image.name":"docker.io/library/hello-world:latest","org.opencontainers.image.ref.name":"latest"`,
+		`"org.opencontainers.image.ref.name":"docker.io/library/hello-world:latest"`, 1))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), index, 0644))
+
+	imgTarFs := ParseImgTarFs(dir)
+	assert.True(t, imgTarFs.IsOCILayout())
+	assert.Equal(t, []string{"docker.io/library/hello-world:latest"}, imgTarFs.GetManifest()[0].RepoTags)
+	assert.Equal(t, 1, len(imgTarFs.GetLayers()))
+
+	layer := imgTarFs.GetLayers()[0]
+	layer.RmLayerTar()
+	assert.NoError(t, os.WriteFile(layer.GetLayerTarPath(), []byte("debloated"), 0644))
+	imgTarFs.UpdateLayer(0)
+	imgTarFs.DumpImgJson()
+	imgTarFs.GetManifest()[0].RepoTags[0] += "-baffs"
+	imgTarFs.DumpManifest()
+
+	assert.False(t, util.PathExist(filepath.Join(dir, "manifest.json")))
+	reparsed := ParseImgTarFs(dir)
+	newSum := fmt.Sprintf("%x", sha256.Sum256([]byte("debloated")))
+	assert.Equal(t, "sha256:"+newSum, reparsed.GetImageJson().Rootfs.DiffIds[0])
+	assert.Equal(t, "docker.io/library/hello-world:latest-baffs", reparsed.indexContent.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+	assert.Equal(t, []string{"docker.io/library/hello-world:latest-baffs"}, reparsed.GetManifest()[0].RepoTags)
+}
+
+func TestShadowLayerRemove(t *testing.T) {
+	overlay := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(overlay, "l"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(overlay, "abc", "diff"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(overlay, "abc", "link"), []byte("ABC"), 0644))
+	metaPath := filepath.Join(overlay, "meta")
+	assert.NoError(t, os.MkdirAll(metaPath, 0755))
+	cacheIdPath := filepath.Join(metaPath, "cache-id")
+	assert.NoError(t, os.WriteFile(cacheIdPath, []byte("abc"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(metaPath, "size"), []byte("0"), 0600))
+
+	original := NewOriginalLayer(*NewLayerInfo(filepath.Join(overlay, "abc")))
+	original.SetMetaPath(metaPath)
+	original.SetCacheIdPath(cacheIdPath)
+	original.SetSizePath(filepath.Join(metaPath, "size"))
+	shadow := original.Shadow()
+	shadow.Dump(nil)
+	assert.True(t, util.PathExist(filepath.Join(overlay, "l", "shadow_ABC")))
+
+	shadow.Restore(nil)
+	shadow.Remove()
+
+	assert.False(t, util.PathExist(filepath.Join(overlay, "shadow_abc")))
+	assert.False(t, util.PathExist(filepath.Join(overlay, "l", "shadow_ABC")))
+	assert.False(t, util.PathExist(cacheIdPath+".bak"))
+	cacheId, err := os.ReadFile(cacheIdPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(cacheId))
+}
+
+func TestShadowLayerRemoveRefusesOriginal(t *testing.T) {
+	overlay := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(overlay, "abc", "diff"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(overlay, "abc", "link"), []byte("ABC"), 0644))
+	layer := NewShadowLayer(*NewLayerInfo(filepath.Join(overlay, "abc")))
+
+	assert.Panics(t, func() { layer.Remove() })
+	assert.True(t, util.PathExist(filepath.Join(overlay, "abc")))
+}
@@ -0,0 +1,53 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package imagetest provides layer stack fixtures for tests.
+package imagetest
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/stretchr/testify/assert"
+)
+
+// NewStack creates a stack of n layers with empty original and kept dirs, the top layer first.
+func NewStack(t testing.TB, n int) image.LayerStack {
+	dir := t.TempDir()
+	var stack image.LayerStack
+	for i := 0; i < n; i++ {
+		l := image.StackLayer{Origin: filepath.Join(dir, "origin", strconv.Itoa(i)), Kept: filepath.Join(dir, "kept", strconv.Itoa(i))}
+		assert.NoError(t, os.MkdirAll(l.Origin, 0755))
+		assert.NoError(t, os.MkdirAll(l.Kept, 0755))
+		stack = append(stack, l)
+	}
+	return stack
+}
+
+// WriteFile writes a file, creating its parent dirs.
+func WriteFile(t testing.TB, path string, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
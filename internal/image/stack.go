@@ -0,0 +1,392 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package image
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/negativa-ai/BLAFS/internal/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// modeBits are the mode bits copied from original files, including sticky, setuid and setgid.
+const modeBits = os.ModePerm | os.ModeSticky | os.ModeSetuid | os.ModeSetgid
+
+// maxSymlinks bounds the number of symlinks followed when resolving a path, as in the kernel.
+const maxSymlinks = 40
+
+// A StackLayer pairs the original diff dir of a layer with the dir holding its kept files.
+type StackLayer struct {
+	Origin string
+	Kept   string
+}
+
+// A LayerStack is the layers of a shadowed image, ordered from the top layer to the bottom one.
+// Paths are resolved in the merged view of the original layers, as overlayfs does,
+// and kept files are copied from the original layer providing them to its kept dir.
+type LayerStack []StackLayer
+
+// NewLayerStack creates the stack of shadow layers, ordered from the top layer to the bottom one.
+func NewLayerStack(shadowLayers []ShadowLayer) LayerStack {
+	var stack LayerStack
+	for _, l := range shadowLayers {
+		original := l.Original()
+		stack = append(stack, StackLayer{Origin: original.GetDiffPath(), Kept: l.GetKeptPath()})
+	}
+	return stack
+}
+
+// Lookup returns the index of the topmost layer providing a path in the merged view, or -1.
+// Whiteouts, opaque directories and non-directories on the path hide it in lower layers.
+func (s LayerStack) Lookup(name string) int {
+	for i, l := range s {
+		if info, err := os.Lstat(filepath.Join(l.Origin, name)); err == nil {
+			if util.IsWhiteout(info) {
+				return -1
+			}
+			return i
+		}
+		for p := path.Dir(name); p != "."; p = path.Dir(p) {
+			info, err := os.Lstat(filepath.Join(l.Origin, p))
+			if err != nil {
+				continue
+			}
+			if !info.IsDir() || util.IsOpaqueDir(filepath.Join(l.Origin, p)) {
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// Resolve returns the path and all paths needed to resolve it in lexical order:
+// symlinks among its parents, and the targets of those symlinks and of the path itself.
+// Paths missing in the merged view are left out.
+func (s LayerStack) Resolve(name string) []string {
+	_, closure := s.resolve(name)
+	paths := make([]string, 0, len(closure))
+	for p := range closure {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Realpath returns the path with all symlinks resolved in the merged view, and false if it is missing.
+func (s LayerStack) Realpath(name string) (string, bool) {
+	realPath, _ := s.resolve(name)
+	return realPath, realPath != ""
+}
+
+// OriginPath returns the path of a file in the topmost original layer providing it, and false if it is missing.
+// Symlinks are not resolved.
+func (s LayerStack) OriginPath(name string) (string, bool) {
+	l := s.Lookup(name)
+	if l == -1 {
+		return "", false
+	}
+	return filepath.Join(s[l].Origin, name), true
+}
+
+// resolve returns the resolved path, or "" if missing, and the paths needed to resolve it.
+func (s LayerStack) resolve(name string) (string, map[string]bool) {
+	closure := map[string]bool{}
+	followed := 0
+	var walk func(name string) string
+	walk = func(name string) string {
+		if closure[name] {
+			return name
+		}
+		segments := strings.Split(name, "/")
+		for i := range segments {
+			p := path.Join(segments[:i+1]...)
+			l := s.Lookup(p)
+			if l == -1 {
+				return ""
+			}
+			full := filepath.Join(s[l].Origin, p)
+			info, err := os.Lstat(full)
+			if err != nil || info.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			closure[p] = true
+			followed++
+			if followed > maxSymlinks {
+				log.Warn("too many levels of symbolic links: ", name)
+				return ""
+			}
+			target, err := os.Readlink(full)
+			if err != nil {
+				panic(err)
+			}
+			// resolve the target inside the image root, ".." never leaves it
+			if !path.IsAbs(target) {
+				target = path.Join("/", path.Dir(p), target)
+			}
+			target = strings.TrimPrefix(path.Clean("/"+target), "/")
+			if target == "" {
+				return ""
+			}
+			return walk(path.Join(append([]string{target}, segments[i+1:]...)...))
+		}
+		closure[name] = true
+		return name
+	}
+	realPath := walk(path.Clean(strings.TrimPrefix(name, "/")))
+	return realPath, closure
+}
+
+// Keep copies a path from the topmost original layer providing it to the kept dir of that layer.
+// It returns false if the path is missing, already kept or in a layer exported unchanged.
+func (s LayerStack) Keep(name string) bool {
+	l := s.Lookup(name)
+	if l == -1 || s[l].Kept == s[l].Origin {
+		return false
+	}
+	return keepPath(s[l].Origin, s[l].Kept, name)
+}
+
+// KeepResolved keeps a path together with all paths needed to resolve it, see Resolve.
+// It returns the paths newly kept.
+func (s LayerStack) KeepResolved(name string) []string {
+	var added []string
+	for _, p := range s.Resolve(name) {
+		if s.Keep(p) {
+			added = append(added, p)
+		}
+	}
+	return added
+}
+
+// WalkKept calls fn with the layer and the relative path of every entry in the kept dirs.
+func (s LayerStack) WalkKept(fn func(l StackLayer, relPath string, d fs.DirEntry)) {
+	for _, l := range s {
+		if err := filepath.WalkDir(l.Kept, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(l.Kept, p)
+			if err != nil {
+				return err
+			}
+			if relPath != "." {
+				fn(l, relPath, d)
+			}
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// SymlinkClosure keeps the targets of all kept symlinks, following symlink chains across layers.
+// It returns the paths newly kept.
+func (s LayerStack) SymlinkClosure() []string {
+	var symlinks []string
+	s.WalkKept(func(_ StackLayer, relPath string, d fs.DirEntry) {
+		if d.Type()&os.ModeSymlink != 0 {
+			symlinks = append(symlinks, relPath)
+		}
+	})
+	var added []string
+	for _, p := range symlinks {
+		added = append(added, s.KeepResolved(p)...)
+	}
+	return added
+}
+
+// KeepSkeleton keeps every directory of the original layers, with its original mode.
+// It returns the directories newly kept.
+func (s LayerStack) KeepSkeleton() []string {
+	var added []string
+	for _, l := range s {
+		if err := filepath.WalkDir(l.Origin, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(l.Origin, p)
+			if err != nil {
+				return err
+			}
+			if relPath != "." && d.IsDir() && keepPath(l.Origin, l.Kept, relPath) {
+				added = append(added, relPath)
+			}
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+	}
+	return added
+}
+
+// IsKept returns true if a file of an original layer is kept in the kept dir of its layer.
+// An empty kept file is a placeholder of a file never opened, unless the original file is empty too.
+func IsKept(keptDir string, relPath string, info os.FileInfo) bool {
+	keptInfo, err := os.Lstat(filepath.Join(keptDir, relPath))
+	if err != nil {
+		return false
+	}
+	return !info.Mode().IsRegular() || keptInfo.Size() > 0 || info.Size() == 0
+}
+
+// IsKept returns true if a path of the merged view is kept, symlinks are resolved.
+func (s LayerStack) IsKept(name string) bool {
+	realPath, ok := s.Realpath(name)
+	if !ok {
+		return false
+	}
+	l := s.Lookup(realPath)
+	info, err := os.Lstat(filepath.Join(s[l].Origin, realPath))
+	if err != nil {
+		return false
+	}
+	return IsKept(s[l].Kept, realPath, info)
+}
+
+// ReadFile reads a file of the merged view of the original layers, symlinks are resolved.
+func (s LayerStack) ReadFile(name string) ([]byte, error) {
+	realPath, ok := s.Realpath(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	originPath, _ := s.OriginPath(realPath)
+	return os.ReadFile(originPath)
+}
+
+// WriteKept writes a file to the kept dir of the topmost layer providing it, or of the top layer if it is missing.
+// Symlinks are resolved, missing parent directories are created.
+// A layer exported unchanged, whose kept dir is its original dir, is never written.
+func (s LayerStack) WriteKept(name string, data []byte, perm os.FileMode) {
+	l := 0
+	if realPath, ok := s.Realpath(name); ok {
+		name = realPath
+		l = s.Lookup(realPath)
+	}
+	if s[l].Kept == s[l].Origin {
+		return
+	}
+	makeParents(s[l].Origin, s[l].Kept, path.Dir(name))
+	if err := os.WriteFile(filepath.Join(s[l].Kept, name), data, perm); err != nil {
+		panic(err)
+	}
+}
+
+// RemoveKept removes a file from the kept dir of the topmost layer providing it, unless the layer is exported unchanged.
+func (s LayerStack) RemoveKept(name string) {
+	realPath, ok := s.Realpath(name)
+	if !ok {
+		return
+	}
+	l := s.Lookup(realPath)
+	if s[l].Kept == s[l].Origin {
+		return
+	}
+	if err := os.Remove(filepath.Join(s[l].Kept, realPath)); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+}
+
+// keepPath copies a file, a symlink or an empty directory of a layer from its original diff dir to its kept dir.
+// Existing files are overwritten only if they are empty placeholders of non-empty original files.
+// It returns false if nothing is copied.
+func keepPath(originDir string, keptDir string, name string) bool {
+	src := filepath.Join(originDir, name)
+	dst := filepath.Join(keptDir, name)
+	info, err := os.Lstat(src)
+	if err != nil {
+		panic(err)
+	}
+	if dstInfo, err := os.Lstat(dst); err == nil {
+		if !dstInfo.Mode().IsRegular() || dstInfo.Size() == info.Size() {
+			return false
+		}
+	}
+	makeParents(originDir, keptDir, path.Dir(name))
+
+	switch {
+	case info.IsDir():
+		if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+			panic(err)
+		}
+		copyOwner(info, dst)
+		// mkdir is subject to umask
+		if err := os.Chmod(dst, info.Mode()&modeBits); err != nil {
+			panic(err)
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			panic(err)
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			panic(err)
+		}
+		copyOwner(info, dst)
+	case info.Mode().IsRegular():
+		util.CopyFile(src, dst)
+		// chown clears setuid and setgid, so it goes first
+		copyOwner(info, dst)
+		if err := os.Chmod(dst, info.Mode()&modeBits); err != nil {
+			panic(err)
+		}
+	default:
+		// fifos and devices are added from the original layer when archiving
+		return false
+	}
+	return true
+}
+
+// copyOwner sets the owner of a kept file to the one of its original.
+func copyOwner(info os.FileInfo, dst string) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			log.Debug("failed to chown ", dst, ": ", err)
+		}
+	}
+}
+
+// makeParents creates the parent directories of a kept path with the mode of their originals.
+func makeParents(originDir string, keptDir string, dir string) {
+	if dir == "." || dir == "/" {
+		return
+	}
+	if util.PathExist(filepath.Join(keptDir, dir)) {
+		return
+	}
+	makeParents(originDir, keptDir, path.Dir(dir))
+	mode := os.FileMode(0755)
+	if info, err := os.Stat(filepath.Join(originDir, dir)); err == nil {
+		mode = info.Mode() & modeBits
+	}
+	if err := os.Mkdir(filepath.Join(keptDir, dir), mode); err != nil && !os.IsExist(err) {
+		panic(err)
+	}
+	if err := os.Chmod(filepath.Join(keptDir, dir), mode); err != nil {
+		panic(err)
+	}
+}
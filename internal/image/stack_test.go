@@ -0,0 +1,93 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package image_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image/imagetest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestLayerStackLookup(t *testing.T) {
+	stack := imagetest.NewStack(t, 2)
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "etc/hosts"), "hosts")
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "etc/passwd"), "passwd")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "etc/passwd"), "passwd")
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "var/cache/a"), "a")
+	assert.NoError(t, os.MkdirAll(filepath.Join(stack[0].Origin, "var"), 0755))
+	if err := unix.Mknod(filepath.Join(stack[0].Origin, "var/cache"), unix.S_IFCHR, 0); err != nil {
+		t.Skip("cannot create whiteout: ", err)
+	}
+
+	assert.Equal(t, 1, stack.Lookup("etc/hosts"))
+	assert.Equal(t, 0, stack.Lookup("etc/passwd"))
+	assert.Equal(t, -1, stack.Lookup("var/cache"))
+	assert.Equal(t, -1, stack.Lookup("var/cache/a"))
+	assert.Equal(t, -1, stack.Lookup("missing"))
+}
+
+func TestLayerStackSymlinkClosure(t *testing.T) {
+	stack := imagetest.NewStack(t, 2)
+	// top: kept bin/sh -> busybox -> /usr/bin/busybox, with usr/bin -> ../lib/bin in the bottom layer
+	assert.NoError(t, os.MkdirAll(filepath.Join(stack[0].Origin, "bin"), 0755))
+	assert.NoError(t, os.Symlink("busybox", filepath.Join(stack[0].Origin, "bin/sh")))
+	assert.NoError(t, os.Symlink("/usr/bin/busybox", filepath.Join(stack[0].Origin, "bin/busybox")))
+	assert.NoError(t, os.MkdirAll(filepath.Join(stack[0].Kept, "bin"), 0755))
+	assert.NoError(t, os.Symlink("busybox", filepath.Join(stack[0].Kept, "bin/sh")))
+	assert.NoError(t, os.MkdirAll(filepath.Join(stack[1].Origin, "usr"), 0755))
+	assert.NoError(t, os.Symlink("../lib/bin", filepath.Join(stack[1].Origin, "usr/bin")))
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "lib/bin/busybox"), "busybox")
+	// a cycle is not followed forever
+	assert.NoError(t, os.Symlink("loop", filepath.Join(stack[0].Origin, "loop")))
+	assert.NoError(t, os.Symlink("loop", filepath.Join(stack[0].Kept, "loop")))
+
+	added := stack.SymlinkClosure()
+
+	assert.ElementsMatch(t, []string{"bin/busybox", "lib/bin/busybox", "usr/bin"}, added)
+	content, err := os.ReadFile(filepath.Join(stack[1].Kept, "lib/bin/busybox"))
+	assert.NoError(t, err)
+	assert.Equal(t, "busybox", string(content))
+	assert.Empty(t, stack.SymlinkClosure())
+}
+
+func TestLayerStackKeepSkeleton(t *testing.T) {
+	stack := imagetest.NewStack(t, 1)
+	assert.NoError(t, os.MkdirAll(filepath.Join(stack[0].Origin, "tmp"), 0755))
+	assert.NoError(t, os.Chmod(filepath.Join(stack[0].Origin, "tmp"), os.ModeSticky|0777))
+	assert.NoError(t, os.MkdirAll(filepath.Join(stack[0].Origin, "var/run"), 0700))
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "etc/hosts"), "hosts")
+
+	added := stack.KeepSkeleton()
+
+	assert.ElementsMatch(t, []string{"tmp", "var", "var/run", "etc"}, added)
+	info, err := os.Stat(filepath.Join(stack[0].Kept, "var/run"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(stack[0].Kept, "tmp"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeSticky|0777, info.Mode()&(os.ModeSticky|os.ModePerm))
+	assert.NoFileExists(t, filepath.Join(stack[0].Kept, "etc/hosts"))
+}
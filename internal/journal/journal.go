@@ -0,0 +1,349 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/negativa-ai/BLAFS/internal/mount"
+	"github.com/negativa-ai/BLAFS/internal/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const journalFile = "journal.jsonl"
+
+// Actions that can be recorded in a journal.
+const (
+	ActionMkdir      = "mkdir"      // a directory is created
+	ActionCreate     = "create"     // a file is created, its previous content is not kept
+	ActionWrite      = "write"      // a small file is written, its previous content is kept
+	ActionSymlink    = "symlink"    // a symlink is created
+	ActionRelink     = "relink"     // a symlink is replaced, its previous target is kept
+	ActionRmdir      = "rmdir"      // an empty directory, e.g., an unmounted mount point, is removed
+	ActionMove       = "move"       // a file or directory is moved
+	ActionMount      = "mount"      // a debloated_fs mount is created
+	ActionUmount     = "umount"     // a debloated_fs mount is removed
+	ActionCheckpoint = "checkpoint" // a step of the operation is done
+)
+
+// A Header describes the operation a journal belongs to, so that it can be run again.
+type Header struct {
+	Op      string            `json:"op"`
+	Images  []string          `json:"images"`
+	Options map[string]string `json:"options,omitempty"`
+	Time    time.Time         `json:"time"`
+}
+
+// An Entry is a mutation of the docker storage, recorded before it happens.
+type Entry struct {
+	Action  string `json:"action"`
+	Path    string `json:"path"`
+	Dst     string `json:"dst,omitempty"`     // destination of a move, or previous target of a relink
+	Existed bool   `json:"existed,omitempty"` // whether path existed before the mutation
+	Data    []byte `json:"data,omitempty"`    // previous content of path, only for ActionWrite
+}
+
+/*
+A Journal is an on-disk write-ahead log of an operation that modifies the docker storage in place,
+such as shadow and debloat. It is stored in {work_dir}/journal.jsonl, one json object per line:
+the header first, then every entry in the order the mutations happen.
+
+A journal is removed once the operation is committed. A journal that is found on start
+belongs to an unfinished operation, which can be rolled forward by running the operation again,
+or rolled back by undoing the recorded entries in reverse order.
+
+All methods of Journal are no-ops on a nil journal.
+*/
+
+type Journal struct {
+	path    string
+	file    *os.File
+	Header  Header
+	Entries []Entry
+}
+
+// Pending returns true if an unfinished operation is recorded in the work dir.
+func Pending(workDir string) bool {
+	return util.PathExist(filepath.Join(workDir, journalFile))
+}
+
+// Begin creates a new journal for an operation in the work dir.
+// It fails if an unfinished operation is recorded.
+func Begin(workDir string, header Header) (*Journal, error) {
+	path := filepath.Join(workDir, journalFile)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, errors.New("an unfinished operation is recorded in " + path)
+		}
+		return nil, err
+	}
+	header.Time = time.Now()
+	j := &Journal{path: path, file: file, Header: header}
+	if err := j.append(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Resume reopens the journal of an unfinished operation, so that the operation can be rolled forward
+// and the new entries are appended to the recorded ones.
+func Resume(workDir string) (*Journal, error) {
+	j, err := Open(workDir)
+	if err != nil {
+		return nil, err
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Open reads the journal of an unfinished operation from the work dir.
+func Open(workDir string) (*Journal, error) {
+	path := filepath.Join(workDir, journalFile)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	j := &Journal{path: path}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	first := true
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if first {
+			if err := json.Unmarshal(line, &j.Header); err != nil {
+				return nil, err
+			}
+			first = false
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// the last entry might be truncated by a crash, the mutation it records never happened
+			log.Warn("Ignore a broken journal entry: ", string(line))
+			break
+		}
+		j.Entries = append(j.Entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if first {
+		return nil, errors.New("empty journal: " + path)
+	}
+	return j, nil
+}
+
+// append writes a json line to the journal file and flushes it to the disk.
+func (j *Journal) append(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Record appends an entry to the journal. It must be called before the mutation happens.
+func (j *Journal) Record(e Entry) {
+	if j == nil {
+		return
+	}
+	if j.file == nil {
+		panic("journal is not writable: " + j.path)
+	}
+	log.Debug("journal: ", e.Action, " ", e.Path, " ", e.Dst)
+	if err := j.append(e); err != nil {
+		panic(err)
+	}
+	j.Entries = append(j.Entries, e)
+}
+
+// HasCheckpoint returns true if the checkpoint with the given name is recorded.
+func (j *Journal) HasCheckpoint(name string) bool {
+	if j == nil {
+		return false
+	}
+	for _, e := range j.Entries {
+		if e.Action == ActionCheckpoint && e.Path == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Commit marks the operation as finished by removing the journal.
+func (j *Journal) Commit() {
+	if j == nil {
+		return
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	if err := os.Remove(j.path); err != nil {
+		panic(err)
+	}
+}
+
+// Rollback undoes all recorded entries in reverse order and removes the journal.
+// It stops with a panic if a layer cannot be unmounted, keeping the journal to roll back again once the layer is unused.
+func (j *Journal) Rollback() {
+	if j == nil {
+		return
+	}
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		undo(j.Entries[i])
+	}
+	j.Commit()
+}
+
+// undo reverts a single entry. Entries whose mutation never happened are skipped.
+func undo(e Entry) {
+	log.Debug("journal undo: ", e.Action, " ", e.Path, " ", e.Dst)
+	switch e.Action {
+	case ActionMkdir, ActionCreate, ActionSymlink:
+		if !e.Existed {
+			if mount.IsMountedWithType(e.Path, mount.MountType) {
+				panic("refuse to remove a path still mounted with debloated_fs: " + e.Path)
+			}
+			if err := os.RemoveAll(e.Path); err != nil {
+				panic(err)
+			}
+		}
+	case ActionWrite:
+		if e.Existed {
+			if err := os.WriteFile(e.Path, e.Data, 0600); err != nil {
+				panic(err)
+			}
+		} else if err := os.Remove(e.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			panic(err)
+		}
+	case ActionRelink:
+		if e.Existed {
+			if err := os.Remove(e.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				panic(err)
+			}
+			if err := os.Symlink(e.Dst, e.Path); err != nil {
+				panic(err)
+			}
+		}
+	case ActionRmdir:
+		if err := os.Mkdir(e.Path, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			panic(err)
+		}
+	case ActionMove:
+		if util.PathExist(e.Dst) && !util.PathExist(e.Path) {
+			if err := util.Move(e.Dst, e.Path); err != nil {
+				panic(err)
+			}
+		}
+	case ActionMount:
+		// removing files through debloated_fs removes them from the original layer, the rollback stops while it is mounted
+		cmd := exec.Command("umount", "-f", e.Path)
+		log.Debug("umount layer: ", cmd)
+		out, err := cmd.CombinedOutput()
+		if mount.IsMountedWithType(e.Path, mount.MountType) {
+			panic(fmt.Sprintf("cannot umount %s: %v: %s", e.Path, err, out))
+		}
+	case ActionUmount:
+		log.Warn("Cannot remount ", e.Path, ", run `baffs shadow` again to remount it")
+	case ActionCheckpoint:
+	default:
+		log.Warn("Unknown journal action: ", e.Action)
+	}
+}
+
+// Mkdir returns an entry that records creating a directory.
+func Mkdir(path string) Entry {
+	return Entry{Action: ActionMkdir, Path: path, Existed: util.PathExist(path)}
+}
+
+// Create returns an entry that records creating a file, without keeping its previous content.
+func Create(path string) Entry {
+	return Entry{Action: ActionCreate, Path: path, Existed: util.PathExist(path)}
+}
+
+// Write returns an entry that records writing a small file, keeping its previous content.
+func Write(path string) Entry {
+	e := Entry{Action: ActionWrite, Path: path}
+	if data, err := os.ReadFile(path); err == nil {
+		e.Existed = true
+		e.Data = data
+	}
+	return e
+}
+
+// Symlink returns an entry that records creating a symlink.
+func Symlink(path string) Entry {
+	_, err := os.Lstat(path)
+	return Entry{Action: ActionSymlink, Path: path, Existed: err == nil}
+}
+
+// Relink returns an entry that records replacing a symlink, keeping its previous target.
+func Relink(path string) Entry {
+	e := Entry{Action: ActionRelink, Path: path}
+	if target, err := os.Readlink(path); err == nil {
+		e.Existed = true
+		e.Dst = target
+	}
+	return e
+}
+
+// Rmdir returns an entry that records removing an empty directory.
+func Rmdir(path string) Entry {
+	return Entry{Action: ActionRmdir, Path: path, Existed: util.PathExist(path)}
+}
+
+// Move returns an entry that records moving src to dst.
+func Move(src string, dst string) Entry {
+	return Entry{Action: ActionMove, Path: src, Dst: dst, Existed: util.PathExist(src)}
+}
+
+// Mount returns an entry that records mounting debloated_fs on a mount point.
+func Mount(mountPoint string) Entry {
+	return Entry{Action: ActionMount, Path: mountPoint}
+}
+
+// Umount returns an entry that records unmounting debloated_fs from a mount point.
+func Umount(mountPoint string) Entry {
+	return Entry{Action: ActionUmount, Path: mountPoint}
+}
+
+// Checkpoint returns an entry that records a finished step of the operation.
+func Checkpoint(name string) Entry {
+	return Entry{Action: ActionCheckpoint, Path: name}
+}
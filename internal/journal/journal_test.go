@@ -0,0 +1,130 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBeginFailsIfPending(t *testing.T) {
+	workDir := t.TempDir()
+	j, err := Begin(workDir, Header{Op: "shadow", Images: []string{"redis"}})
+	assert.NoError(t, err)
+	assert.True(t, Pending(workDir))
+
+	_, err = Begin(workDir, Header{Op: "debloat"})
+	assert.Error(t, err)
+
+	j.Commit()
+	assert.False(t, Pending(workDir))
+}
+
+func TestOpenRecordedEntries(t *testing.T) {
+	workDir := t.TempDir()
+	j, err := Begin(workDir, Header{Op: "debloat", Images: []string{"redis"}, Options: map[string]string{"top": "-1"}})
+	assert.NoError(t, err)
+	j.Record(Mkdir(filepath.Join(workDir, "a")))
+	j.Record(Checkpoint("restored"))
+
+	opened, err := Open(workDir)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "debloat", opened.Header.Op)
+	assert.Equal(t, "-1", opened.Header.Options["top"])
+	assert.Equal(t, 2, len(opened.Entries))
+	assert.True(t, opened.HasCheckpoint("restored"))
+}
+
+func TestRollback(t *testing.T) {
+	workDir := t.TempDir()
+	storage := t.TempDir()
+	cacheId := filepath.Join(storage, "cache-id")
+	assert.NoError(t, os.WriteFile(cacheId, []byte("original"), 0600))
+	layer := filepath.Join(storage, "shadow_layer")
+	real := filepath.Join(layer, "real")
+	diff := filepath.Join(layer, "diff")
+
+	j, err := Begin(workDir, Header{Op: "shadow"})
+	assert.NoError(t, err)
+	j.Record(Mkdir(layer))
+	assert.NoError(t, os.Mkdir(layer, 0755))
+	j.Record(Mkdir(real))
+	assert.NoError(t, os.Mkdir(real, 0755))
+	j.Record(Mkdir(diff))
+	assert.NoError(t, os.Mkdir(diff, 0755))
+	j.Record(Write(cacheId))
+	assert.NoError(t, os.WriteFile(cacheId, []byte("shadow_layer"), 0600))
+	link := filepath.Join(storage, "link")
+	assert.NoError(t, os.Symlink("../layer/diff", link))
+	j.Record(Relink(link))
+	assert.NoError(t, os.Remove(link))
+	assert.NoError(t, os.Symlink("../shadow_layer/diff", link))
+	j.Record(Rmdir(diff))
+	assert.NoError(t, os.Remove(diff))
+	j.Record(Move(real, diff))
+	assert.NoError(t, util.Move(real, diff))
+
+	// simulate a crash, then roll back from the journal on disk
+	opened, err := Open(workDir)
+	assert.NoError(t, err)
+	opened.Rollback()
+
+	data, err := os.ReadFile(cacheId)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+	assert.False(t, util.PathExist(layer))
+	target, err := os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, "../layer/diff", target)
+	assert.False(t, Pending(workDir))
+}
+
+func TestResumeAppends(t *testing.T) {
+	workDir := t.TempDir()
+	j, err := Begin(workDir, Header{Op: "shadow"})
+	assert.NoError(t, err)
+	j.Record(Checkpoint("dumped"))
+
+	resumed, err := Resume(workDir)
+	assert.NoError(t, err)
+	resumed.Record(Checkpoint("mounted"))
+
+	opened, err := Open(workDir)
+	assert.NoError(t, err)
+	assert.True(t, opened.HasCheckpoint("dumped"))
+	assert.True(t, opened.HasCheckpoint("mounted"))
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+
+	assert.NotPanics(t, func() {
+		j.Record(Checkpoint("dumped"))
+		j.Commit()
+	})
+	assert.False(t, j.HasCheckpoint("dumped"))
+}
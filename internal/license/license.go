@@ -0,0 +1,258 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package license
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+	"github.com/negativa-ai/BLAFS/internal/util"
+)
+
+// licensePrefixes are the lower case prefixes of the base names of license and copyright notices.
+var licensePrefixes = []string{"license", "licence", "unlicense", "copying", "copyright", "notice", "legal", "third_party_notices", "thirdpartynotices"}
+
+// licenseDirs hold license files of the directory above them, e.g. foo-1.0.dist-info/licenses/LICENSE.
+var licenseDirs = map[string]bool{"license": true, "licenses": true, "licence": true, "licences": true, "legal": true}
+
+// IsLicenseFile tells if a path is a license or copyright notice, from its base name or its directory.
+func IsLicenseFile(name string) bool {
+	if strings.HasPrefix(name, "usr/share/licenses/") || strings.HasPrefix(name, "usr/share/common-licenses/") {
+		return true
+	}
+	base := strings.ToLower(path.Base(name))
+	for _, prefix := range licensePrefixes {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	// e.g. vendor.js.LICENSE.txt of bundlers
+	return strings.Contains(base, ".license")
+}
+
+// An Entry lists the license files kept for a package, or for a directory outside of packages.
+type Entry struct {
+	Manager  string   `json:"manager,omitempty"`
+	Package  string   `json:"package,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Declared string   `json:"declared,omitempty"` // license declared by the package manager
+	Dir      string   `json:"dir,omitempty"`
+	Files    []string `json:"files"`
+}
+
+// A Manifest lists the licenses of the software shipped in a debloated image.
+type Manifest struct {
+	Image   string  `json:"image"`
+	Entries []Entry `json:"entries"`
+}
+
+// Prune removes the files no longer kept in a stack from the manifest, e.g. removed by drop rules.
+func (m *Manifest) Prune(stack image.LayerStack) {
+	for i := range m.Entries {
+		kept := []string{}
+		for _, f := range m.Entries[i].Files {
+			if stack.IsKept(f) {
+				kept = append(kept, f)
+			}
+		}
+		m.Entries[i].Files = kept
+	}
+}
+
+// WriteJSON writes the manifest as indented JSON.
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// Retain keeps the license files of the packages and directories of a stack that still have kept files.
+// A license file of a package is kept if the package is not fully removed. Other license files belong to
+// the Python distribution whose dist-info holds them, or else to their directory, and are kept if a file
+// of the distribution or of the directory subtree is kept.
+// It returns the manifest of the shipped licenses and the paths newly kept.
+func Retain(stack image.LayerStack) (Manifest, []string) {
+	candidates := licenseFiles(stack)
+	statuses := pkgdb.Check(stack, pkgdb.Read(stack))
+	keptDirs := keptDirs(stack)
+
+	var m Manifest
+	var added []string
+	keep := func(f string) {
+		if stack.Keep(f) {
+			added = append(added, f)
+		}
+	}
+
+	owned := map[string]bool{}
+	for _, s := range statuses {
+		files := map[string]bool{}
+		for _, f := range s.Files {
+			files[f] = true
+		}
+		var kept []string
+		for _, f := range candidates {
+			if !files[f] && !strings.HasPrefix(f, "usr/share/doc/"+s.Name+"/") && !strings.HasPrefix(f, "usr/share/licenses/"+s.Name+"/") {
+				continue
+			}
+			owned[f] = true
+			if s.State != pkgdb.StateRemoved {
+				keep(f)
+				kept = append(kept, f)
+			}
+		}
+		if s.State != pkgdb.StateRemoved {
+			m.Entries = append(m.Entries, Entry{Manager: s.Manager, Package: s.ID(), Version: s.Version, Declared: s.License, Files: nonNil(kept)})
+		}
+	}
+
+	byDir := map[string][]string{}
+	for _, f := range candidates {
+		if owned[f] {
+			continue
+		}
+		dir := ownerDir(f)
+		var ok bool
+		if strings.HasSuffix(dir, ".dist-info") {
+			ok = distInfoKept(stack, dir)
+		} else {
+			ok = keptDirs[dir]
+		}
+		if ok {
+			keep(f)
+			byDir[dir] = append(byDir[dir], f)
+		}
+	}
+	dirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		m.Entries = append(m.Entries, Entry{Dir: dir, Files: byDir[dir]})
+	}
+	return m, added
+}
+
+func nonNil(files []string) []string {
+	if files == nil {
+		return []string{}
+	}
+	return files
+}
+
+// ownerDir returns the directory a license file belongs to, skipping directories that only hold licenses.
+func ownerDir(name string) string {
+	dir := path.Dir(name)
+	for dir != "." && licenseDirs[strings.ToLower(path.Base(dir))] {
+		dir = path.Dir(dir)
+	}
+	return dir
+}
+
+// licenseFiles returns the license files of the merged original layers of a stack, in lexical order.
+func licenseFiles(stack image.LayerStack) []string {
+	var files []string
+	for i, l := range stack {
+		if err := filepath.WalkDir(l.Origin, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(l.Origin, p)
+			if err != nil {
+				return err
+			}
+			if relPath == "." || d.IsDir() || stack.Lookup(relPath) != i {
+				return nil
+			}
+			name := filepath.ToSlash(relPath)
+			if !IsLicenseFile(name) {
+				return nil
+			}
+			if info, err := d.Info(); err != nil || util.IsWhiteout(info) {
+				return err
+			}
+			files = append(files, name)
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// keptDirs returns the directories with kept files other than license files in their subtree, the root included.
+func keptDirs(stack image.LayerStack) map[string]bool {
+	dirs := map[string]bool{}
+	stack.WalkKept(func(l image.StackLayer, relPath string, d fs.DirEntry) {
+		name := filepath.ToSlash(relPath)
+		if d.IsDir() || IsLicenseFile(name) {
+			return
+		}
+		info, err := os.Lstat(filepath.Join(l.Origin, relPath))
+		if err == nil && !image.IsKept(l.Kept, relPath, info) {
+			return
+		}
+		for dir := path.Dir(name); !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			if dir == "." {
+				break
+			}
+		}
+	})
+	return dirs
+}
+
+// distInfoKept tells if a file installed by a Python distribution, as listed in the RECORD of its dist-info, is kept.
+// The metadata files of the dist-info itself are ignored.
+func distInfoKept(stack image.LayerStack, dir string) bool {
+	data, err := stack.ReadFile(path.Join(dir, "RECORD"))
+	if err != nil {
+		return false
+	}
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return false
+	}
+	// paths in RECORD are relative to the site-packages directory holding the dist-info
+	sitePackages := path.Dir(dir)
+	for _, r := range records {
+		if len(r) == 0 || r[0] == "" {
+			continue
+		}
+		f := path.Clean(path.Join(sitePackages, r[0]))
+		if !strings.HasPrefix(f, dir+"/") && stack.IsKept(f) {
+			return true
+		}
+	}
+	return false
+}
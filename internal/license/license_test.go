@@ -0,0 +1,87 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package license
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image/imagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsLicenseFile(t *testing.T) {
+	assert.True(t, IsLicenseFile("usr/share/doc/bash/copyright"))
+	assert.True(t, IsLicenseFile("app/node_modules/left-pad/LICENSE"))
+	assert.True(t, IsLicenseFile("app/COPYING.LESSER"))
+	assert.True(t, IsLicenseFile("app/dist/vendor.js.LICENSE.txt"))
+	assert.True(t, IsLicenseFile("usr/share/licenses/musl/COPYRIGHT"))
+	assert.False(t, IsLicenseFile("usr/share/doc/bash/README"))
+	assert.False(t, IsLicenseFile("app/index.js"))
+}
+
+func TestRetain(t *testing.T) {
+	stack := imagetest.NewStack(t, 1)
+	write := func(name string, kept bool) {
+		imagetest.WriteFile(t, filepath.Join(stack[0].Origin, name), name)
+		if kept {
+			imagetest.WriteFile(t, filepath.Join(stack[0].Kept, name), name)
+		}
+	}
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "var/lib/dpkg/status"),
+		"Package: bash\nStatus: install ok installed\nVersion: 5.2\n\nPackage: gzip\nStatus: install ok installed\nVersion: 1.12\n")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "var/lib/dpkg/info/bash.list"), "/bin/bash\n/usr/share/doc/bash/copyright\n")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "var/lib/dpkg/info/gzip.list"), "/bin/gzip\n/usr/share/doc/gzip/copyright\n")
+	write("bin/bash", true)
+	write("usr/share/doc/bash/copyright", false)
+	write("bin/gzip", false)
+	write("usr/share/doc/gzip/copyright", false)
+	// directories outside of packages
+	write("app/node_modules/used/index.js", true)
+	write("app/node_modules/used/LICENSE", false)
+	write("app/node_modules/unused/index.js", false)
+	write("app/node_modules/unused/LICENSE", false)
+	// python distributions
+	write("app/site-packages/used/__init__.py", true)
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "app/site-packages/used-1.0.dist-info/RECORD"), "used/__init__.py,sha256=x,1\nused-1.0.dist-info/RECORD,,\n")
+	write("app/site-packages/used-1.0.dist-info/licenses/LICENSE.txt", false)
+
+	m, added := Retain(stack)
+	assert.Equal(t, []string{
+		"usr/share/doc/bash/copyright",
+		"app/node_modules/used/LICENSE",
+		"app/site-packages/used-1.0.dist-info/licenses/LICENSE.txt",
+	}, added)
+	assert.FileExists(t, filepath.Join(stack[0].Kept, "usr/share/doc/bash/copyright"))
+	assert.NoFileExists(t, filepath.Join(stack[0].Kept, "usr/share/doc/gzip/copyright"))
+	assert.NoFileExists(t, filepath.Join(stack[0].Kept, "app/node_modules/unused/LICENSE"))
+	assert.Equal(t, []Entry{
+		{Manager: "dpkg", Package: "bash", Version: "5.2", Files: []string{"usr/share/doc/bash/copyright"}},
+		{Dir: "app/node_modules/used", Files: []string{"app/node_modules/used/LICENSE"}},
+		{Dir: "app/site-packages/used-1.0.dist-info", Files: []string{"app/site-packages/used-1.0.dist-info/licenses/LICENSE.txt"}},
+	}, m.Entries)
+
+	assert.NoError(t, os.Remove(filepath.Join(stack[0].Kept, "app/node_modules/used/LICENSE")))
+	m.Prune(stack)
+	assert.Equal(t, []string{}, m.Entries[1].Files)
+}
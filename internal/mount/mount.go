@@ -25,6 +25,8 @@ import (
 	"bufio"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -73,6 +75,36 @@ func (m Mount) Unmount() {
 	}
 }
 
+// PID returns the id of the process serving the mount, 0 if there is none.
+// debloated_fs daemonizes itself, its process is found by its command line.
+func (m Mount) PID() int {
+	procs, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return 0
+	}
+	for _, proc := range procs {
+		data, err := os.ReadFile(proc)
+		if err != nil {
+			continue
+		}
+		cmdline := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		if len(cmdline) < 2 || filepath.Base(cmdline[0]) != filepath.Base(m.exePath) || cmdline[len(cmdline)-1] != m.mountPoint {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(proc)))
+		if err != nil {
+			continue
+		}
+		return pid
+	}
+	return 0
+}
+
+// GetMountPoint returns the path of the mount point.
+func (m Mount) GetMountPoint() string {
+	return m.mountPoint
+}
+
 func NewMount(exePath string, mountPoint string, kvArgs map[string]string, flagArgs []string) Mount {
 	return Mount{
 		exePath:    exePath,
@@ -22,6 +22,7 @@
 package mount
 
 import (
+	"os/exec"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -33,3 +34,16 @@ func TestIsMountedWithType(t *testing.T) {
 
 	assert.False(t, mounted)
 }
+
+func TestMountPID(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	cmd := exec.Command(sleep, "30")
+	assert.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	assert.Equal(t, cmd.Process.Pid, NewMount(sleep, "30", nil, nil).PID())
+	assert.Equal(t, 0, NewMount(sleep, "31", nil, nil).PID())
+}
@@ -0,0 +1,129 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package pkgdb
+
+import (
+	"path"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+)
+
+const apkInstalled = "lib/apk/db/installed"
+
+// apkPackage parses a stanza of the apk database.
+// Files are listed as F: lines for directories, each followed by R: lines for the files in it.
+func apkPackage(stanza string) Package {
+	p := Package{Manager: Apk, record: apkInstalled}
+	dir := ""
+	for _, line := range strings.Split(stanza, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "P":
+			p.Name = value
+		case "V":
+			p.Version = value
+		case "A":
+			p.Arch = value
+		case "L":
+			p.License = value
+		case "o":
+			p.Source = value
+		case "F":
+			dir = value
+			p.Files = append(p.Files, relPath(dir))
+		case "R":
+			p.Files = append(p.Files, relPath(path.Join(dir, value)))
+		}
+	}
+	return p
+}
+
+// readApk reads the apk database of installed packages.
+func readApk(stack image.LayerStack) ([]Package, error) {
+	if !exists(stack, apkInstalled) {
+		return nil, nil
+	}
+	data, err := stack.ReadFile(apkInstalled)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, stanza := range stanzas(string(data)) {
+		if p := apkPackage(stanza); p.Name != "" {
+			pkgs = append(pkgs, p)
+		}
+	}
+	return pkgs, nil
+}
+
+// rewriteApkStanza removes the R: lines of removed files, with the a: and Z: lines describing them.
+func rewriteApkStanza(stanza string, removed map[string]bool) string {
+	var kept []string
+	dir := ""
+	skip := false
+	for _, line := range strings.Split(stanza, "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		switch key {
+		case "F":
+			dir = value
+			skip = false
+		case "R":
+			skip = removed[relPath(path.Join(dir, value))]
+		case "a", "Z":
+			// attributes and checksum of the preceding file or directory
+		default:
+			skip = false
+		}
+		if !skip {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// rewriteApk removes the removed packages from the apk database and the removed files of partly removed packages.
+func rewriteApk(stack image.LayerStack, statuses []Status) {
+	byName := map[string]Status{}
+	for _, s := range statuses {
+		byName[s.Name] = s
+	}
+	data, err := stack.ReadFile(apkInstalled)
+	if err != nil {
+		panic(err)
+	}
+	var kept []string
+	for _, stanza := range stanzas(string(data)) {
+		s, ok := byName[apkPackage(stanza).Name]
+		switch {
+		case ok && s.State == StateRemoved:
+			continue
+		case ok && s.State == StatePartlyRemoved:
+			stanza = rewriteApkStanza(stanza, toSet(s.Removed))
+		}
+		kept = append(kept, stanza)
+	}
+	stack.WriteKept(apkInstalled, []byte(strings.Join(kept, "\n\n")+"\n\n"), 0644)
+}
@@ -0,0 +1,280 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package pkgdb
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+)
+
+const (
+	dpkgStatus  = "var/lib/dpkg/status"
+	dpkgStatusD = "var/lib/dpkg/status.d" // used by distroless images instead of status
+	dpkgInfo    = "var/lib/dpkg/info"
+	md5sumsExt  = ".md5sums"
+	dpkgListExt = ".list"
+)
+
+// fields parses the fields of a stanza, continuation lines are skipped.
+func fields(stanza string) map[string]string {
+	f := map[string]string{}
+	for _, line := range strings.Split(stanza, "\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if ok {
+			f[key] = strings.TrimSpace(value)
+		}
+	}
+	return f
+}
+
+// dpkgPackage creates a package from a stanza of the dpkg status, it returns false if the package is not installed.
+func dpkgPackage(stanza string, record string) (Package, bool) {
+	f := fields(stanza)
+	if f["Package"] == "" {
+		return Package{}, false
+	}
+	if status, ok := f["Status"]; ok && !strings.HasSuffix(status, " installed") {
+		return Package{}, false
+	}
+	p := Package{Manager: Dpkg, Name: f["Package"], Version: f["Version"], Arch: f["Architecture"], record: record}
+	// Source: name (version)
+	if source, _, _ := strings.Cut(f["Source"], " "); source != "" {
+		p.Source = source
+	}
+	return p, true
+}
+
+// dpkgInfoFile returns the path of an info file of a package, e.g. its .list file, and false if missing.
+func dpkgInfoFile(stack image.LayerStack, p *Package, ext string) (string, bool) {
+	for _, name := range []string{p.Name + ":" + p.Arch, p.Name} {
+		infoFile := path.Join(dpkgInfo, name+ext)
+		if exists(stack, infoFile) {
+			return infoFile, true
+		}
+	}
+	return "", false
+}
+
+// dpkgInfoFiles returns the paths of the info files of a package, named {name}[:{arch}].{ext}.
+func dpkgInfoFiles(infoFiles []string, p *Package) []string {
+	var files []string
+	for _, name := range infoFiles {
+		if i := strings.LastIndex(name, "."); i > 0 && (name[:i] == p.Name || name[:i] == p.Name+":"+p.Arch) {
+			files = append(files, path.Join(dpkgInfo, name))
+		}
+	}
+	return files
+}
+
+// readDpkgFileList reads the absolute paths listed in a .list file.
+func readDpkgFileList(stack image.LayerStack, listFile string) ([]string, error) {
+	data, err := stack.ReadFile(listFile)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != "/." {
+			files = append(files, relPath(line))
+		}
+	}
+	return files, nil
+}
+
+// readMd5sums reads the paths listed in a .md5sums file, relative to the image root.
+func readMd5sums(stack image.LayerStack, md5sumsFile string) ([]string, error) {
+	data, err := stack.ReadFile(md5sumsFile)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if _, file, ok := strings.Cut(strings.TrimSpace(line), "  "); ok {
+			files = append(files, relPath(file))
+		}
+	}
+	return files, nil
+}
+
+// readDpkg reads the dpkg status and the file lists of installed packages.
+func readDpkg(stack image.LayerStack) ([]Package, error) {
+	var pkgs []Package
+	if exists(stack, dpkgStatus) {
+		data, err := stack.ReadFile(dpkgStatus)
+		if err != nil {
+			return nil, err
+		}
+		for _, stanza := range stanzas(string(data)) {
+			p, ok := dpkgPackage(stanza, dpkgStatus)
+			if !ok {
+				continue
+			}
+			if listFile, ok := dpkgInfoFile(stack, &p, dpkgListExt); ok {
+				if p.Files, err = readDpkgFileList(stack, listFile); err != nil {
+					return nil, err
+				}
+			}
+			pkgs = append(pkgs, p)
+		}
+	}
+
+	for _, name := range listDir(stack, dpkgStatusD) {
+		if strings.HasSuffix(name, md5sumsExt) {
+			continue
+		}
+		record := path.Join(dpkgStatusD, name)
+		data, err := stack.ReadFile(record)
+		if err != nil {
+			return nil, err
+		}
+		for _, stanza := range stanzas(string(data)) {
+			p, ok := dpkgPackage(stanza, record)
+			if !ok {
+				continue
+			}
+			if md5sums := record + md5sumsExt; exists(stack, md5sums) {
+				if p.Files, err = readMd5sums(stack, md5sums); err != nil {
+					return nil, err
+				}
+			}
+			pkgs = append(pkgs, p)
+		}
+	}
+	return pkgs, nil
+}
+
+// listDir returns the names of the entries of a directory in the merged view of a stack, in lexical order.
+func listDir(stack image.LayerStack, dir string) []string {
+	realDir, ok := stack.Realpath(dir)
+	if !ok {
+		return nil
+	}
+	set := map[string]bool{}
+	for _, l := range stack {
+		entries, err := os.ReadDir(filepath.Join(l.Origin, realDir))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if stack.Lookup(path.Join(realDir, e.Name())) != -1 {
+				set[e.Name()] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filterLines keeps the lines of a file list whose path is not removed.
+func filterLines(data []byte, removed map[string]bool, pathOf func(line string) string) []byte {
+	var kept []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if !removed[pathOf(line)] {
+			kept = append(kept, line)
+		}
+	}
+	return []byte(strings.Join(kept, "\n") + "\n")
+}
+
+func md5sumsPath(line string) string {
+	_, file, _ := strings.Cut(strings.TrimSpace(line), "  ")
+	return relPath(file)
+}
+
+// rewriteFileList rewrites a .list or .md5sums file without the removed files of a package.
+func rewriteFileList(stack image.LayerStack, file string, removed map[string]bool, pathOf func(line string) string) {
+	data, err := stack.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	stack.WriteKept(file, filterLines(data, removed, pathOf), 0644)
+}
+
+// rewriteDpkg removes the removed packages from the dpkg status and their info files,
+// rewrites the file lists of partly removed packages and keeps those of kept packages.
+func rewriteDpkg(stack image.LayerStack, statuses []Status) {
+	removedPkgs := map[string]bool{}
+	for _, s := range statuses {
+		if s.State == StateRemoved {
+			removedPkgs[s.ID()] = true
+		}
+	}
+
+	if exists(stack, dpkgStatus) {
+		data, err := stack.ReadFile(dpkgStatus)
+		if err != nil {
+			panic(err)
+		}
+		var kept []string
+		for _, stanza := range stanzas(string(data)) {
+			if p, ok := dpkgPackage(stanza, dpkgStatus); ok && removedPkgs[p.ID()] {
+				continue
+			}
+			kept = append(kept, stanza)
+		}
+		stack.WriteKept(dpkgStatus, []byte(strings.Join(kept, "\n\n")+"\n"), 0644)
+	}
+
+	infoFiles := listDir(stack, dpkgInfo)
+	for _, s := range statuses {
+		removed := toSet(s.Removed)
+		switch {
+		case s.State == StateRemoved && s.record == dpkgStatus:
+			for _, infoFile := range dpkgInfoFiles(infoFiles, &s.Package) {
+				stack.RemoveKept(infoFile)
+			}
+		case s.State == StateRemoved:
+			stack.RemoveKept(s.record)
+			stack.RemoveKept(s.record + md5sumsExt)
+		case s.State == StatePartlyRemoved && s.record == dpkgStatus:
+			if listFile, ok := dpkgInfoFile(stack, &s.Package, dpkgListExt); ok {
+				rewriteFileList(stack, listFile, removed, relPath)
+			}
+			if md5sums, ok := dpkgInfoFile(stack, &s.Package, md5sumsExt); ok {
+				rewriteFileList(stack, md5sums, removed, md5sumsPath)
+			}
+		case s.State == StatePartlyRemoved:
+			if md5sums := s.record + md5sumsExt; exists(stack, md5sums) {
+				rewriteFileList(stack, md5sums, removed, md5sumsPath)
+			}
+		case s.record == dpkgStatus:
+			for _, infoFile := range dpkgInfoFiles(infoFiles, &s.Package) {
+				stack.Keep(infoFile)
+			}
+		default:
+			stack.Keep(s.record)
+			stack.Keep(s.record + md5sumsExt)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package pkgdb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	log "github.com/sirupsen/logrus"
+)
+
+// Package managers whose databases are read.
+const (
+	Dpkg = "dpkg"
+	Apk  = "apk"
+	Rpm  = "rpm"
+)
+
+// States of a package in a debloated image.
+const (
+	StateKept          = "kept"
+	StatePartlyRemoved = "partly-removed"
+	StateRemoved       = "removed"
+)
+
+// A Package is a package installed in an image, as recorded in the database of its package manager.
+type Package struct {
+	Manager string   `json:"manager"`
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Arch    string   `json:"arch,omitempty"`
+	Source  string   `json:"source,omitempty"`  // source package or origin
+	License string   `json:"license,omitempty"` // not recorded by dpkg
+	Files   []string `json:"files"`             // files and directories, relative to the image root
+	record  string   // database file holding the record of the package
+}
+
+// A Status tells how much of a package is kept in a debloated image.
+type Status struct {
+	Package
+	State   string   `json:"state"`
+	Kept    []string `json:"kept"`    // kept files, directories excluded
+	Removed []string `json:"removed"` // removed files, directories excluded
+}
+
+// ID returns the name of a package, qualified by its architecture if any.
+func (p *Package) ID() string {
+	if p.Arch == "" {
+		return p.Name
+	}
+	return p.Name + ":" + p.Arch
+}
+
+// Read reads the packages of all package databases found in the original layers of a stack.
+// Databases that cannot be read are skipped with a warning.
+func Read(stack image.LayerStack) []Package {
+	var pkgs []Package
+	readers := []struct {
+		manager string
+		read    func(image.LayerStack) ([]Package, error)
+	}{{Dpkg, readDpkg}, {Apk, readApk}, {Rpm, readRpm}}
+	for _, r := range readers {
+		found, err := r.read(stack)
+		if err != nil {
+			log.Warn("Cannot read ", r.manager, " database: ", err)
+			continue
+		}
+		if len(found) > 0 {
+			log.Debug("Found ", len(found), " ", r.manager, " packages")
+		}
+		pkgs = append(pkgs, found...)
+	}
+	return pkgs
+}
+
+// Check checks which files of the packages are kept in the kept dirs of a stack.
+// Directories and files missing in the original image are ignored.
+func Check(stack image.LayerStack, pkgs []Package) []Status {
+	var statuses []Status
+	for _, p := range pkgs {
+		s := Status{Package: p}
+		for _, f := range p.Files {
+			originPath, ok := resolve(stack, f)
+			if !ok {
+				continue
+			}
+			if info, err := os.Stat(originPath); err == nil && info.IsDir() {
+				continue
+			}
+			if stack.IsKept(f) {
+				s.Kept = append(s.Kept, f)
+			} else {
+				s.Removed = append(s.Removed, f)
+			}
+		}
+		switch {
+		case len(s.Removed) == 0:
+			s.State = StateKept
+		case len(s.Kept) == 0:
+			s.State = StateRemoved
+		default:
+			s.State = StatePartlyRemoved
+		}
+		statuses = append(statuses, s)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].ID() < statuses[j].ID()
+	})
+	return statuses
+}
+
+// Count returns the number of packages in each state.
+func Count(statuses []Status) map[string]int {
+	count := map[string]int{StateKept: 0, StatePartlyRemoved: 0, StateRemoved: 0}
+	for _, s := range statuses {
+		count[s.State]++
+	}
+	return count
+}
+
+// Rewritable returns an error if a stack has package databases that Rewrite cannot rewrite, i.e. rpm databases.
+func Rewritable(stack image.LayerStack) error {
+	for _, dbs := range [][]string{rpmSqliteDbs, rpmLegacyDbs} {
+		for _, db := range dbs {
+			if exists(stack, db) {
+				return fmt.Errorf("%s: rewriting rpm databases is not supported", db)
+			}
+		}
+	}
+	return nil
+}
+
+// Rewrite rewrites the package databases in the kept dirs of a stack, so that they only list kept files.
+// Removed packages are dropped from the databases. It panics on rpm packages, see Rewritable.
+func Rewrite(stack image.LayerStack, statuses []Status) {
+	byManager := map[string][]Status{}
+	for _, s := range statuses {
+		byManager[s.Manager] = append(byManager[s.Manager], s)
+	}
+	if len(byManager[Rpm]) > 0 {
+		panic("rewriting rpm databases is not supported")
+	}
+	if len(byManager[Dpkg]) > 0 {
+		rewriteDpkg(stack, byManager[Dpkg])
+	}
+	if len(byManager[Apk]) > 0 {
+		rewriteApk(stack, byManager[Apk])
+	}
+}
+
+// OSRelease returns the ID and VERSION_ID fields of the os-release of an image, or empty strings.
+func OSRelease(stack image.LayerStack) (string, string) {
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		data, err := stack.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		f := map[string]string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+				f[key] = strings.Trim(value, `"'`)
+			}
+		}
+		return f["ID"], f["VERSION_ID"]
+	}
+	return "", ""
+}
+
+// resolve returns the path of a file in the original layers, with symlinks resolved.
+func resolve(stack image.LayerStack, name string) (string, bool) {
+	realPath, ok := stack.Realpath(name)
+	if !ok {
+		return "", false
+	}
+	return stack.OriginPath(realPath)
+}
+
+// exists returns true if a path exists in the merged view of a stack.
+func exists(stack image.LayerStack, name string) bool {
+	_, ok := resolve(stack, name)
+	return ok
+}
+
+// stanzas splits a database in RFC 822 style into paragraphs separated by blank lines.
+func stanzas(data string) []string {
+	var paragraphs []string
+	for _, p := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n\n") {
+		if strings.TrimSpace(p) != "" {
+			paragraphs = append(paragraphs, strings.Trim(p, "\n"))
+		}
+	}
+	return paragraphs
+}
+
+// relPath converts an absolute path of a package database to a path relative to the image root.
+func relPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func toSet(files []string) map[string]bool {
+	set := map[string]bool{}
+	for _, f := range files {
+		set[f] = true
+	}
+	return set
+}
@@ -0,0 +1,270 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package pkgdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/image/imagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeOrigin writes a file to the original layer, and to the kept dir if kept.
+func writeOrigin(t *testing.T, stack image.LayerStack, name string, content string, kept bool) {
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, name), content)
+	if kept {
+		imagetest.WriteFile(t, filepath.Join(stack[0].Kept, name), content)
+	}
+}
+
+func readKept(t *testing.T, stack image.LayerStack, name string) string {
+	data, err := os.ReadFile(filepath.Join(stack[0].Kept, name))
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestDpkg(t *testing.T) {
+	stack := imagetest.NewStack(t, 1)
+	writeOrigin(t, stack, dpkgStatus, `Package: libfoo
+Status: install ok installed
+Architecture: amd64
+Version: 1.0-1
+Description: foo
+ library
+
+Package: bar
+Status: install ok installed
+Architecture: amd64
+Source: bar-src (2.0)
+Version: 2.0-1
+
+Package: baz
+Status: install ok installed
+Architecture: all
+Version: 3.0
+
+Package: old
+Status: deinstall ok config-files
+Version: 0.1
+`, false)
+	writeOrigin(t, stack, "var/lib/dpkg/info/libfoo:amd64.list", "/.\n/usr\n/usr/lib\n/usr/lib/libfoo.so\n", false)
+	writeOrigin(t, stack, "var/lib/dpkg/info/bar.list", "/.\n/usr/bin/bar\n/usr/share/doc/bar/README\n", false)
+	writeOrigin(t, stack, "var/lib/dpkg/info/bar.md5sums", "aaa  usr/bin/bar\nbbb  usr/share/doc/bar/README\n", false)
+	writeOrigin(t, stack, "var/lib/dpkg/info/baz.list", "/usr/bin/baz\n", false)
+	writeOrigin(t, stack, "var/lib/dpkg/info/baz.postinst", "#!/bin/sh\n", true)
+	writeOrigin(t, stack, "usr/lib/libfoo.so", "foo", true)
+	writeOrigin(t, stack, "usr/bin/bar", "bar", true)
+	writeOrigin(t, stack, "usr/share/doc/bar/README", "readme", false)
+	writeOrigin(t, stack, "usr/bin/baz", "baz", false)
+
+	pkgs := Read(stack)
+	assert.Len(t, pkgs, 3)
+	assert.Equal(t, "libfoo:amd64", pkgs[0].ID())
+	assert.Equal(t, []string{"usr", "usr/lib", "usr/lib/libfoo.so"}, pkgs[0].Files)
+	assert.Equal(t, "bar-src", pkgs[1].Source)
+
+	statuses := Check(stack, pkgs)
+	assert.Equal(t, "bar:amd64", statuses[0].ID())
+	assert.Equal(t, StatePartlyRemoved, statuses[0].State)
+	assert.Equal(t, []string{"usr/bin/bar"}, statuses[0].Kept)
+	assert.Equal(t, []string{"usr/share/doc/bar/README"}, statuses[0].Removed)
+	assert.Equal(t, StateRemoved, statuses[1].State)
+	assert.Equal(t, StateKept, statuses[2].State)
+	assert.Equal(t, []string{"usr/lib/libfoo.so"}, statuses[2].Kept)
+	assert.Equal(t, map[string]int{StateKept: 1, StatePartlyRemoved: 1, StateRemoved: 1}, Count(statuses))
+
+	Rewrite(stack, statuses)
+	status := readKept(t, stack, dpkgStatus)
+	assert.Contains(t, status, "Package: libfoo\n")
+	assert.Contains(t, status, "Package: bar\n")
+	assert.Contains(t, status, "Package: old\n")
+	assert.NotContains(t, status, "Package: baz\n")
+	assert.Equal(t, "/.\n/usr/bin/bar\n", readKept(t, stack, "var/lib/dpkg/info/bar.list"))
+	assert.Equal(t, "aaa  usr/bin/bar\n", readKept(t, stack, "var/lib/dpkg/info/bar.md5sums"))
+	assert.Equal(t, "/.\n/usr\n/usr/lib\n/usr/lib/libfoo.so\n", readKept(t, stack, "var/lib/dpkg/info/libfoo:amd64.list"))
+	assert.NoFileExists(t, filepath.Join(stack[0].Kept, "var/lib/dpkg/info/baz.postinst"))
+}
+
+func TestDpkgStatusD(t *testing.T) {
+	stack := imagetest.NewStack(t, 1)
+	writeOrigin(t, stack, "var/lib/dpkg/status.d/base", "Package: base\nVersion: 1\nArchitecture: amd64\n", false)
+	writeOrigin(t, stack, "var/lib/dpkg/status.d/base.md5sums", "aaa  etc/base\nbbb  usr/share/base\n", false)
+	writeOrigin(t, stack, "var/lib/dpkg/status.d/tzdata", "Package: tzdata\nVersion: 2024a\nArchitecture: all\n", true)
+	writeOrigin(t, stack, "var/lib/dpkg/status.d/tzdata.md5sums", "ccc  usr/share/zoneinfo/UTC\n", true)
+	writeOrigin(t, stack, "etc/base", "base", true)
+	writeOrigin(t, stack, "usr/share/base", "base", false)
+	writeOrigin(t, stack, "usr/share/zoneinfo/UTC", "utc", false)
+
+	statuses := Check(stack, Read(stack))
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, StatePartlyRemoved, statuses[0].State)
+	assert.Equal(t, StateRemoved, statuses[1].State)
+
+	Rewrite(stack, statuses)
+	assert.Equal(t, "aaa  etc/base\n", readKept(t, stack, "var/lib/dpkg/status.d/base.md5sums"))
+	assert.NoFileExists(t, filepath.Join(stack[0].Kept, "var/lib/dpkg/status.d/tzdata"))
+	assert.NoFileExists(t, filepath.Join(stack[0].Kept, "var/lib/dpkg/status.d/tzdata.md5sums"))
+}
+
+func TestApk(t *testing.T) {
+	stack := imagetest.NewStack(t, 1)
+	writeOrigin(t, stack, apkInstalled, `C:Q1abc=
+P:musl
+V:1.2.4-r2
+A:x86_64
+L:MIT
+o:musl
+F:lib
+R:ld-musl-x86_64.so.1
+a:0:0:755
+Z:Q1def=
+R:libc.musl-x86_64.so.1
+a:0:0:777
+Z:Q1ghi=
+
+P:zlib
+V:1.3-r0
+A:x86_64
+L:Zlib
+F:lib
+R:libz.so.1
+Z:Q1jkl=
+
+`, false)
+	writeOrigin(t, stack, "lib/ld-musl-x86_64.so.1", "musl", true)
+	writeOrigin(t, stack, "lib/libc.musl-x86_64.so.1", "musl", false)
+	writeOrigin(t, stack, "lib/libz.so.1", "zlib", false)
+
+	pkgs := Read(stack)
+	assert.Len(t, pkgs, 2)
+	assert.Equal(t, "MIT", pkgs[0].License)
+	assert.Equal(t, []string{"lib", "lib/ld-musl-x86_64.so.1", "lib/libc.musl-x86_64.so.1"}, pkgs[0].Files)
+
+	statuses := Check(stack, pkgs)
+	assert.Equal(t, StatePartlyRemoved, statuses[0].State)
+	assert.Equal(t, StateRemoved, statuses[1].State)
+
+	Rewrite(stack, statuses)
+	assert.Equal(t, `C:Q1abc=
+P:musl
+V:1.2.4-r2
+A:x86_64
+L:MIT
+o:musl
+F:lib
+R:ld-musl-x86_64.so.1
+a:0:0:755
+Z:Q1def=
+
+`, readKept(t, stack, apkInstalled))
+}
+
+// rpmTestHeader builds an rpm header blob with string, string array and int32 tags.
+func rpmTestHeader(strs map[int]string, arrays map[int][]string, ints map[int][]int32) []byte {
+	var index, data bytes.Buffer
+	entry := func(tag int, typ int, count int) {
+		binary.Write(&index, binary.BigEndian, []uint32{uint32(tag), uint32(typ), uint32(data.Len()), uint32(count)})
+	}
+	for tag, s := range strs {
+		entry(tag, rpmTypeString, 1)
+		data.WriteString(s + "\x00")
+	}
+	for tag, values := range arrays {
+		entry(tag, rpmTypeStringArray, len(values))
+		for _, s := range values {
+			data.WriteString(s + "\x00")
+		}
+	}
+	for tag, values := range ints {
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+		entry(tag, rpmTypeInt32, len(values))
+		binary.Write(&data, binary.BigEndian, values)
+	}
+	var blob bytes.Buffer
+	binary.Write(&blob, binary.BigEndian, []uint32{uint32(index.Len() / 16), uint32(data.Len())})
+	blob.Write(index.Bytes())
+	blob.Write(data.Bytes())
+	return blob.Bytes()
+}
+
+func TestRpmHeader(t *testing.T) {
+	blob := rpmTestHeader(
+		map[int]string{rpmTagName: "bash", rpmTagVersion: "5.2", rpmTagRelease: "1.el9", rpmTagArch: "x86_64",
+			rpmTagSourceRpm: "bash-5.2-1.el9.src.rpm", rpmTagLicense: "GPL-3.0-or-later"},
+		map[int][]string{rpmTagDirNames: {"/usr/bin/", "/etc/"}, rpmTagBaseNames: {"bash", "bashrc"}},
+		map[int][]int32{rpmTagDirIndexes: {0, 1}, rpmTagEpoch: {1}})
+	h, err := parseRpmHeader(blob)
+	assert.NoError(t, err)
+	p := rpmPackage(h, "var/lib/rpm/rpmdb.sqlite")
+	assert.Equal(t, "bash:x86_64", p.ID())
+	assert.Equal(t, "1:5.2-1.el9", p.Version)
+	assert.Equal(t, "bash", p.Source)
+	assert.Equal(t, "GPL-3.0-or-later", p.License)
+	assert.Equal(t, []string{"usr/bin/bash", "etc/bashrc"}, p.Files)
+
+	_, err = parseRpmHeader(blob[:20])
+	assert.Error(t, err)
+}
+
+func TestRpmSqlite(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	stack := imagetest.NewStack(t, 1)
+	db := filepath.Join(stack[0].Origin, rpmSqliteDbs[0])
+	assert.NoError(t, os.MkdirAll(filepath.Dir(db), 0755))
+	blob := rpmTestHeader(map[int]string{rpmTagName: "bash", rpmTagVersion: "5.2", rpmTagRelease: "1", rpmTagArch: "x86_64"},
+		map[int][]string{rpmTagDirNames: {"/usr/bin/"}, rpmTagBaseNames: {"bash"}}, map[int][]int32{rpmTagDirIndexes: {0}})
+	sql := fmt.Sprintf("CREATE TABLE Packages (hnum INTEGER PRIMARY KEY, blob BLOB NOT NULL); INSERT INTO Packages (blob) VALUES (X'%s');", hex.EncodeToString(blob))
+	assert.NoError(t, exec.Command("sqlite3", db, sql).Run())
+	writeOrigin(t, stack, "usr/bin/bash", "bash", true)
+
+	statuses := Check(stack, Read(stack))
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, Rpm, statuses[0].Manager)
+	assert.Equal(t, StateKept, statuses[0].State)
+}
+
+func TestRewritableRpm(t *testing.T) {
+	stack := imagetest.NewStack(t, 2)
+	writeOrigin(t, stack, "var/lib/dpkg/status", "", false)
+	assert.NoError(t, Rewritable(stack))
+
+	stack = imagetest.NewStack(t, 2)
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, rpmSqliteDbs[0]), "")
+	assert.ErrorContains(t, Rewritable(stack), rpmSqliteDbs[0])
+	stack = imagetest.NewStack(t, 1)
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, rpmLegacyDbs[0]), "")
+	assert.Error(t, Rewritable(stack))
+
+	assert.Panics(t, func() { Rewrite(stack, []Status{{Package: Package{Name: "bash", Manager: Rpm}}}) })
+}
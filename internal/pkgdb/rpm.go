@@ -0,0 +1,185 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package pkgdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+)
+
+// rpm databases in sqlite format, older Berkeley DB and NDB databases are not supported.
+var rpmSqliteDbs = []string{"var/lib/rpm/rpmdb.sqlite", "usr/lib/sysimage/rpm/rpmdb.sqlite"}
+var rpmLegacyDbs = []string{"var/lib/rpm/Packages", "var/lib/rpm/Packages.db", "usr/lib/sysimage/rpm/Packages.db"}
+
+// rpm header tags
+const (
+	rpmTagName       = 1000
+	rpmTagVersion    = 1001
+	rpmTagRelease    = 1002
+	rpmTagEpoch      = 1003
+	rpmTagLicense    = 1014
+	rpmTagArch       = 1022
+	rpmTagSourceRpm  = 1044
+	rpmTagDirIndexes = 1116
+	rpmTagBaseNames  = 1117
+	rpmTagDirNames   = 1118
+)
+
+// rpm header types
+const (
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18nString  = 9
+)
+
+// rpmHeader is a parsed rpm header, tags are mapped to strings or int32s.
+type rpmHeader struct {
+	strings map[int][]string
+	ints    map[int][]int32
+}
+
+func (h *rpmHeader) str(tag int) string {
+	if values := h.strings[tag]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// parseRpmHeader parses a header blob of the rpm database: the number of index entries and the size of the data,
+// followed by the index entries and the data, all in big endian.
+func parseRpmHeader(blob []byte) (rpmHeader, error) {
+	h := rpmHeader{strings: map[int][]string{}, ints: map[int][]int32{}}
+	if len(blob) < 8 {
+		return h, fmt.Errorf("rpm header too short")
+	}
+	il := int(binary.BigEndian.Uint32(blob[0:4]))
+	dl := int(binary.BigEndian.Uint32(blob[4:8]))
+	dataStart := 8 + il*16
+	if il < 0 || dl < 0 || dataStart+dl > len(blob) {
+		return h, fmt.Errorf("invalid rpm header: %d entries, %d bytes of data", il, dl)
+	}
+	data := blob[dataStart : dataStart+dl]
+	for i := 0; i < il; i++ {
+		entry := blob[8+i*16 : 8+(i+1)*16]
+		tag := int(binary.BigEndian.Uint32(entry[0:4]))
+		typ := binary.BigEndian.Uint32(entry[4:8])
+		offset := int(binary.BigEndian.Uint32(entry[8:12]))
+		count := int(binary.BigEndian.Uint32(entry[12:16]))
+		if offset < 0 || offset > len(data) {
+			return h, fmt.Errorf("invalid offset of rpm tag %d", tag)
+		}
+		switch typ {
+		case rpmTypeInt32:
+			if offset+4*count > len(data) {
+				return h, fmt.Errorf("invalid count of rpm tag %d", tag)
+			}
+			for j := 0; j < count; j++ {
+				h.ints[tag] = append(h.ints[tag], int32(binary.BigEndian.Uint32(data[offset+4*j:])))
+			}
+		case rpmTypeString, rpmTypeStringArray, rpmTypeI18nString:
+			if typ == rpmTypeString {
+				count = 1
+			}
+			rest := data[offset:]
+			for j := 0; j < count; j++ {
+				end := bytes.IndexByte(rest, 0)
+				if end == -1 {
+					return h, fmt.Errorf("unterminated string of rpm tag %d", tag)
+				}
+				h.strings[tag] = append(h.strings[tag], string(rest[:end]))
+				rest = rest[end+1:]
+			}
+		}
+	}
+	return h, nil
+}
+
+// rpmPackage creates a package from an rpm header.
+func rpmPackage(h rpmHeader, record string) Package {
+	p := Package{Manager: Rpm, Name: h.str(rpmTagName), Arch: h.str(rpmTagArch), License: h.str(rpmTagLicense), record: record}
+	p.Version = h.str(rpmTagVersion) + "-" + h.str(rpmTagRelease)
+	if epoch := h.ints[rpmTagEpoch]; len(epoch) > 0 {
+		p.Version = fmt.Sprintf("%d:%s", epoch[0], p.Version)
+	}
+	// {name}-{version}-{release}.src.rpm
+	if source := strings.TrimSuffix(h.str(rpmTagSourceRpm), ".src.rpm"); source != "" {
+		if i := strings.LastIndex(source, "-"); i > 0 {
+			source = source[:i]
+		}
+		if i := strings.LastIndex(source, "-"); i > 0 {
+			source = source[:i]
+		}
+		p.Source = source
+	}
+	dirNames := h.strings[rpmTagDirNames]
+	for i, base := range h.strings[rpmTagBaseNames] {
+		if i < len(h.ints[rpmTagDirIndexes]) && int(h.ints[rpmTagDirIndexes][i]) < len(dirNames) {
+			p.Files = append(p.Files, relPath(path.Join(dirNames[h.ints[rpmTagDirIndexes][i]], base)))
+		}
+	}
+	return p
+}
+
+// readRpm reads the rpm database in sqlite format with the sqlite3 command,
+// the database in the original layer is opened as immutable so that it is never modified.
+func readRpm(stack image.LayerStack) ([]Package, error) {
+	for _, db := range rpmSqliteDbs {
+		originPath, ok := resolve(stack, db)
+		if !ok {
+			continue
+		}
+		out, err := exec.Command("sqlite3", "-readonly", "file:"+originPath+"?immutable=1", "SELECT hex(blob) FROM Packages").Output()
+		if err != nil {
+			return nil, fmt.Errorf("sqlite3 failed to read %s: %w", db, err)
+		}
+		var pkgs []Package
+		for _, line := range strings.Fields(string(out)) {
+			blob, err := hex.DecodeString(line)
+			if err != nil {
+				return nil, err
+			}
+			h, err := parseRpmHeader(blob)
+			if err != nil {
+				return nil, err
+			}
+			// gpg-pubkey pseudo packages have no files
+			if p := rpmPackage(h, db); p.Name != "" && p.Name != "gpg-pubkey" {
+				pkgs = append(pkgs, p)
+			}
+		}
+		return pkgs, nil
+	}
+	for _, db := range rpmLegacyDbs {
+		if exists(stack, db) {
+			return nil, fmt.Errorf("%s: only rpm databases in sqlite format are supported", db)
+		}
+	}
+	return nil, nil
+}
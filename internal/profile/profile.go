@@ -0,0 +1,196 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package profile
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Profile records the files accessed in each layer of an image during profiling.
+// Layers are keyed by their diff ids, so that a profile can be applied to an image tar without docker.
+type Profile struct {
+	Image  string              `json:"image"`
+	Layers map[string][]string `json:"layers"` // diff id -> accessed files, relative to the layer root
+}
+
+// NewProfile creates an empty profile of an image.
+func NewProfile(imgName string) Profile {
+	return Profile{Image: imgName, Layers: map[string][]string{}}
+}
+
+// AddLayer adds the accessed files of a layer. Files of layers with the same diff id are merged.
+func (p *Profile) AddLayer(diffId string, files []string) {
+	set := map[string]bool{}
+	for _, f := range p.Layers[diffId] {
+		set[f] = true
+	}
+	for _, f := range files {
+		set[f] = true
+	}
+	merged := make([]string, 0, len(set))
+	for f := range set {
+		merged = append(merged, f)
+	}
+	sort.Strings(merged)
+	p.Layers[diffId] = merged
+}
+
+// Kept returns the set of accessed files of a layer, and false if the layer is not profiled.
+func (p *Profile) Kept(diffId string) (map[string]bool, bool) {
+	files, ok := p.Layers[diffId]
+	if !ok {
+		return nil, false
+	}
+	kept := map[string]bool{}
+	for _, f := range files {
+		kept[f] = true
+	}
+	return kept, true
+}
+
+// Dump writes the profile to a json file.
+func (p *Profile) Dump(dst string) {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		panic(err)
+	}
+}
+
+// Load reads a profile from a json file.
+func Load(src string) Profile {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		panic(err)
+	}
+	p := NewProfile("")
+	if err := json.Unmarshal(data, &p); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// entryName normalizes the name of a tar entry to a path relative to the layer root.
+func entryName(name string) string {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	return strings.TrimPrefix(name, "./")
+}
+
+// keepEntry returns true if an entry of a layer tar should be kept.
+// Whiteouts, FIFOs and device nodes have no content to be accessed, so they are always kept,
+// the same as util.TarLayer does for a debloated layer.
+func keepEntry(header *tar.Header, name string, kept map[string]bool, parents map[string]bool) bool {
+	if name == "." || kept[name] {
+		return true
+	}
+	if strings.HasPrefix(path.Base(name), util.WhiteoutPrefix) {
+		return true
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return parents[name]
+	case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		return true
+	}
+	return false
+}
+
+// FilterLayerTar writes the entries of the layer tar src that are in kept to dst.
+// Parent directories of kept files are kept, and so are the targets of kept hardlinks.
+// Metadata of kept entries is copied unchanged.
+func FilterLayerTar(src string, dst string, kept map[string]bool) {
+	// the first pass collects hardlink targets, which must be kept along with their links
+	in, err := os.Open(src)
+	if err != nil {
+		panic(err)
+	}
+	defer in.Close()
+	closure := map[string]bool{}
+	for f := range kept {
+		closure[f] = true
+	}
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		if header.Typeflag == tar.TypeLink && closure[entryName(header.Name)] {
+			closure[entryName(header.Linkname)] = true
+		}
+	}
+	parents := map[string]bool{}
+	for f := range closure {
+		for dir := path.Dir(f); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		panic(err)
+	}
+	defer out.Close()
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	tr = tar.NewReader(in)
+	total, written := 0, 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		total++
+		if !keepEntry(header, entryName(header.Name), closure, parents) {
+			continue
+		}
+		written++
+		if err := tw.WriteHeader(header); err != nil {
+			panic(err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			panic(err)
+		}
+	}
+	log.Debug("Kept ", written, " of ", total, " entries of ", src)
+}
@@ -0,0 +1,113 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package profile
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTar writes a tar file with the given headers, regular files get their names as content.
+func writeTar(t *testing.T, dst string, headers []*tar.Header) {
+	f, err := os.Create(dst)
+	assert.NoError(t, err)
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	defer tw.Close()
+	for _, h := range headers {
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(h.Name))
+		}
+		assert.NoError(t, tw.WriteHeader(h))
+		if h.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(h.Name))
+			assert.NoError(t, err)
+		}
+	}
+}
+
+// readTarNames returns the names of all entries in a tar file.
+func readTarNames(t *testing.T, src string) []string {
+	f, err := os.Open(src)
+	assert.NoError(t, err)
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, h.Name)
+	}
+	return names
+}
+
+func TestAddLayerMerges(t *testing.T) {
+	p := NewProfile("redis")
+
+	p.AddLayer("sha256:a", []string{"usr/bin/redis", "etc"})
+	p.AddLayer("sha256:a", []string{"etc", "etc/hosts"})
+
+	assert.Equal(t, []string{"etc", "etc/hosts", "usr/bin/redis"}, p.Layers["sha256:a"])
+	_, ok := p.Kept("sha256:b")
+	assert.False(t, ok)
+}
+
+func TestDumpLoad(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "profile.json")
+	p := NewProfile("redis")
+	p.AddLayer("sha256:a", []string{"etc/hosts"})
+
+	p.Dump(dst)
+	loaded := Load(dst)
+
+	assert.Equal(t, p, loaded)
+}
+
+func TestFilterLayerTar(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "layer.tar")
+	dst := filepath.Join(dir, "filtered.tar")
+	writeTar(t, src, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/python3.11", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "usr/bin/python3", Typeflag: tar.TypeLink, Linkname: "usr/bin/python3.11"},
+		{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755},
+	})
+
+	FilterLayerTar(src, dst, map[string]bool{"etc/hosts": true, "usr/bin/python3": true})
+
+	assert.Equal(t, []string{"etc/", "etc/hosts", "etc/.wh.shadow", "usr/", "usr/bin/", "usr/bin/python3.11", "usr/bin/python3"},
+		readTarNames(t, dst))
+}
@@ -0,0 +1,198 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package report
+
+import (
+	"html/template"
+	"io"
+
+	"github.com/negativa-ai/BLAFS/internal/rules"
+)
+
+// Metadata describes a debloat run in html reports and SBOMs.
+type Metadata struct {
+	Image           string      `json:"image"`
+	OriginalDigest  string      `json:"original_digest"`
+	DebloatedImage  string      `json:"debloated_image"`
+	DebloatedDigest string      `json:"debloated_digest"`
+	Version         string      `json:"version"`
+	Time            string      `json:"time"`
+	Rules           rules.Rules `json:"rules"`
+}
+
+// htmlData is the data rendered by htmlTemplate.
+type htmlData struct {
+	Report
+	Metadata Metadata
+	Tree     *Node
+	Subtrees []Subtree
+	MaxSize  int64
+}
+
+// WriteHTML writes a self-contained html report, without external assets, so that it can be shared as a single file.
+// It shows the metadata of the run, per-layer size bars, the largest removed subtrees
+// and a collapsible tree of the merged filesystem marking kept and removed files.
+func WriteHTML(w io.Writer, r Report, tree *Node, m Metadata) error {
+	data := htmlData{Report: r, Metadata: m, Tree: tree, Subtrees: tree.RemovedSubtrees(len(r.Dirs))}
+	for _, l := range r.Layers {
+		if l.OriginalSize > data.MaxSize {
+			data.MaxSize = l.OriginalSize
+		}
+	}
+	return htmlTemplate.Execute(w, data)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"human":   HumanSize,
+	"percent": percent,
+	"short":   shortId,
+	"ratio": func(part int64, whole int64) float64 {
+		if whole <= 0 {
+			return 0
+		}
+		return float64(part) * 100 / float64(whole)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Debloat report of {{.Image}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: left; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+code { font-size: 0.9em; }
+.track { width: 24em; }
+.bar { background: #f3c4c4; height: 1em; }
+.bar .kept { background: #5a9e5a; height: 100%; }
+.legend span { display: inline-block; width: 1em; height: 1em; vertical-align: middle; margin: 0 0.3em 0 1em; }
+#tree { font-family: monospace; }
+#tree details { margin-left: 1.2em; }
+#tree .file { margin-left: 2.4em; }
+.kept { color: #2e7d32; }
+.removed { color: #c62828; text-decoration: line-through; }
+.partial { color: #ef6c00; }
+.size { color: #777; margin-left: 0.5em; }
+</style>
+</head>
+<body>
+<h1>Debloat report of <code>{{.Image}}</code></h1>
+<p>Removed <strong>{{human .RemovedSize}}</strong> of {{human .OriginalSize}} ({{percent .RemovedSize .OriginalSize}}), {{.RemovedFiles}} of {{.OriginalFiles}} files.</p>
+
+<h2>Run</h2>
+<table>
+<tr><th>Original image</th><td><code>{{.Metadata.Image}}</code></td></tr>
+<tr><th>Original digest</th><td><code>{{.Metadata.OriginalDigest}}</code></td></tr>
+<tr><th>Debloated image</th><td><code>{{.Metadata.DebloatedImage}}</code></td></tr>
+<tr><th>Debloated digest</th><td><code>{{.Metadata.DebloatedDigest}}</code></td></tr>
+<tr><th>baffs version</th><td>{{.Metadata.Version}}</td></tr>
+<tr><th>Time</th><td>{{.Metadata.Time}}</td></tr>
+<tr><th>Keep rules</th><td>{{range .Metadata.Rules.Keep}}<code>{{.}}</code> {{else}}none{{end}}</td></tr>
+<tr><th>Drop rules</th><td>{{range .Metadata.Rules.Drop}}<code>{{.}}</code> {{else}}none{{end}}</td></tr>
+</table>
+
+<h2>Layers</h2>
+<p class="legend"><span style="background:#5a9e5a"></span>kept<span style="background:#f3c4c4"></span>removed</p>
+<table>
+<tr><th>Layer</th><th>Diff ID</th><th>Size</th><th class="num">Original</th><th class="num">Kept</th><th class="num">Removed</th><th class="num">Removed files</th></tr>
+{{range $i, $l := .Layers}}<tr>
+<td class="num">{{$i}}</td><td><code title="{{$l.DiffId}}">{{short $l.DiffId}}</code></td>
+<td><div class="track"><div class="bar" style="width: {{ratio $l.OriginalSize $.MaxSize}}%"><div class="kept" style="width: {{ratio $l.KeptSize $l.OriginalSize}}%"></div></div></div></td>
+<td class="num">{{human $l.OriginalSize}}</td><td class="num">{{human $l.KeptSize}}</td>
+<td class="num">{{human $l.RemovedSize}} ({{percent $l.RemovedSize $l.OriginalSize}})</td><td class="num">{{$l.RemovedFiles}} / {{$l.OriginalFiles}}</td>
+</tr>
+{{end}}</table>
+
+<h2>Largest removed subtrees</h2>
+<table>
+<tr><th>Directory</th><th class="num">Size</th><th class="num">Files</th></tr>
+{{range .Subtrees}}<tr><td><code>{{.Path}}</code></td><td class="num">{{human .Size}}</td><td class="num">{{.Files}}</td></tr>
+{{end}}</table>
+
+<h2>Removed file types</h2>
+<table>
+<tr><th>Type</th><th class="num">Size</th><th class="num">Files</th></tr>
+{{range .Types}}<tr><td>{{.Name}}</td><td class="num">{{human .Size}}</td><td class="num">{{.Files}}</td></tr>
+{{end}}</table>
+
+<h2>Filesystem</h2>
+<p class="legend"><span class="kept">kept</span> <span class="partial">partly removed</span> <span class="removed">removed</span></p>
+<div id="tree"></div>
+
+<script>
+const tree = {{.Tree}};
+
+function human(size) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (size >= 1024 && i < units.length - 1) { size /= 1024; i++; }
+  return (i === 0 ? size : size.toFixed(1)) + " " + units[i];
+}
+
+function state(node) {
+  if (node.rf === 0) return "kept";
+  if (node.rf === node.f) return "removed";
+  return "partial";
+}
+
+function label(node) {
+  const span = document.createElement("span");
+  span.className = state(node);
+  span.textContent = node.n + (node.d ? "/" : "");
+  const size = document.createElement("span");
+  size.className = "size";
+  size.textContent = node.d ? human(node.s) + ", " + human(node.r) + " removed, " + node.rf + "/" + node.f + " files" : human(node.s);
+  const fragment = document.createDocumentFragment();
+  fragment.append(span, size);
+  return fragment;
+}
+
+// children are rendered when a directory is opened for the first time, trees can be large
+function render(node, container) {
+  for (const child of node.c || []) {
+    if (child.d) {
+      const details = document.createElement("details");
+      const summary = document.createElement("summary");
+      summary.append(label(child));
+      details.append(summary);
+      details.addEventListener("toggle", () => {
+        if (details.open && !details.dataset.rendered) {
+          details.dataset.rendered = "1";
+          render(child, details);
+        }
+      });
+      container.append(details);
+    } else {
+      const div = document.createElement("div");
+      div.className = "file";
+      div.append(label(child));
+      container.append(div);
+    }
+  }
+}
+
+render(tree, document.getElementById("tree"));
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,357 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+	"github.com/negativa-ai/BLAFS/internal/surface"
+	"github.com/negativa-ai/BLAFS/internal/util"
+)
+
+// DirDepth is the depth of the directories removed files are grouped by, e.g. usr/share/doc.
+const DirDepth = 3
+
+// A LayerReport summarizes what was removed from a layer.
+type LayerReport struct {
+	DiffId        string `json:"diff_id"`
+	OriginalSize  int64  `json:"original_size"`
+	KeptSize      int64  `json:"kept_size"`
+	RemovedSize   int64  `json:"removed_size"`
+	OriginalFiles int    `json:"original_files"`
+	KeptFiles     int    `json:"kept_files"`
+	RemovedFiles  int    `json:"removed_files"`
+}
+
+// A Group summarizes the removed files of a directory or of a file type.
+type Group struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+}
+
+// A Report summarizes what debloating removed from an image, per layer, per directory and per file type.
+type Report struct {
+	Image         string          `json:"image"`
+	OriginalSize  int64           `json:"original_size"`
+	KeptSize      int64           `json:"kept_size"`
+	RemovedSize   int64           `json:"removed_size"`
+	OriginalFiles int             `json:"original_files"`
+	KeptFiles     int             `json:"kept_files"`
+	RemovedFiles  int             `json:"removed_files"`
+	Layers        []LayerReport   `json:"layers"`   // from the top layer to the bottom one
+	Dirs          []Group         `json:"dirs"`     // directories with the most bytes removed
+	Types         []Group         `json:"types"`    // file types with the most bytes removed
+	Packages      []Package       `json:"packages"` // packages of the package databases found in the image
+	Surface       surface.Surface `json:"surface"`  // shells, interpreters, setuid binaries... of the image
+}
+
+// A Package tells how much of a package is kept in a debloated image.
+type Package struct {
+	Manager      string `json:"manager"`
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	State        string `json:"state"` // kept, partly-removed or removed
+	KeptFiles    int    `json:"kept_files"`
+	RemovedFiles int    `json:"removed_files"`
+}
+
+// A RemovedFile is a file of an original layer that is not kept in its shadow layer.
+type RemovedFile struct {
+	Path string
+	Info os.FileInfo
+}
+
+// WalkLayer calls fn for every file of the original layer of a shadow layer, directories and whiteouts excluded.
+func WalkLayer(l image.ShadowLayer, fn func(relPath string, info os.FileInfo, kept bool)) {
+	original := l.Original()
+	originDir := original.GetDiffPath()
+	keptDir := l.GetKeptPath()
+	if err := filepath.WalkDir(originDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if util.IsWhiteout(info) {
+			return nil
+		}
+		relPath, err := filepath.Rel(originDir, p)
+		if err != nil {
+			return err
+		}
+		fn(relPath, info, image.IsKept(keptDir, relPath, info))
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// New creates the report of an image from its shadow layers and their diff ids, both from the top layer to the bottom one.
+// At most topN directories and file types are reported.
+func New(imgName string, shadowLayers []image.ShadowLayer, diffIds []string, topN int) Report {
+	r := Report{Image: imgName}
+	dirs := map[string]*Group{}
+	types := map[string]*Group{}
+	for i, l := range shadowLayers {
+		original := l.Original()
+		lr := LayerReport{DiffId: diffIds[i], OriginalSize: original.GetLayerSize(), KeptSize: l.GetLayerSize()}
+		lr.RemovedSize = lr.OriginalSize - lr.KeptSize
+		WalkLayer(l, func(relPath string, info os.FileInfo, kept bool) {
+			lr.OriginalFiles++
+			if kept {
+				lr.KeptFiles++
+				return
+			}
+			lr.RemovedFiles++
+			add(dirs, groupDir(relPath), info.Size())
+			add(types, FileType(filepath.Join(original.GetDiffPath(), relPath), info), info.Size())
+		})
+		r.Layers = append(r.Layers, lr)
+		r.OriginalSize += lr.OriginalSize
+		r.KeptSize += lr.KeptSize
+		r.RemovedSize += lr.RemovedSize
+		r.OriginalFiles += lr.OriginalFiles
+		r.KeptFiles += lr.KeptFiles
+		r.RemovedFiles += lr.RemovedFiles
+	}
+	r.Dirs = top(dirs, topN)
+	r.Types = top(types, topN)
+
+	stack := image.NewLayerStack(shadowLayers)
+	r.Surface = surface.Classify(stack)
+	for _, s := range pkgdb.Check(stack, pkgdb.Read(stack)) {
+		r.Packages = append(r.Packages, Package{Manager: s.Manager, Name: s.ID(), Version: s.Version, State: s.State,
+			KeptFiles: len(s.Kept), RemovedFiles: len(s.Removed)})
+	}
+	return r
+}
+
+// countPackages returns the number of packages in each state.
+func (r *Report) countPackages() map[string]int {
+	count := map[string]int{}
+	for _, p := range r.Packages {
+		count[p.State]++
+	}
+	return count
+}
+
+func add(groups map[string]*Group, name string, size int64) {
+	g, ok := groups[name]
+	if !ok {
+		g = &Group{Name: name}
+		groups[name] = g
+	}
+	g.Size += size
+	g.Files++
+}
+
+// top returns the n groups with the most bytes removed.
+func top(groups map[string]*Group, n int) []Group {
+	var sorted []Group
+	for _, g := range groups {
+		sorted = append(sorted, *g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Size != sorted[j].Size {
+			return sorted[i].Size > sorted[j].Size
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	if n >= 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// groupDir returns the directory a removed file is grouped by, at most DirDepth levels deep.
+func groupDir(relPath string) string {
+	dir := path.Dir(filepath.ToSlash(relPath))
+	if dir == "." {
+		return "/"
+	}
+	segments := strings.Split(dir, "/")
+	if len(segments) > DirDepth {
+		segments = segments[:DirDepth]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// FileType classifies a file by its kind, ELF header or extension.
+func FileType(filePath string, info os.FileInfo) string {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return "symlink"
+	case !info.Mode().IsRegular():
+		return "special"
+	}
+	if f, err := os.Open(filePath); err == nil {
+		magic := make([]byte, 4)
+		n, _ := io.ReadFull(f, magic)
+		f.Close()
+		if n == 4 && string(magic) == "\x7fELF" {
+			return "elf"
+		}
+	}
+	name := info.Name()
+	if ext := path.Ext(name); ext != "" && ext != name {
+		return strings.ToLower(ext)
+	}
+	return "other"
+}
+
+// HumanSize formats a size in bytes with a binary unit.
+func HumanSize(size int64) string {
+	const unit = 1024
+	if size < unit && size > -unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	i := -1
+	for (value >= unit || value <= -unit) && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+func percent(part int64, whole int64) string {
+	if whole == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(whole))
+}
+
+func shortId(diffId string) string {
+	id := strings.TrimPrefix(diffId, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// WriteJSON writes the report as indented json.
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteText writes the report as plain text tables.
+func (r *Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Image: %s\n", r.Image)
+	fmt.Fprintf(w, "Removed %s of %s (%s), %d of %d files\n\n", HumanSize(r.RemovedSize), HumanSize(r.OriginalSize),
+		percent(r.RemovedSize, r.OriginalSize), r.RemovedFiles, r.OriginalFiles)
+
+	fmt.Fprintf(w, "%-5s %-12s %12s %12s %12s %8s %10s\n", "LAYER", "DIFF ID", "ORIGINAL", "KEPT", "REMOVED", "REMOVED%", "FILES")
+	for i, l := range r.Layers {
+		fmt.Fprintf(w, "%-5d %-12s %12s %12s %12s %8s %10s\n", i, shortId(l.DiffId), HumanSize(l.OriginalSize), HumanSize(l.KeptSize),
+			HumanSize(l.RemovedSize), percent(l.RemovedSize, l.OriginalSize), fmt.Sprintf("-%d/%d", l.RemovedFiles, l.OriginalFiles))
+	}
+
+	fmt.Fprintf(w, "\n%-40s %12s %8s\n", "REMOVED DIRECTORY", "SIZE", "FILES")
+	for _, g := range r.Dirs {
+		fmt.Fprintf(w, "%-40s %12s %8d\n", g.Name, HumanSize(g.Size), g.Files)
+	}
+	fmt.Fprintf(w, "\n%-40s %12s %8s\n", "REMOVED FILE TYPE", "SIZE", "FILES")
+	for _, g := range r.Types {
+		fmt.Fprintf(w, "%-40s %12s %8d\n", g.Name, HumanSize(g.Size), g.Files)
+	}
+
+	if summary := r.Surface.Summary(); len(summary) > 0 {
+		fmt.Fprintf(w, "\nAttack surface:\n")
+		for _, line := range summary {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+
+	if len(r.Packages) == 0 {
+		return
+	}
+	count := r.countPackages()
+	fmt.Fprintf(w, "\nPackages: %d kept, %d partly removed, %d removed\n", count[pkgdb.StateKept], count[pkgdb.StatePartlyRemoved], count[pkgdb.StateRemoved])
+	fmt.Fprintf(w, "%-40s %-30s %-15s %8s\n", "PACKAGE", "VERSION", "STATE", "REMOVED")
+	for _, p := range r.Packages {
+		if p.State != pkgdb.StateKept {
+			fmt.Fprintf(w, "%-40s %-30s %-15s %8s\n", p.Name, p.Version, p.State, fmt.Sprintf("%d/%d", p.RemovedFiles, p.KeptFiles+p.RemovedFiles))
+		}
+	}
+}
+
+// WriteMarkdown writes the report as markdown tables, e.g. to attach it to merge requests.
+func (r *Report) WriteMarkdown(w io.Writer) {
+	fmt.Fprintf(w, "## Debloat report of `%s`\n\n", r.Image)
+	fmt.Fprintf(w, "Removed **%s** of %s (%s), %d of %d files.\n\n", HumanSize(r.RemovedSize), HumanSize(r.OriginalSize),
+		percent(r.RemovedSize, r.OriginalSize), r.RemovedFiles, r.OriginalFiles)
+
+	fmt.Fprintf(w, "### Layers\n\n| Layer | Diff ID | Original | Kept | Removed | Removed files |\n|---:|---|---:|---:|---:|---:|\n")
+	for i, l := range r.Layers {
+		fmt.Fprintf(w, "| %d | `%s` | %s | %s | %s (%s) | %d / %d |\n", i, shortId(l.DiffId), HumanSize(l.OriginalSize), HumanSize(l.KeptSize),
+			HumanSize(l.RemovedSize), percent(l.RemovedSize, l.OriginalSize), l.RemovedFiles, l.OriginalFiles)
+	}
+
+	fmt.Fprintf(w, "\n### Top removed directories\n\n| Directory | Size | Files |\n|---|---:|---:|\n")
+	for _, g := range r.Dirs {
+		fmt.Fprintf(w, "| `%s` | %s | %d |\n", g.Name, HumanSize(g.Size), g.Files)
+	}
+	fmt.Fprintf(w, "\n### Removed file types\n\n| Type | Size | Files |\n|---|---:|---:|\n")
+	for _, g := range r.Types {
+		fmt.Fprintf(w, "| %s | %s | %d |\n", g.Name, HumanSize(g.Size), g.Files)
+	}
+
+	if summary := r.Surface.Summary(); len(summary) > 0 {
+		fmt.Fprintf(w, "\n### Attack surface\n\n| Category | Files | Kept |\n|---|---:|---:|\n")
+		for _, c := range r.Surface.Categories {
+			if len(c.Files) > 0 {
+				fmt.Fprintf(w, "| %s | %d | %d |\n", c.Name, len(c.Files), len(c.Kept))
+			}
+		}
+	}
+
+	if len(r.Packages) == 0 {
+		return
+	}
+	count := r.countPackages()
+	fmt.Fprintf(w, "\n### Packages\n\n%d kept, %d partly removed, %d removed.\n\n| Package | Version | State | Removed files |\n|---|---|---|---:|\n",
+		count[pkgdb.StateKept], count[pkgdb.StatePartlyRemoved], count[pkgdb.StateRemoved])
+	for _, p := range r.Packages {
+		if p.State != pkgdb.StateKept {
+			fmt.Fprintf(w, "| `%s` | %s | %s | %d / %d |\n", p.Name, p.Version, p.State, p.RemovedFiles, p.KeptFiles+p.RemovedFiles)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/rules"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+// newShadowLayer creates an original layer and its shadow layer under overlay, with an empty real dir.
+func newShadowLayer(t *testing.T, overlay string, name string) image.ShadowLayer {
+	for _, layerName := range []string{name, "shadow_" + name} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(overlay, layerName, "diff"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(overlay, layerName, "link"), []byte(strings.ToUpper(layerName)), 0644))
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(overlay, "shadow_"+name, "real"), 0755))
+	return image.NewShadowLayer(*image.NewLayerInfo(filepath.Join(overlay, "shadow_"+name)))
+}
+
+func TestNew(t *testing.T) {
+	overlay := t.TempDir()
+	top := newShadowLayer(t, overlay, "top")
+	bottom := newShadowLayer(t, overlay, "bottom")
+	writeFile(t, filepath.Join(overlay, "top/diff/app/main.py"), "print(1)")
+	writeFile(t, filepath.Join(overlay, "top/diff/app/cache/a.pyc"), "0123456789")
+	writeFile(t, filepath.Join(overlay, "shadow_top/real/app/main.py"), "print(1)")
+	writeFile(t, filepath.Join(overlay, "bottom/diff/usr/share/doc/pkg/README"), "readme")
+	writeFile(t, filepath.Join(overlay, "bottom/diff/usr/bin/tool"), "\x7fELF....")
+	writeFile(t, filepath.Join(overlay, "bottom/diff/etc/empty"), "")
+	// placeholders of files never opened are removed, empty files are kept
+	writeFile(t, filepath.Join(overlay, "shadow_bottom/real/usr/bin/tool"), "")
+	writeFile(t, filepath.Join(overlay, "shadow_bottom/real/etc/empty"), "")
+
+	r := New("img", []image.ShadowLayer{top, bottom}, []string{"sha256:top", "sha256:bottom"}, 10)
+
+	assert.Equal(t, 5, r.OriginalFiles)
+	assert.Equal(t, 2, r.KeptFiles)
+	assert.Equal(t, 3, r.RemovedFiles)
+	assert.Equal(t, 2, r.Layers[0].OriginalFiles)
+	assert.Equal(t, 1, r.Layers[0].RemovedFiles)
+	assert.Equal(t, int64(10), r.Layers[0].RemovedSize)
+	assert.Equal(t, "sha256:bottom", r.Layers[1].DiffId)
+	assert.Equal(t, []Group{{Name: "/app/cache", Size: 10, Files: 1}, {Name: "/usr/bin", Size: 8, Files: 1}, {Name: "/usr/share/doc", Size: 6, Files: 1}}, r.Dirs)
+	assert.Equal(t, []Group{{Name: ".pyc", Size: 10, Files: 1}, {Name: "elf", Size: 8, Files: 1}, {Name: "other", Size: 6, Files: 1}}, r.Types)
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.WriteJSON(&buf))
+	var decoded Report
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, r, decoded)
+
+	buf.Reset()
+	r.WriteText(&buf)
+	assert.Contains(t, buf.String(), "Removed 24 B of 32 B (75.0%), 3 of 5 files")
+	buf.Reset()
+	r.WriteMarkdown(&buf)
+	assert.Contains(t, buf.String(), "| `/app/cache` | 10 B | 1 |")
+}
+
+func TestNewPackages(t *testing.T) {
+	overlay := t.TempDir()
+	layer := newShadowLayer(t, overlay, "layer")
+	writeFile(t, filepath.Join(overlay, "layer/diff/var/lib/dpkg/status"), "Package: tool\nStatus: install ok installed\nVersion: 1.0\n")
+	writeFile(t, filepath.Join(overlay, "layer/diff/var/lib/dpkg/info/tool.list"), "/usr/bin/tool\n/usr/share/doc/tool/README\n")
+	writeFile(t, filepath.Join(overlay, "layer/diff/usr/bin/tool"), "tool")
+	writeFile(t, filepath.Join(overlay, "layer/diff/usr/share/doc/tool/README"), "readme")
+	writeFile(t, filepath.Join(overlay, "shadow_layer/real/usr/bin/tool"), "tool")
+
+	r := New("img", []image.ShadowLayer{layer}, []string{"sha256:layer"}, 10)
+	assert.Equal(t, []Package{{Manager: "dpkg", Name: "tool", Version: "1.0", State: "partly-removed", KeptFiles: 1, RemovedFiles: 1}}, r.Packages)
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	assert.Contains(t, buf.String(), "Packages: 0 kept, 1 partly removed, 0 removed")
+	buf.Reset()
+	r.WriteMarkdown(&buf)
+	assert.Contains(t, buf.String(), "| `tool` | 1.0 | partly-removed | 1 / 2 |")
+}
+
+func TestHumanSize(t *testing.T) {
+	assert.Equal(t, "512 B", HumanSize(512))
+	assert.Equal(t, "1.5 KiB", HumanSize(1536))
+	assert.Equal(t, "2.0 GiB", HumanSize(2<<30))
+}
+
+func TestTree(t *testing.T) {
+	overlay := t.TempDir()
+	top := newShadowLayer(t, overlay, "top")
+	bottom := newShadowLayer(t, overlay, "bottom")
+	writeFile(t, filepath.Join(overlay, "top/diff/etc/hosts"), "127.0.0.1")
+	writeFile(t, filepath.Join(overlay, "shadow_top/real/etc/hosts"), "127.0.0.1")
+	writeFile(t, filepath.Join(overlay, "bottom/diff/etc/hosts"), "hidden by the top layer")
+	writeFile(t, filepath.Join(overlay, "bottom/diff/usr/share/doc/a/README"), "readme")
+	writeFile(t, filepath.Join(overlay, "bottom/diff/usr/share/doc/b/README"), "readme")
+	writeFile(t, filepath.Join(overlay, "bottom/diff/usr/share/man/man1/ls.1"), "man")
+
+	tree := NewTree([]image.ShadowLayer{top, bottom})
+
+	assert.Equal(t, 4, tree.Files)
+	assert.Equal(t, 3, tree.RemovedFiles)
+	assert.Equal(t, []string{"etc", "usr"}, []string{tree.Children[0].Name, tree.Children[1].Name})
+	assert.Equal(t, int64(9), tree.Children[0].Size)
+	assert.Equal(t, []Subtree{{Path: "/usr", Size: 15, Files: 3}}, tree.RemovedSubtrees(10))
+}
+
+func TestWriteHTML(t *testing.T) {
+	overlay := t.TempDir()
+	top := newShadowLayer(t, overlay, "top")
+	writeFile(t, filepath.Join(overlay, "top/diff/etc/hosts"), "127.0.0.1")
+	writeFile(t, filepath.Join(overlay, "top/diff/usr/bin/<script>"), "x")
+	writeFile(t, filepath.Join(overlay, "shadow_top/real/etc/hosts"), "127.0.0.1")
+	layers := []image.ShadowLayer{top}
+	r := New("img", layers, []string{"sha256:top"}, 10)
+	m := Metadata{Image: "img", OriginalDigest: "sha256:aaa", DebloatedImage: "img-baffs", DebloatedDigest: "sha256:bbb",
+		Version: "dev", Rules: rules.Rules{Keep: []string{"etc/ssl/**"}}}
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteHTML(&buf, r, NewTree(layers), m))
+
+	html := buf.String()
+	assert.Contains(t, html, "sha256:bbb")
+	assert.Contains(t, html, "<code>etc/ssl/**</code>")
+	assert.Contains(t, html, `style="width: 100%"`)
+	assert.NotContains(t, html, "<script>\"")
+	assert.NotContains(t, html, "ZgotmplZ")
+	assert.NotRegexp(t, `(src|href)="http`, html)
+}
@@ -0,0 +1,163 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package report
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/util"
+)
+
+// A Node is a file or directory of the merged filesystem of an image.
+// Short json keys keep the tree embedded in html reports small.
+type Node struct {
+	Name         string  `json:"n"`
+	Size         int64   `json:"s"`           // bytes in the original image
+	Removed      int64   `json:"r"`           // bytes removed
+	Files        int     `json:"f"`           // files in the original image
+	RemovedFiles int     `json:"rf"`          // files removed
+	Dir          bool    `json:"d,omitempty"` // true for directories
+	Children     []*Node `json:"c,omitempty"` // sorted by name
+	children     map[string]*Node
+}
+
+// A Subtree is a directory whose files are all removed.
+type Subtree struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+}
+
+func (n *Node) child(name string, dir bool) *Node {
+	if n.children == nil {
+		n.children = map[string]*Node{}
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &Node{Name: name, Dir: dir}
+		n.children[name] = c
+		n.Children = append(n.Children, c)
+	}
+	return c
+}
+
+// NewTree creates the merged filesystem tree of the original layers of shadow layers, from the top layer to the bottom one.
+// Files hidden by upper layers are left out, each file is marked as kept or removed in its shadow layer.
+func NewTree(shadowLayers []image.ShadowLayer) *Node {
+	root := &Node{Name: "/", Dir: true}
+	stack := image.NewLayerStack(shadowLayers)
+	for i, l := range stack {
+		if err := filepath.WalkDir(l.Origin, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(l.Origin, p)
+			if err != nil {
+				return err
+			}
+			if relPath == "." || stack.Lookup(relPath) != i {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if util.IsWhiteout(info) {
+				return nil
+			}
+
+			segments := strings.Split(filepath.ToSlash(relPath), "/")
+			node := root
+			for _, s := range segments[:len(segments)-1] {
+				node = node.child(s, true)
+			}
+			if d.IsDir() {
+				node.child(segments[len(segments)-1], true)
+				return nil
+			}
+			file := node.child(segments[len(segments)-1], false)
+			file.Size = info.Size()
+			file.Files = 1
+			if !image.IsKept(l.Kept, relPath, info) {
+				file.Removed = file.Size
+				file.RemovedFiles = 1
+			}
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+	}
+	root.sum()
+	return root
+}
+
+// sum sums up sizes and file counts of directories and sorts their children.
+func (n *Node) sum() {
+	if !n.Dir {
+		return
+	}
+	n.Size, n.Removed, n.Files, n.RemovedFiles = 0, 0, 0, 0
+	for _, c := range n.Children {
+		c.sum()
+		n.Size += c.Size
+		n.Removed += c.Removed
+		n.Files += c.Files
+		n.RemovedFiles += c.RemovedFiles
+	}
+	sort.Slice(n.Children, func(i, j int) bool {
+		return n.Children[i].Name < n.Children[j].Name
+	})
+}
+
+// RemovedSubtrees returns the n largest directories whose files are all removed, and that are not inside another one.
+func (n *Node) RemovedSubtrees(topN int) []Subtree {
+	var subtrees []Subtree
+	var walk func(node *Node, nodePath string)
+	walk = func(node *Node, nodePath string) {
+		for _, c := range node.Children {
+			if !c.Dir {
+				continue
+			}
+			childPath := strings.TrimSuffix(nodePath, "/") + "/" + c.Name
+			if c.Files > 0 && c.RemovedFiles == c.Files {
+				subtrees = append(subtrees, Subtree{Path: childPath, Size: c.Removed, Files: c.RemovedFiles})
+				continue
+			}
+			walk(c, childPath)
+		}
+	}
+	walk(n, "/")
+	sort.Slice(subtrees, func(i, j int) bool {
+		if subtrees[i].Size != subtrees[j].Size {
+			return subtrees[i].Size > subtrees[j].Size
+		}
+		return subtrees[i].Path < subtrees[j].Path
+	})
+	if topN >= 0 && len(subtrees) > topN {
+		subtrees = subtrees[:topN]
+	}
+	return subtrees
+}
@@ -0,0 +1,241 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+)
+
+// Rules adjust the files kept in a debloated image, independently of profiling.
+// Keep patterns copy matching files from the original layers, e.g. CA bundles or timezone data,
+// drop patterns remove matching files even if they were accessed, e.g. caches. Drop wins over keep.
+//
+// Patterns are globs relative to the root of the image, "**" matches any number of directories.
+// A pattern without "/" matches the base name at any depth, e.g. "*.pyc".
+// A pattern matching a directory matches everything below it.
+// Patterns match paths as stored in the layers, symlinked directories are not followed when matching.
+type Rules struct {
+	Keep []string `json:"keep"`
+	Drop []string `json:"drop"`
+}
+
+// Load reads rules from a file, one rule per line:
+//
+//	# comment
+//	keep etc/ssl/**
+//	drop *.pyc
+func Load(rulesPath string) (Rules, error) {
+	var r Rules
+	f, err := os.Open(rulesPath)
+	if err != nil {
+		return r, err
+	}
+	defer f.Close()
+	r, err = parse(f)
+	if err != nil {
+		return r, fmt.Errorf("%s: %w", rulesPath, err)
+	}
+	return r, nil
+}
+
+func parse(reader io.Reader) (Rules, error) {
+	var r Rules
+	scanner := bufio.NewScanner(reader)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return r, fmt.Errorf("line %d: expected `keep|drop <pattern>`", lineNo)
+		}
+		if _, err := path.Match(fields[1], ""); err != nil {
+			return r, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		switch fields[0] {
+		case "keep":
+			r.Keep = append(r.Keep, fields[1])
+		case "drop":
+			r.Drop = append(r.Drop, fields[1])
+		default:
+			return r, fmt.Errorf("line %d: unknown action %s", lineNo, fields[0])
+		}
+	}
+	return r, scanner.Err()
+}
+
+// Merge appends the patterns of o to r.
+func (r *Rules) Merge(o Rules) {
+	r.Keep = append(r.Keep, o.Keep...)
+	r.Drop = append(r.Drop, o.Drop...)
+}
+
+// Match reports whether a path relative to the image root matches a pattern.
+func Match(pattern string, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	name = strings.Trim(name, "/")
+	if !strings.Contains(pattern, "/") && pattern != "**" {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchTree reports whether the path or one of its parent directories matches any of the patterns.
+func matchTree(patterns []string, name string) bool {
+	for p := name; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if Match(pattern, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Kept returns true if the path is kept by a keep pattern and not dropped.
+func (r *Rules) Kept(name string) bool {
+	return matchTree(r.Keep, name) && !r.Dropped(name)
+}
+
+// Dropped returns true if the path is removed by a drop pattern.
+func (r *Rules) Dropped(name string) bool {
+	return matchTree(r.Drop, name)
+}
+
+// ApplyKeep keeps the files matching the keep patterns in the layers of an image.
+// A kept file is copied from the topmost layer providing it, together with the symlinks on its path
+// and their targets, so that kept paths still resolve in the debloated image.
+// It returns the paths newly kept.
+func (r *Rules) ApplyKeep(stack image.LayerStack) []string {
+	if len(r.Keep) == 0 {
+		return nil
+	}
+
+	keep := map[string]bool{}
+	for _, l := range stack {
+		if err := filepath.WalkDir(l.Origin, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(l.Origin, p)
+			if err != nil {
+				return err
+			}
+			if relPath == "." || d.Type()&fs.ModeCharDevice != 0 {
+				return nil
+			}
+			if r.Kept(relPath) {
+				keep[relPath] = true
+			}
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+	}
+
+	paths := make([]string, 0, len(keep))
+	for p := range keep {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var added []string
+	for _, p := range paths {
+		added = append(added, stack.KeepResolved(p)...)
+	}
+	return added
+}
+
+// ApplyDrop removes the files matching the drop patterns from the kept dirs of an image.
+// It returns the paths removed.
+func (r *Rules) ApplyDrop(stack image.LayerStack) []string {
+	var dropped []string
+	for _, l := range stack {
+		dropped = append(dropped, r.drop(l.Kept)...)
+	}
+	return dropped
+}
+
+// drop removes the dropped files from a kept dir.
+func (r *Rules) drop(keptDir string) []string {
+	if len(r.Drop) == 0 {
+		return nil
+	}
+	var dropped []string
+	if err := filepath.WalkDir(keptDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(keptDir, p)
+		if err != nil {
+			return err
+		}
+		if relPath == "." || !r.Dropped(relPath) {
+			return nil
+		}
+		dropped = append(dropped, relPath)
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	return dropped
+}
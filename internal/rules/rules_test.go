@@ -0,0 +1,134 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestMatch(t *testing.T) {
+	assert.True(t, Match("etc/ssl/**", "etc/ssl/certs/ca.pem"))
+	assert.True(t, Match("/etc/ssl/**", "etc/ssl"))
+	assert.True(t, Match("usr/**/zoneinfo", "usr/share/zoneinfo"))
+	assert.True(t, Match("**/*.pyc", "usr/lib/python3/a.pyc"))
+	assert.True(t, Match("*.pyc", "usr/lib/python3/a.pyc"))
+	assert.True(t, Match("lib/*/libnss_*", "lib/x86_64-linux-gnu/libnss_dns.so.2"))
+	assert.False(t, Match("lib/*/libnss_*", "lib/libnss_dns.so.2"))
+	assert.False(t, Match("etc/ssl/*", "etc/ssl/certs/ca.pem"))
+	assert.False(t, Match("etc/ssl", "etc"))
+}
+
+func TestParse(t *testing.T) {
+	r, err := parse(strings.NewReader("# certs\nkeep etc/ssl/**\n\ndrop *.pyc\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"etc/ssl/**"}, r.Keep)
+	assert.Equal(t, []string{"*.pyc"}, r.Drop)
+
+	_, err = parse(strings.NewReader("remove *.pyc\n"))
+	assert.Error(t, err)
+	_, err = parse(strings.NewReader("keep [\n"))
+	assert.Error(t, err)
+}
+
+func TestKeptAndDropped(t *testing.T) {
+	r := Rules{Keep: []string{"usr/share/zoneinfo"}, Drop: []string{"usr/share/zoneinfo/right"}}
+
+	assert.True(t, r.Kept("usr/share/zoneinfo/UTC"))
+	assert.False(t, r.Kept("usr/share/zoneinfo/right/UTC"))
+	assert.False(t, r.Kept("usr/share"))
+	assert.True(t, r.Dropped("usr/share/zoneinfo/right/UTC"))
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestApply(t *testing.T) {
+	dir := t.TempDir()
+	upper := image.StackLayer{Origin: filepath.Join(dir, "upper/origin"), Kept: filepath.Join(dir, "upper/kept")}
+	lower := image.StackLayer{Origin: filepath.Join(dir, "lower/origin"), Kept: filepath.Join(dir, "lower/kept")}
+	for _, d := range []string{upper.Origin, upper.Kept, lower.Origin, lower.Kept} {
+		assert.NoError(t, os.MkdirAll(d, 0755))
+	}
+
+	// upper: etc/ssl/cert.pem -> certs/ca.pem, the bundle itself lives in the lower layer
+	assert.NoError(t, os.MkdirAll(filepath.Join(upper.Origin, "etc/ssl"), 0755))
+	assert.NoError(t, os.Symlink("certs/ca.pem", filepath.Join(upper.Origin, "etc/ssl/cert.pem")))
+	writeFile(t, filepath.Join(lower.Origin, "etc/ssl/certs/ca.pem"), "bundle")
+	writeFile(t, filepath.Join(lower.Origin, "etc/ssl/certs/other.pem"), "other")
+	// a placeholder of a file that was listed but never read
+	writeFile(t, filepath.Join(lower.Origin, "etc/localtime"), "UTC")
+	writeFile(t, filepath.Join(lower.Kept, "etc/localtime"), "")
+	// a whited out file is not kept
+	writeFile(t, filepath.Join(lower.Origin, "etc/removed"), "removed")
+	if err := unix.Mknod(filepath.Join(upper.Origin, "etc/removed"), unix.S_IFCHR, 0); err != nil {
+		t.Skip("cannot create whiteout: ", err)
+	}
+	// an accessed cache
+	writeFile(t, filepath.Join(upper.Origin, "app/a.pyc"), "pyc")
+	writeFile(t, filepath.Join(upper.Kept, "app/a.pyc"), "pyc")
+	writeFile(t, filepath.Join(upper.Kept, "app/a.py"), "py")
+
+	r := Rules{Keep: []string{"etc/ssl/cert.pem", "etc/localtime", "etc/removed"}, Drop: []string{"*.pyc"}}
+	stack := image.LayerStack{upper, lower}
+	r.ApplyKeep(stack)
+	assert.Equal(t, []string{"app/a.pyc"}, r.ApplyDrop(stack))
+
+	target, err := os.Readlink(filepath.Join(upper.Kept, "etc/ssl/cert.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, "certs/ca.pem", target)
+	content, err := os.ReadFile(filepath.Join(lower.Kept, "etc/ssl/certs/ca.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bundle", string(content))
+	assert.NoFileExists(t, filepath.Join(lower.Kept, "etc/ssl/certs/other.pem"))
+	content, err = os.ReadFile(filepath.Join(lower.Kept, "etc/localtime"))
+	assert.NoError(t, err)
+	assert.Equal(t, "UTC", string(content))
+	assert.NoFileExists(t, filepath.Join(lower.Kept, "etc/removed"))
+	assert.NoFileExists(t, filepath.Join(upper.Kept, "app/a.pyc"))
+	assert.FileExists(t, filepath.Join(upper.Kept, "app/a.py"))
+}
+
+func TestApplyParentSymlink(t *testing.T) {
+	dir := t.TempDir()
+	layer := image.StackLayer{Origin: filepath.Join(dir, "origin"), Kept: filepath.Join(dir, "kept")}
+	assert.NoError(t, os.MkdirAll(layer.Kept, 0755))
+	writeFile(t, filepath.Join(layer.Origin, "usr/lib/ssl/cert.pem"), "bundle")
+	assert.NoError(t, os.Symlink("usr/lib", filepath.Join(layer.Origin, "lib")))
+	assert.NoError(t, os.MkdirAll(filepath.Join(layer.Origin, "etc/ssl"), 0755))
+	assert.NoError(t, os.Symlink("/lib/ssl/cert.pem", filepath.Join(layer.Origin, "etc/ssl/cert.pem")))
+
+	r := Rules{Keep: []string{"etc/ssl/cert.pem"}}
+	r.ApplyKeep(image.LayerStack{layer})
+
+	_, err := os.Readlink(filepath.Join(layer.Kept, "lib"))
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(layer.Kept, "usr/lib/ssl/cert.pem"))
+}
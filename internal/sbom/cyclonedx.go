@@ -0,0 +1,153 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type cdxBOM struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxPedigree struct {
+	Ancestors []cdxComponent `json:"ancestors"`
+}
+
+type cdxComponent struct {
+	BOMRef      string         `json:"bom-ref,omitempty"`
+	Type        string         `json:"type"`
+	Name        string         `json:"name"`
+	Version     string         `json:"version,omitempty"`
+	Purl        string         `json:"purl,omitempty"`
+	Hashes      []cdxHash      `json:"hashes,omitempty"`
+	Licenses    []cdxLicense   `json:"licenses,omitempty"`
+	Pedigree    *cdxPedigree   `json:"pedigree,omitempty"`
+	Properties  []cdxProperty  `json:"properties,omitempty"`
+	Components  []cdxComponent `json:"components,omitempty"`
+	Description string         `json:"description,omitempty"`
+}
+
+// cdxImage describes a container image by its name and digest.
+func cdxImage(ref string, name string, digest string) cdxComponent {
+	c := cdxComponent{BOMRef: ref, Type: "container", Name: name, Version: digest}
+	if h := digestHex(digest); h != "" {
+		c.Hashes = []cdxHash{{"SHA-256", h}}
+	}
+	return c
+}
+
+func cdxFile(f File) cdxComponent {
+	return cdxComponent{BOMRef: "file:" + f.Path, Type: "file", Name: "/" + f.Path,
+		Hashes: []cdxHash{{"SHA-1", f.SHA1}, {"SHA-256", f.SHA256}}}
+}
+
+// WriteCycloneDX writes the SBOM as a CycloneDX 1.5 JSON document.
+// The original image is the ancestor of the debloated image in its pedigree,
+// files are nested in the package owning them.
+func (s *SBOM) WriteCycloneDX(w io.Writer) error {
+	m := s.Metadata
+	img := cdxImage("image", m.DebloatedImage, m.DebloatedDigest)
+	img.Pedigree = &cdxPedigree{Ancestors: []cdxComponent{cdxImage("original-image", m.Image, m.OriginalDigest)}}
+	bom := cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: m.Time,
+			Tools:     cdxTools{Components: []cdxComponent{{Type: "application", Name: "baffs", Version: m.Version}}},
+			Component: img,
+		},
+		Components: []cdxComponent{},
+	}
+
+	files := map[string]File{}
+	for _, f := range s.Files {
+		files[f.Path] = f
+	}
+	inPackage := map[string]bool{}
+	for _, status := range s.Packages {
+		purl := Purl(status.Package, s.Distro)
+		c := cdxComponent{BOMRef: purl, Type: "library", Name: status.Name, Version: status.Version, Purl: purl,
+			Properties: []cdxProperty{
+				{"baffs:package:manager", status.Manager},
+				{"baffs:package:state", status.State},
+				{"baffs:package:removed-files", fmt.Sprint(len(status.Removed))},
+			}}
+		if status.License != "" {
+			l := cdxLicense{}
+			l.License.Name = status.License
+			c.Licenses = []cdxLicense{l}
+		}
+		for _, p := range status.Kept {
+			// a file is listed once, in the first package owning it
+			if f, ok := files[p]; ok && !inPackage[p] {
+				inPackage[p] = true
+				c.Components = append(c.Components, cdxFile(f))
+			}
+		}
+		bom.Components = append(bom.Components, c)
+	}
+	for _, f := range s.Files {
+		if !inPackage[f.Path] {
+			bom.Components = append(bom.Components, cdxFile(f))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(bom)
+}
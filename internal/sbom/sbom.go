@@ -0,0 +1,151 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package sbom
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+	"github.com/negativa-ai/BLAFS/internal/report"
+)
+
+// A File is a regular file present in a debloated image.
+type File struct {
+	Path   string `json:"path"` // relative to the image root
+	Size   int64  `json:"size"`
+	SHA1   string `json:"sha1"`
+	SHA256 string `json:"sha256"`
+}
+
+// An SBOM describes the packages and files present in a debloated image.
+type SBOM struct {
+	Metadata report.Metadata
+	Distro   string         // ID of the os-release of the image, used in package urls
+	Packages []pkgdb.Status // packages not fully removed, Kept lists their files present in the image
+	Files    []File         // in lexical order
+}
+
+// New creates the SBOM of the kept dirs of a stack.
+// Empty placeholders of files never opened are not listed, the same as in reports.
+func New(stack image.LayerStack, m report.Metadata) SBOM {
+	distro, _ := pkgdb.OSRelease(stack)
+	s := SBOM{Metadata: m, Distro: distro}
+	for _, status := range pkgdb.Check(stack, pkgdb.Read(stack)) {
+		if status.State != pkgdb.StateRemoved {
+			s.Packages = append(s.Packages, status)
+		}
+	}
+
+	seen := map[string]bool{}
+	stack.WalkKept(func(l image.StackLayer, relPath string, d fs.DirEntry) {
+		// the layers are walked from the top, upper files hide lower ones
+		if !d.Type().IsRegular() || seen[relPath] {
+			return
+		}
+		seen[relPath] = true
+		if stack.Lookup(relPath) == -1 {
+			return
+		}
+		if info, err := os.Lstat(filepath.Join(l.Origin, relPath)); err == nil && !image.IsKept(l.Kept, relPath, info) {
+			return
+		}
+		s.Files = append(s.Files, hashFile(filepath.Join(l.Kept, relPath), filepath.ToSlash(relPath)))
+	})
+	sort.Slice(s.Files, func(i, j int) bool {
+		return s.Files[i].Path < s.Files[j].Path
+	})
+	return s
+}
+
+func hashFile(p string, relPath string) File {
+	f, err := os.Open(p)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	h1 := sha1.New()
+	h256 := sha256.New()
+	size, err := io.Copy(io.MultiWriter(h1, h256), f)
+	if err != nil {
+		panic(err)
+	}
+	return File{Path: relPath, Size: size, SHA1: hex.EncodeToString(h1.Sum(nil)), SHA256: hex.EncodeToString(h256.Sum(nil))}
+}
+
+// Purl returns the package url of a package, e.g. pkg:deb/debian/bash@5.2-1?arch=amd64.
+// The distro defaults to debian, alpine and redhat for dpkg, apk and rpm packages.
+func Purl(p pkgdb.Package, distro string) string {
+	typ, defaultDistro := "deb", "debian"
+	switch p.Manager {
+	case pkgdb.Apk:
+		typ, defaultDistro = "apk", "alpine"
+	case pkgdb.Rpm:
+		typ, defaultDistro = "rpm", "redhat"
+	}
+	if distro == "" {
+		distro = defaultDistro
+	}
+	version := p.Version
+	qualifiers := url.Values{}
+	if p.Arch != "" {
+		qualifiers.Set("arch", p.Arch)
+	}
+	// rpm epochs are a qualifier, dpkg epochs are part of the version
+	if epoch, rest, ok := strings.Cut(version, ":"); ok && p.Manager == pkgdb.Rpm {
+		version = rest
+		qualifiers.Set("epoch", epoch)
+	}
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s", typ, url.PathEscape(distro), url.PathEscape(p.Name), strings.ReplaceAll(url.PathEscape(version), ":", "%3A"))
+	if len(qualifiers) > 0 {
+		purl += "?" + qualifiers.Encode()
+	}
+	return purl
+}
+
+// digestHex returns the hex part of a digest such as sha256:abc.
+func digestHex(digest string) string {
+	_, h, _ := strings.Cut(digest, ":")
+	return h
+}
+
+// newUUID returns a random version 4 uuid.
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,107 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package sbom
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image/imagetest"
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+	"github.com/negativa-ai/BLAFS/internal/report"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSBOM creates the SBOM of a stack of two layers with an apk database.
+func newTestSBOM(t *testing.T) SBOM {
+	stack := imagetest.NewStack(t, 2)
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "etc/os-release"), "NAME=\"Alpine Linux\"\nID=alpine\n")
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "lib/apk/db/installed"), "P:musl\nV:1.2.4-r2\nA:x86_64\nL:MIT\nF:lib\nR:libc.so\nR:libm.so\n\n")
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "lib/libc.so"), "libc")
+	imagetest.WriteFile(t, filepath.Join(stack[1].Kept, "lib/libc.so"), "libc")
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "lib/libm.so"), "libm")
+	// placeholder of a file never opened
+	imagetest.WriteFile(t, filepath.Join(stack[1].Kept, "lib/libm.so"), "")
+	imagetest.WriteFile(t, filepath.Join(stack[1].Origin, "app/config"), "old")
+	imagetest.WriteFile(t, filepath.Join(stack[1].Kept, "app/config"), "old")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "app/config"), "new")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Kept, "app/config"), "new")
+
+	return New(stack, report.Metadata{Image: "app:1", OriginalDigest: "sha256:aaaa", DebloatedImage: "app:1-baffs",
+		DebloatedDigest: "sha256:bbbb", Version: "v1.0.0", Time: "2025-01-01T00:00:00Z"})
+}
+
+func TestNew(t *testing.T) {
+	s := newTestSBOM(t)
+	assert.Equal(t, "alpine", s.Distro)
+	assert.Len(t, s.Packages, 1)
+	assert.Equal(t, pkgdb.StatePartlyRemoved, s.Packages[0].State)
+	assert.Equal(t, []File{
+		{Path: "app/config", Size: 3, SHA1: "c2a6b03f190dfb2b4aa91f8af8d477a9bc3401dc", SHA256: "11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437"},
+		{Path: "lib/libc.so", Size: 4, SHA1: "cb9c5e2d56e129ddbf7d7f021e9ecdcc26174648", SHA256: "16c8c6eb85e05438f5d6c60ff9869072a3a3b1618aa1481ac7a0cb049f06f51d"},
+	}, s.Files)
+}
+
+func TestPurl(t *testing.T) {
+	assert.Equal(t, "pkg:deb/debian/libc6@2.36-9?arch=amd64", Purl(pkgdb.Package{Manager: pkgdb.Dpkg, Name: "libc6", Version: "2.36-9", Arch: "amd64"}, ""))
+	assert.Equal(t, "pkg:deb/ubuntu/bash@1%3A5.2?arch=amd64", Purl(pkgdb.Package{Manager: pkgdb.Dpkg, Name: "bash", Version: "1:5.2", Arch: "amd64"}, "ubuntu"))
+	assert.Equal(t, "pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64", Purl(pkgdb.Package{Manager: pkgdb.Apk, Name: "musl", Version: "1.2.4-r2", Arch: "x86_64"}, ""))
+	assert.Equal(t, "pkg:rpm/fedora/bash@5.2-1?arch=x86_64&epoch=1", Purl(pkgdb.Package{Manager: pkgdb.Rpm, Name: "bash", Version: "1:5.2-1", Arch: "x86_64"}, "fedora"))
+}
+
+func TestWriteSPDX(t *testing.T) {
+	s := newTestSBOM(t)
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteSPDX(&buf))
+	var doc spdxDocument
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	assert.Len(t, doc.Packages, 3)
+	assert.Equal(t, []spdxChecksum{{"SHA256", "aaaa"}}, doc.Packages[1].Checksums)
+	assert.Equal(t, "pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64", doc.Packages[2].ExternalRefs[0].ReferenceLocator)
+	assert.Len(t, doc.Files, 2)
+	assert.Equal(t, "./lib/libc.so", doc.Files[1].FileName)
+	assert.Equal(t, []spdxRelationship{
+		{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"},
+		{"SPDXRef-Image", "DESCENDANT_OF", "SPDXRef-OriginalImage"},
+		{"SPDXRef-Image", "CONTAINS", "SPDXRef-Package-0"},
+		{"SPDXRef-Package-0", "CONTAINS", "SPDXRef-File-1"},
+		{"SPDXRef-Image", "CONTAINS", "SPDXRef-File-0"},
+	}, doc.Relationships)
+}
+
+func TestWriteCycloneDX(t *testing.T) {
+	s := newTestSBOM(t)
+	var buf bytes.Buffer
+	assert.NoError(t, s.WriteCycloneDX(&buf))
+	var bom cdxBOM
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &bom))
+	assert.Equal(t, "1.5", bom.SpecVersion)
+	assert.Equal(t, "sha256:bbbb", bom.Metadata.Component.Version)
+	assert.Equal(t, []cdxHash{{"SHA-256", "aaaa"}}, bom.Metadata.Component.Pedigree.Ancestors[0].Hashes)
+	assert.Len(t, bom.Components, 2)
+	assert.Equal(t, "MIT", bom.Components[0].Licenses[0].License.Name)
+	assert.Equal(t, "/lib/libc.so", bom.Components[0].Components[0].Name)
+	assert.Equal(t, "/app/config", bom.Components[1].Name)
+}
@@ -0,0 +1,163 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+const spdxNoAssertion = "NOASSERTION"
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	LicenseComments       string            `json:"licenseComments,omitempty"`
+	SourceInfo            string            `json:"sourceInfo,omitempty"`
+	Comment               string            `json:"comment,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxImage describes a container image by its name and digest.
+func spdxImage(id string, name string, digest string, comment string) spdxPackage {
+	p := spdxPackage{SPDXID: id, Name: name, VersionInfo: digest, DownloadLocation: spdxNoAssertion,
+		LicenseConcluded: spdxNoAssertion, LicenseDeclared: spdxNoAssertion, PrimaryPackagePurpose: "CONTAINER", Comment: comment}
+	if h := digestHex(digest); h != "" {
+		p.Checksums = []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: h}}
+	}
+	return p
+}
+
+// WriteSPDX writes the SBOM as an SPDX 2.3 JSON document.
+// The debloated image is a descendant of the original image, it contains the packages and the files,
+// and packages contain their files present in the image.
+func (s *SBOM) WriteSPDX(w io.Writer) error {
+	m := s.Metadata
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              m.DebloatedImage,
+		DocumentNamespace: fmt.Sprintf("https://github.com/negativa-ai/BLAFS/spdx/%s-%s", url.PathEscape(m.DebloatedImage), newUUID()),
+		CreationInfo:      spdxCreationInfo{Created: m.Time, Creators: []string{"Tool: baffs-" + m.Version}},
+		Packages: []spdxPackage{
+			spdxImage("SPDXRef-Image", m.DebloatedImage, m.DebloatedDigest, "Debloated from "+m.Image),
+			spdxImage("SPDXRef-OriginalImage", m.Image, m.OriginalDigest, ""),
+		},
+		Files: []spdxFile{},
+		Relationships: []spdxRelationship{
+			{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"},
+			{"SPDXRef-Image", "DESCENDANT_OF", "SPDXRef-OriginalImage"},
+		},
+	}
+
+	fileIds := map[string]string{}
+	for i, f := range s.Files {
+		id := fmt.Sprintf("SPDXRef-File-%d", i)
+		fileIds[f.Path] = id
+		doc.Files = append(doc.Files, spdxFile{SPDXID: id, FileName: "./" + f.Path, LicenseConcluded: spdxNoAssertion,
+			Checksums: []spdxChecksum{{"SHA1", f.SHA1}, {"SHA256", f.SHA256}}})
+	}
+
+	inPackage := map[string]bool{}
+	for i, status := range s.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i)
+		p := spdxPackage{SPDXID: id, Name: status.Name, VersionInfo: status.Version, DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion, LicenseDeclared: spdxNoAssertion, PrimaryPackagePurpose: "LIBRARY",
+			Comment:      fmt.Sprintf("%s package, %s: %d files kept, %d removed", status.Manager, status.State, len(status.Kept), len(status.Removed)),
+			ExternalRefs: []spdxExternalRef{{"PACKAGE-MANAGER", "purl", Purl(status.Package, s.Distro)}}}
+		// licenses declared by package managers are not always valid SPDX expressions
+		if status.License != "" {
+			p.LicenseComments = "Declared by " + status.Manager + ": " + status.License
+		}
+		if status.Source != "" && status.Source != status.Name {
+			p.SourceInfo = "built from source package " + status.Source
+		}
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", id})
+		for _, f := range status.Kept {
+			if fileId, ok := fileIds[f]; ok {
+				inPackage[f] = true
+				doc.Relationships = append(doc.Relationships, spdxRelationship{id, "CONTAINS", fileId})
+			}
+		}
+	}
+	for _, f := range s.Files {
+		if !inPackage[f.Path] {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", fileIds[f.Path]})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
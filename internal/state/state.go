@@ -0,0 +1,316 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/negativa-ai/BLAFS/internal/journal"
+)
+
+const stateFile = "state.json"
+
+// Status of an image.
+const (
+	Shadowed  = "shadowed"
+	Debloated = "debloated"
+	Restored  = "restored"
+)
+
+/*
+A DB is the state of the images handled by baffs, stored in {work_dir}/state.json.
+It is the single source of truth about which images are shadowed, it is never inferred from overlay2 paths.
+
+It records each image shadowed, keyed by its original digest, and which images reference each shadow layer,
+so that images sharing layers can be shadowed, debloated and restored in any order.
+Layers are keyed by the name of their original overlay2 directory, i.e., their original cache-id,
+whether the image inspected shows the original or the shadow layer.
+A shadow layer is created when the first image referencing it is shadowed,
+and restored when the last image referencing it is debloated or restored.
+*/
+type DB struct {
+	path   string
+	exists bool
+	Images map[string]*Image   `json:"images"` // by original digest
+	Layers map[string][]string `json:"layers"` // IDs of the images referencing each layer, in lexical order
+}
+
+// An Image is the record of a shadowed image.
+type Image struct {
+	ID         string    `json:"id"`    // original digest
+	Names      []string  `json:"names"` // names the image was handled with
+	Status     string    `json:"status"`
+	ShadowedAt time.Time `json:"shadowed_at"` // start of profiling, zero if shadowed by an older version
+	Backup     string    `json:"backup"`      // original image saved by docker save
+	Layers     []Layer   `json:"layers"`      // from the top layer to the bottom one
+	Export     *Export   `json:"export,omitempty"`
+}
+
+// A Layer is the record of a layer of a shadowed image.
+type Layer struct {
+	Key        string `json:"key"`
+	DiffID     string `json:"diff_id"`
+	Original   string `json:"original"` // original overlay2 directory
+	Shadow     string `json:"shadow"`   // shadow overlay2 directory
+	MountPoint string `json:"mount_point"`
+	MountPID   int    `json:"mount_pid,omitempty"` // debloated_fs process, 0 if not mounted
+}
+
+// An Export is the result of debloating an image.
+type Export struct {
+	Time            time.Time `json:"time"`
+	Tar             string    `json:"tar"`
+	DebloatedImage  string    `json:"debloated_image"`
+	DebloatedDigest string    `json:"debloated_digest"`
+	Outputs         []string  `json:"outputs"` // reports and SBOMs written next to the tar
+}
+
+// Key returns the key of a layer from the name of its original or shadow directory.
+func Key(layerName string) string {
+	return strings.TrimPrefix(layerName, "shadow_")
+}
+
+// Open reads the state in the work dir, an empty state is returned if it does not exist yet.
+func Open(workDir string) (*DB, error) {
+	d := &DB{path: filepath.Join(workDir, stateFile), Images: map[string]*Image{}, Layers: map[string][]string{}}
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.exists = true
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	if d.Images == nil {
+		d.Images = map[string]*Image{}
+	}
+	if d.Layers == nil {
+		d.Layers = map[string][]string{}
+	}
+	return d, nil
+}
+
+// Exists returns false if the state was never saved, e.g., images were shadowed by an older version.
+func (d *DB) Exists() bool {
+	return d.exists
+}
+
+// Save writes the state, the write is recorded in the journal j before it happens.
+func (d *DB) Save(j *journal.Journal) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	j.Record(journal.Write(d.path))
+	if err := os.WriteFile(d.path, data, 0600); err != nil {
+		return err
+	}
+	d.exists = true
+	return nil
+}
+
+// Put adds or replaces the record of an image.
+func (d *DB) Put(img *Image) {
+	d.Images[img.ID] = img
+}
+
+// Image returns the record of an image by its original digest, nil if the image was never shadowed.
+func (d *DB) Image(imgID string) *Image {
+	return d.Images[imgID]
+}
+
+// Sorted returns all image records, by name.
+func (d *DB) Sorted() []*Image {
+	var images []*Image
+	for _, img := range d.Images {
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Name() < images[j].Name()
+	})
+	return images
+}
+
+// Lookup returns the record of an image by one of its names, nil if there is none.
+func (d *DB) Lookup(name string) *Image {
+	for _, img := range d.Sorted() {
+		for _, n := range img.Names {
+			if n == name {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+// SetMountPID records the debloated_fs process mounted on a mount point in all shadowed images.
+func (d *DB) SetMountPID(mountPoint string, pid int) {
+	for _, img := range d.Images {
+		if img.Status != Shadowed {
+			continue
+		}
+		for i := range img.Layers {
+			if img.Layers[i].MountPoint == mountPoint {
+				img.Layers[i].MountPID = pid
+			}
+		}
+	}
+}
+
+// Name returns the first name of an image, its digest if it has none.
+func (img *Image) Name() string {
+	if len(img.Names) > 0 {
+		return img.Names[0]
+	}
+	return img.ID
+}
+
+// AddName records a name of the image.
+func (img *Image) AddName(name string) {
+	for _, n := range img.Names {
+		if n == name {
+			return
+		}
+	}
+	img.Names = append(img.Names, name)
+}
+
+// Acquire adds a reference of an image to a layer. It returns true if the layer had no reference before.
+func (d *DB) Acquire(key string, imgID string) bool {
+	images := d.Layers[key]
+	for _, img := range images {
+		if img == imgID {
+			return false
+		}
+	}
+	d.Layers[key] = append(images, imgID)
+	sort.Strings(d.Layers[key])
+	return len(images) == 0
+}
+
+// Release removes the reference of an image to a layer. It returns true if no image references the layer anymore.
+func (d *DB) Release(key string, imgID string) bool {
+	var images []string
+	for _, img := range d.Layers[key] {
+		if img != imgID {
+			images = append(images, img)
+		}
+	}
+	if len(images) == 0 {
+		delete(d.Layers, key)
+		return true
+	}
+	d.Layers[key] = images
+	return false
+}
+
+// Referencing returns the IDs of the images referencing a layer.
+func (d *DB) Referencing(key string) []string {
+	return d.Layers[key]
+}
+
+// References tells if an image references a layer.
+func (d *DB) References(key string, imgID string) bool {
+	for _, img := range d.Layers[key] {
+		if img == imgID {
+			return true
+		}
+	}
+	return false
+}
+
+// Shared tells if images other than the given one reference a layer.
+func (d *DB) Shared(key string, imgID string) bool {
+	for _, img := range d.Layers[key] {
+		if img != imgID {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSON writes image records as indented json.
+func WriteJSON(w io.Writer, images []*Image) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(images)
+}
+
+// WriteText writes image records in a human readable form.
+func (d *DB) WriteText(w io.Writer, images []*Image) {
+	for i, img := range images {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s  %s  %s\n", img.Name(), img.ID, img.Status)
+		if len(img.Names) > 1 {
+			fmt.Fprintf(w, "  names:       %s\n", strings.Join(img.Names, ", "))
+		}
+		if img.ShadowedAt.IsZero() {
+			fmt.Fprintf(w, "  shadowed at: unknown\n")
+		} else {
+			fmt.Fprintf(w, "  shadowed at: %s\n", img.ShadowedAt.Format(time.RFC3339))
+		}
+		if img.Backup != "" {
+			fmt.Fprintf(w, "  backup:      %s\n", img.Backup)
+		}
+		fmt.Fprintf(w, "  layers:\n")
+		for _, l := range img.Layers {
+			fmt.Fprintf(w, "    %s", l.Key)
+			if img.Status == Shadowed {
+				if l.MountPID != 0 {
+					fmt.Fprintf(w, "  mounted by pid %d", l.MountPID)
+				} else {
+					fmt.Fprintf(w, "  not mounted")
+				}
+			}
+			others := 0
+			for _, id := range d.Referencing(l.Key) {
+				if id != img.ID {
+					others++
+				}
+			}
+			if others > 0 {
+				fmt.Fprintf(w, "  shared with %d images", others)
+			}
+			fmt.Fprintln(w)
+		}
+		if img.Export != nil {
+			fmt.Fprintf(w, "  debloated:   %s  %s at %s\n", img.Export.DebloatedImage, img.Export.DebloatedDigest, img.Export.Time.Format(time.RFC3339))
+			fmt.Fprintf(w, "  tar:         %s\n", img.Export.Tar)
+			for _, output := range img.Export.Outputs {
+				fmt.Fprintf(w, "  output:      %s\n", output)
+			}
+		}
+	}
+}
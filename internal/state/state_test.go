@@ -0,0 +1,115 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package state
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayers(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open(dir)
+	assert.NoError(t, err)
+	assert.False(t, d.Exists())
+
+	assert.Equal(t, "abc", Key("shadow_abc"))
+	assert.Equal(t, "abc", Key("abc"))
+
+	// base is shared by both images
+	assert.True(t, d.Acquire("base", "sha256:1"))
+	assert.True(t, d.Acquire("top1", "sha256:1"))
+	assert.False(t, d.Acquire("base", "sha256:2"))
+	assert.True(t, d.Acquire("top2", "sha256:2"))
+	assert.False(t, d.Acquire("base", "sha256:2"))
+	assert.Equal(t, []string{"sha256:1", "sha256:2"}, d.Referencing("base"))
+	assert.True(t, d.Shared("base", "sha256:1"))
+	assert.False(t, d.Shared("top1", "sha256:1"))
+	assert.True(t, d.References("top2", "sha256:2"))
+	assert.False(t, d.References("top2", "sha256:1"))
+
+	assert.NoError(t, d.Save(nil))
+	d, err = Open(dir)
+	assert.NoError(t, err)
+	assert.True(t, d.Exists())
+	assert.Equal(t, []string{"sha256:1", "sha256:2"}, d.Referencing("base"))
+
+	assert.False(t, d.Release("base", "sha256:1"))
+	assert.True(t, d.Release("top1", "sha256:1"))
+	assert.True(t, d.Release("base", "sha256:2"))
+	// releasing a layer never acquired is releasing its last reference
+	assert.True(t, d.Release("unknown", "sha256:1"))
+	assert.Equal(t, map[string][]string{"top2": {"sha256:2"}}, d.Layers)
+}
+
+func TestImages(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open(dir)
+	assert.NoError(t, err)
+
+	shadowedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	d.Put(&Image{ID: "sha256:2", Names: []string{"redis:7"}, Status: Shadowed, ShadowedAt: shadowedAt,
+		Layers: []Layer{{Key: "top", MountPoint: "/overlay2/shadow_top/diff"}, {Key: "base", MountPoint: "/overlay2/shadow_base/diff"}}})
+	d.Put(&Image{ID: "sha256:1", Names: []string{"nginx:1"}, Status: Debloated,
+		Layers: []Layer{{Key: "base", MountPoint: "/overlay2/shadow_base/diff"}}, Export: &Export{Tar: "/tmp/nginx_1.tar.debloated"}})
+	d.Put(&Image{ID: "sha256:3"})
+
+	// only the layers of shadowed images are mounted
+	d.SetMountPID("/overlay2/shadow_base/diff", 42)
+	assert.Equal(t, 42, d.Image("sha256:2").Layers[1].MountPID)
+	assert.Equal(t, 0, d.Image("sha256:1").Layers[0].MountPID)
+
+	d.Image("sha256:2").AddName("redis:latest")
+	d.Image("sha256:2").AddName("redis:7")
+	assert.Equal(t, []string{"redis:7", "redis:latest"}, d.Image("sha256:2").Names)
+	assert.Nil(t, d.Image("sha256:4"))
+	assert.Equal(t, "sha256:2", d.Lookup("redis:latest").ID)
+	assert.Nil(t, d.Lookup("redis:6"))
+
+	var names []string
+	for _, img := range d.Sorted() {
+		names = append(names, img.Name())
+	}
+	assert.Equal(t, []string{"nginx:1", "redis:7", "sha256:3"}, names)
+
+	d.Acquire("top", "sha256:2")
+	d.Acquire("base", "sha256:2")
+	d.Acquire("base", "sha256:4")
+	var b bytes.Buffer
+	d.WriteText(&b, []*Image{d.Image("sha256:2")})
+	assert.Equal(t, `redis:7  sha256:2  shadowed
+  names:       redis:7, redis:latest
+  shadowed at: 2025-01-02T03:04:05Z
+  layers:
+    top  not mounted
+    base  mounted by pid 42  shared with 1 images
+`, b.String())
+
+	assert.NoError(t, d.Save(nil))
+	d, err = Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, shadowedAt, d.Image("sha256:2").ShadowedAt)
+	assert.Equal(t, "/tmp/nginx_1.tar.debloated", d.Image("sha256:1").Export.Tar)
+}
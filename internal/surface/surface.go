@@ -0,0 +1,220 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package surface
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/util"
+)
+
+// Categories of files that widen the attack surface of an image.
+const (
+	Shell          = "shell"
+	Interpreter    = "interpreter"
+	PackageManager = "package-manager"
+	Compiler       = "compiler"
+	NetworkTool    = "network-tool"
+	Setuid         = "setuid"
+	Setgid         = "setgid"
+)
+
+// Categories lists all categories in the order they are reported.
+var Categories = []string{Shell, Interpreter, PackageManager, Compiler, NetworkTool, Setuid, Setgid}
+
+// names matches the base names of executables of each category, versioned names such as python3.11 included.
+var names = map[string]*regexp.Regexp{
+	Shell:          regexp.MustCompile(`^(sh|bash|dash|ash|zsh|ksh|mksh|pdksh|csh|tcsh|fish|rbash|busybox|toybox)$`),
+	Interpreter:    regexp.MustCompile(`^(python[0-9.]*|perl[0-9.]*|ruby[0-9.]*|irb[0-9.]*|node|nodejs|php[0-9.]*|lua[0-9.]*|luajit|tclsh[0-9.]*|wish[0-9.]*|java|jshell|awk|gawk|mawk|nawk|Rscript|guile[0-9.]*|bun|deno)$`),
+	PackageManager: regexp.MustCompile(`^(apt|apt-get|apt-cache|aptitude|dpkg|dpkg-deb|apk|rpm|yum|dnf|microdnf|tdnf|zypper|pacman|pip[0-9.]*|easy_install[0-9.]*|npm|npx|yarn|pnpm|gem|bundle|composer|conda|mamba)$`),
+	Compiler:       regexp.MustCompile(`^(cc|c\+\+|cpp|gcc|g\+\+|gcc-[0-9.]+|g\+\+-[0-9.]+|.+-linux-gnu-(gcc|g\+\+|cpp)(-[0-9.]+)?|clang|clang\+\+|clang-[0-9.]+|tcc|ld|ld\.bfd|ld\.gold|ld\.lld|as|make|gmake|cmake|ninja|go|gofmt|rustc|cargo|javac|gfortran|cc1|cc1plus|collect2)$`),
+	NetworkTool:    regexp.MustCompile(`^(curl|wget|nc|netcat|ncat|nc\.openbsd|nc\.traditional|socat|ssh|scp|sftp|sshd|telnet|ftp|tftp|nmap|ping|ping6|ip|ifconfig|route|netstat|ss|tcpdump|dig|nslookup|host|rsync|openssl)$`),
+}
+
+// A Category lists the files of a category in the original image, and those kept in the debloated image.
+type Category struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+	Kept  []string `json:"kept"`
+}
+
+// A Surface classifies the executables of an image by category.
+type Surface struct {
+	Categories []Category `json:"categories"` // in the order of Categories
+}
+
+// Classify tags the files of the merged original layers of a stack by category, from their base names,
+// ELF headers or shebangs, and setuid and setgid bits. Symlinks are tagged by their own names,
+// e.g. python3 -> python3.11, if they point to an executable. A path may belong to several categories.
+func Classify(stack image.LayerStack) Surface {
+	found := map[string][]string{}
+	for i, l := range stack {
+		if err := filepath.WalkDir(l.Origin, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(l.Origin, p)
+			if err != nil {
+				return err
+			}
+			if relPath == "." || d.IsDir() || stack.Lookup(relPath) != i {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if util.IsWhiteout(info) {
+				return nil
+			}
+			name := filepath.ToSlash(relPath)
+			for _, c := range classify(stack, name, info) {
+				found[c] = append(found[c], name)
+			}
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+	}
+
+	var s Surface
+	for _, name := range Categories {
+		c := Category{Name: name, Files: []string{}, Kept: []string{}}
+		sort.Strings(found[name])
+		for _, f := range found[name] {
+			c.Files = append(c.Files, f)
+			// a symlink is kept only if the link itself is, not its target
+			l := stack.Lookup(f)
+			if l < 0 {
+				continue
+			}
+			info, err := os.Lstat(filepath.Join(stack[l].Origin, f))
+			if err == nil && image.IsKept(stack[l].Kept, f, info) {
+				c.Kept = append(c.Kept, f)
+			}
+		}
+		s.Categories = append(s.Categories, c)
+	}
+	return s
+}
+
+// classify returns the categories of a file of the merged view.
+func classify(stack image.LayerStack, name string, info os.FileInfo) []string {
+	var categories []string
+	if info.Mode().IsRegular() {
+		if info.Mode()&os.ModeSetuid != 0 {
+			categories = append(categories, Setuid)
+		}
+		if info.Mode()&os.ModeSetgid != 0 {
+			categories = append(categories, Setgid)
+		}
+	} else if info.Mode()&os.ModeSymlink == 0 {
+		return categories
+	}
+
+	base := path.Base(name)
+	matched := false
+	for _, c := range Categories {
+		if re, ok := names[c]; ok && re.MatchString(base) {
+			matched = true
+		}
+	}
+	// compilers keep their internal executables, such as cc1, in versioned directories
+	inCompilerDir := strings.HasPrefix(name, "usr/lib/gcc/") || strings.HasPrefix(name, "usr/libexec/gcc/")
+	if (!matched && !inCompilerDir) || !isExecutable(stack, name) {
+		return categories
+	}
+	for _, c := range Categories {
+		if re, ok := names[c]; ok && re.MatchString(base) {
+			categories = append(categories, c)
+		}
+	}
+	if inCompilerDir && !matched {
+		categories = append(categories, Compiler)
+	}
+	return categories
+}
+
+// isExecutable tells if a path of the merged view resolves to a regular file with an executable bit,
+// that is an ELF file or a script with a shebang.
+func isExecutable(stack image.LayerStack, name string) bool {
+	realPath, ok := stack.Realpath(name)
+	if !ok {
+		return false
+	}
+	originPath, ok := stack.OriginPath(realPath)
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(originPath)
+	if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+		return false
+	}
+	f, err := os.Open(originPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("\x7fELF")) || bytes.HasPrefix(magic, []byte("#!"))
+}
+
+// WriteJSON writes the surface as indented JSON.
+func (s *Surface) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// Summary returns one line per category found in the original image, e.g. "shell: 1 of 3 kept (bin/sh)".
+func (s *Surface) Summary() []string {
+	var lines []string
+	for _, c := range s.Categories {
+		if len(c.Files) == 0 {
+			continue
+		}
+		line := fmt.Sprintf("%s: %d of %d kept", c.Name, len(c.Kept), len(c.Files))
+		if len(c.Kept) > 0 {
+			kept := c.Kept
+			if len(kept) > 5 {
+				kept = append(kept[:5:5], "...")
+			}
+			line += " (" + strings.Join(kept, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,89 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package surface
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image/imagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestFile writes a file with the given mode.
+func writeTestFile(t *testing.T, path string, content string, perm os.FileMode) {
+	imagetest.WriteFile(t, path, content)
+	assert.NoError(t, os.Chmod(path, perm))
+}
+
+func TestClassify(t *testing.T) {
+	stack := imagetest.NewStack(t, 1)
+	origin := func(name string) string { return filepath.Join(stack[0].Origin, name) }
+	kept := func(name string) string { return filepath.Join(stack[0].Kept, name) }
+
+	writeTestFile(t, origin("bin/dash"), "\x7fELF....", 0755)
+	writeTestFile(t, kept("bin/dash"), "\x7fELF....", 0755)
+	assert.NoError(t, os.Symlink("dash", origin("bin/sh")))
+	assert.NoError(t, os.Symlink("dash", kept("bin/sh")))
+	// a removed symlink to a kept file is not kept
+	assert.NoError(t, os.Symlink("dash", origin("bin/ash")))
+	writeTestFile(t, origin("bin/bash"), "\x7fELF....", 0755)
+	writeTestFile(t, origin("usr/bin/python3.11"), "\x7fELF....", 0755)
+	assert.NoError(t, os.Symlink("python3.11", origin("usr/bin/python3")))
+	writeTestFile(t, origin("usr/bin/pip3"), "#!/usr/bin/python3\n", 0755)
+	writeTestFile(t, origin("usr/lib/gcc/x86_64-linux-gnu/12/cc1"), "\x7fELF....", 0755)
+	writeTestFile(t, origin("usr/bin/curl"), "\x7fELF....", 0755)
+	writeTestFile(t, kept("usr/bin/curl"), "", 0755)
+	writeTestFile(t, origin("usr/bin/passwd"), "\x7fELF....", 0755|os.ModeSetuid)
+	writeTestFile(t, kept("usr/bin/passwd"), "\x7fELF....", 0755|os.ModeSetuid)
+	// not executable, or not a program
+	writeTestFile(t, origin("usr/share/doc/bash"), "doc", 0644)
+	writeTestFile(t, origin("usr/lib/go"), "data", 0755)
+
+	s := Classify(stack)
+	files := map[string][]string{}
+	keptFiles := map[string][]string{}
+	for _, c := range s.Categories {
+		files[c.Name] = c.Files
+		keptFiles[c.Name] = c.Kept
+	}
+	assert.Equal(t, []string{"bin/ash", "bin/bash", "bin/dash", "bin/sh"}, files[Shell])
+	assert.Equal(t, []string{"bin/dash", "bin/sh"}, keptFiles[Shell])
+	assert.Equal(t, []string{"usr/bin/python3", "usr/bin/python3.11"}, files[Interpreter])
+	assert.Equal(t, []string{"usr/bin/pip3"}, files[PackageManager])
+	assert.Equal(t, []string{"usr/lib/gcc/x86_64-linux-gnu/12/cc1"}, files[Compiler])
+	// an empty placeholder is not kept
+	assert.Equal(t, []string{"usr/bin/curl"}, files[NetworkTool])
+	assert.Equal(t, []string{}, keptFiles[NetworkTool])
+	assert.Equal(t, []string{"usr/bin/passwd"}, keptFiles[Setuid])
+	assert.Equal(t, []string{}, files[Setgid])
+
+	assert.Equal(t, []string{
+		"shell: 2 of 4 kept (bin/dash, bin/sh)",
+		"interpreter: 0 of 2 kept",
+		"package-manager: 0 of 1 kept",
+		"compiler: 0 of 1 kept",
+		"network-tool: 0 of 1 kept",
+		"setuid: 1 of 1 kept (usr/bin/passwd)",
+	}, s.Summary())
+}
@@ -29,7 +29,13 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // PathExist checks if a path exists
@@ -96,73 +102,377 @@ func Sha256Sum(file string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
+// Whiteouts of the Docker layer format.
+// See: https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+const (
+	WhiteoutPrefix    = ".wh."
+	WhiteoutOpaqueDir = ".wh..wh..opq"
+)
+
+// xattrs that mark an overlay directory as opaque
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// IsWhiteout returns true if the file is an overlay whiteout, i.e., a 0/0 character device.
+func IsWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// IsOpaqueDir returns true if the directory is marked as opaque by overlay.
+func IsOpaqueDir(path string) bool {
+	buf := make([]byte, 1)
+	for _, name := range opaqueXattrs {
+		if n, err := unix.Lgetxattr(path, name, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// whiteoutHeader converts the header of an overlay whiteout to a `.wh.{name}` entry.
+func whiteoutHeader(header *tar.Header) *tar.Header {
+	dir, base := path.Split(header.Name)
+	return &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       dir + WhiteoutPrefix + base,
+		Mode:       0600,
+		Uid:        header.Uid,
+		Gid:        header.Gid,
+		ModTime:    header.ModTime,
+		AccessTime: header.AccessTime,
+		ChangeTime: header.ChangeTime,
+	}
+}
+
+// opaqueHeader returns the `.wh..wh..opq` entry of an opaque directory.
+func opaqueHeader(dirHeader *tar.Header) *tar.Header {
+	return &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       path.Join(dirHeader.Name, WhiteoutOpaqueDir),
+		Mode:       dirHeader.Mode & int64(os.ModePerm),
+		Uid:        dirHeader.Uid,
+		Gid:        dirHeader.Gid,
+		ModTime:    dirHeader.ModTime,
+		AccessTime: dirHeader.AccessTime,
+		ChangeTime: dirHeader.ChangeTime,
+	}
+}
+
 // TarFiles creates a tar archive from a directory
 func TarFiles(sourceDir string, destFile string) {
-	// Open the destination file for writing
-	dest, err := os.Create(destFile)
+	TarLayer(sourceDir, "", destFile)
+}
+
+// an inode identifies hardlinked files
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// A layerWriter writes the entries of a layer tar archive.
+type layerWriter struct {
+	tw      *tar.Writer
+	written map[string]bool  // names of all entries written so far
+	links   map[inode]string // name of the first entry of each hardlinked inode
+}
+
+func (w *layerWriter) writeHeader(header *tar.Header) error {
+	w.written[header.Name] = true
+	return w.tw.WriteHeader(header)
+}
+
+// isOverlayXattr returns true if the xattr is private to overlay and must not be archived.
+func isOverlayXattr(name string) bool {
+	return strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.")
+}
+
+// readXattrs returns the extended attributes of a file, without following symlinks.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
 	if err != nil {
-		panic(err)
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
 	}
-	defer dest.Close()
-
-	// Create a new tar writer using the destination file
-	tw := tar.NewWriter(dest)
-	defer tw.Close()
 
-	// Walk through the source directory and add each file to the tar archive
-	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+	xattrs := map[string]string{}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" || isOverlayXattr(name) {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(path, name, nil)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
+
+// metaSource returns the path and info of the file that the metadata of an entry is taken from.
+// It is the file at the same relative path of originDir if it has the same type, otherwise the file itself.
+func metaSource(path string, info os.FileInfo, originDir string, relPath string) (string, os.FileInfo) {
+	if originDir == "" {
+		return path, info
+	}
+	originPath := filepath.Join(originDir, relPath)
+	originInfo, err := os.Lstat(originPath)
+	if err != nil || originInfo.Mode().Type() != info.Mode().Type() {
+		return path, info
+	}
+	return originPath, originInfo
+}
+
+// fileHeader creates the header of an entry, whose type and size come from info of path,
+// and whose ownership, permissions, times and xattrs come from metaInfo of metaPath.
+func fileHeader(path string, info os.FileInfo, metaPath string, metaInfo os.FileInfo, name string) (*tar.Header, error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
 		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
 
-		// Create a new header for the file
+	header.Mode = int64(metaInfo.Mode().Perm())
+	if metaInfo.Mode()&os.ModeSetuid != 0 {
+		header.Mode |= 04000
+	}
+	if metaInfo.Mode()&os.ModeSetgid != 0 {
+		header.Mode |= 02000
+	}
+	if metaInfo.Mode()&os.ModeSticky != 0 {
+		header.Mode |= 01000
+	}
+	header.ModTime = metaInfo.ModTime()
+	if stat, ok := metaInfo.Sys().(*syscall.Stat_t); ok {
+		header.Uid = int(stat.Uid)
+		header.Gid = int(stat.Gid)
+	}
+	// numeric ownership only, names of the host are meaningless in an image
+	header.Uname = ""
+	header.Gname = ""
+
+	xattrs, err := readXattrs(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords["SCHILY.xattr."+k] = v
+	}
+	return header, nil
+}
+
+// linkTarget returns the name of the first entry of a hardlinked file, or "" if the file is not written yet.
+// The inode is taken from metaInfo, so that files hardlinked in the original layer stay hardlinked.
+func (w *layerWriter) linkTarget(metaInfo os.FileInfo, name string) string {
+	stat, ok := metaInfo.Sys().(*syscall.Stat_t)
+	if !ok || !metaInfo.Mode().IsRegular() || stat.Nlink < 2 {
+		return ""
+	}
+	key := inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+	if target, ok := w.links[key]; ok {
+		return target
+	}
+	w.links[key] = name
+	return ""
+}
+
+// writeFile writes a single file of the source directory.
+func (w *layerWriter) writeFile(path string, info os.FileInfo, relPath string, originDir string) error {
+	name := filepath.ToSlash(relPath)
+
+	// Handle overlay whiteouts
+	if IsWhiteout(info) {
 		header, err := tar.FileInfoHeader(info, "")
 		if err != nil {
 			return err
 		}
+		header.Name = name
+		return w.writeHeader(whiteoutHeader(header))
+	}
 
-		// Set the name of the header to the relative path of the file within the source directory
-		relPath, err := filepath.Rel(sourceDir, path)
+	// Sockets are created by running processes, they can not be archived
+	if info.Mode()&os.ModeSocket != 0 {
+		log.Debug("Skip socket: ", path)
+		return nil
+	}
+
+	metaPath, metaInfo := metaSource(path, info, originDir, relPath)
+	header, err := fileHeader(path, info, metaPath, metaInfo, name)
+	if err != nil {
+		return err
+	}
+
+	// Handle hardlinks
+	if target := w.linkTarget(metaInfo, name); target != "" {
+		header.Typeflag = tar.TypeLink
+		header.Linkname = target
+		header.Size = 0
+		return w.writeHeader(header)
+	}
+
+	// The content of a hardlinked file is taken from the original layer,
+	// as only one of its names might be copied completely to the source directory
+	contentPath := path
+	if metaPath != path && info.Mode().IsRegular() && metaInfo.Size() != info.Size() {
+		if stat, ok := metaInfo.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			contentPath = metaPath
+			header.Size = metaInfo.Size()
+		}
+	}
+
+	// Write the header to the tar archive
+	if err := w.writeHeader(header); err != nil {
+		return err
+	}
+
+	// Handle overlay opaque directories, the root of a layer can not be opaque
+	if info.IsDir() && relPath != "." && IsOpaqueDir(path) {
+		return w.writeHeader(opaqueHeader(header))
+	}
+
+	// If the file is a regular file, write its contents to the tar archive
+	if info.Mode().IsRegular() {
+		src, err := os.Open(contentPath)
 		if err != nil {
 			return err
 		}
-		header.Name = filepath.ToSlash(relPath)
+		defer src.Close()
 
-		// Handle symbolic links
-		if info.Mode()&os.ModeSymlink != 0 {
-			link, err := os.Readlink(path)
-			if err != nil {
-				return err
-			}
-			header.Linkname = link
-			header.Typeflag = tar.TypeSymlink
-			if err := tw.WriteHeader(header); err != nil {
-				return err
-			}
-			return nil
+		if _, err := io.Copy(w.tw, src); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// writeOriginFile writes a file of the original layer that has no content to be accessed,
+// i.e., whiteouts, opaque directories, FIFOs and device nodes, if it is missing in the source directory.
+func (w *layerWriter) writeOriginFile(path string, info os.FileInfo, relPath string) error {
+	name := filepath.ToSlash(relPath)
 
-		// Write the header to the tar archive
-		if err := tw.WriteHeader(header); err != nil {
+	if IsWhiteout(info) {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
 			return err
 		}
+		header.Name = name
+		wh := whiteoutHeader(header)
+		if !w.written[wh.Name] {
+			return w.writeHeader(wh)
+		}
+		return nil
+	}
 
-		// If the file is a regular file or a directory, write its contents to the tar archive
-		if info.Mode().IsRegular() {
-			src, err := os.Open(path)
-			if err != nil {
+	if info.IsDir() && IsOpaqueDir(path) {
+		header, err := fileHeader(path, info, path, info, name)
+		if err != nil {
+			return err
+		}
+		opq := opaqueHeader(header)
+		if w.written[opq.Name] {
+			return nil
+		}
+		if !w.written[header.Name] {
+			if err := w.writeHeader(header); err != nil {
 				return err
 			}
-			defer src.Close()
+		}
+		return w.writeHeader(opq)
+	}
 
-			if _, err := io.Copy(tw, src); err != nil {
-				return err
-			}
+	if info.Mode()&(os.ModeNamedPipe|os.ModeDevice) != 0 && !w.written[name] {
+		header, err := fileHeader(path, info, path, info, name)
+		if err != nil {
+			return err
 		}
+		return w.writeHeader(header)
+	}
+	return nil
+}
 
-		return nil
+// TarLayer creates a layer tar archive from an overlay diff directory.
+// Overlay whiteouts and opaque directories are converted to the whiteout files of the Docker layer format.
+// Extended attributes, e.g., file capabilities, are archived as PAX records, and hardlinks as link entries.
+//
+// If originDir is not empty, it is the original layer that sourceDir is debloated from:
+// the ownership, permissions, times, xattrs and hardlinks of each file are taken from originDir,
+// and whiteouts, opaque directories, FIFOs and device nodes of originDir that are missing in sourceDir are added,
+// so that files deleted by the original layer stay deleted.
+func TarLayer(sourceDir string, originDir string, destFile string) {
+	// Open the destination file for writing
+	dest, err := os.Create(destFile)
+	if err != nil {
+		panic(err)
+	}
+	defer dest.Close()
+
+	// Create a new tar writer using the destination file
+	tw := tar.NewWriter(dest)
+	defer tw.Close()
+	w := &layerWriter{tw: tw, written: map[string]bool{}, links: map[inode]string{}}
+
+	// Walk through the source directory and add each file to the tar archive
+	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Set the name of the header to the relative path of the file within the source directory
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		return w.writeFile(path, info, relPath, originDir)
 	})
+	if err != nil {
+		panic(err)
+	}
+
+	if originDir == "" {
+		return
+	}
 
+	// Add files of the original layer that have no content to be accessed
+	err = filepath.Walk(originDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(originDir, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		return w.writeOriginFile(path, info, relPath)
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,174 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// tarEntries returns the headers of all entries in a tar file, keyed by name.
+func tarEntries(t *testing.T, tarPath string) map[string]*tar.Header {
+	f, err := os.Open(tarPath)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	entries := map[string]*tar.Header{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		entries[header.Name] = header
+	}
+	return entries
+}
+
+// mkWhiteout creates an overlay whiteout, it skips the test if not permitted.
+func mkWhiteout(t *testing.T, path string) {
+	if err := unix.Mknod(path, unix.S_IFCHR, 0); err != nil {
+		t.Skip("cannot create whiteout: ", err)
+	}
+}
+
+// mkOpaque marks a directory as opaque, it skips the test if not permitted.
+func mkOpaque(t *testing.T, path string) {
+	if err := unix.Setxattr(path, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skip("cannot set opaque xattr: ", err)
+	}
+}
+
+func TestTarFiles(t *testing.T) {
+	src := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "etc"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "etc", "hosts"), []byte("127.0.0.1"), 0644))
+	assert.NoError(t, os.Symlink("hosts", filepath.Join(src, "etc", "hosts.link")))
+	dest := filepath.Join(t.TempDir(), "layer.tar")
+
+	TarFiles(src, dest)
+
+	entries := tarEntries(t, dest)
+	assert.Equal(t, int64(9), entries["etc/hosts"].Size)
+	assert.Equal(t, byte(tar.TypeSymlink), entries["etc/hosts.link"].Typeflag)
+	assert.Equal(t, "hosts", entries["etc/hosts.link"].Linkname)
+}
+
+func TestTarLayerConvertsWhiteouts(t *testing.T) {
+	src := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "etc"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "opaque"), 0755))
+	mkWhiteout(t, filepath.Join(src, "etc", "deleted"))
+	mkOpaque(t, filepath.Join(src, "opaque"))
+	dest := filepath.Join(t.TempDir(), "layer.tar")
+
+	TarFiles(src, dest)
+
+	entries := tarEntries(t, dest)
+	assert.NotContains(t, entries, "etc/deleted")
+	assert.Equal(t, byte(tar.TypeReg), entries["etc/.wh.deleted"].Typeflag)
+	assert.Equal(t, int64(0), entries["etc/.wh.deleted"].Size)
+	assert.Equal(t, byte(tar.TypeReg), entries["opaque/.wh..wh..opq"].Typeflag)
+}
+
+func TestTarLayerKeepsOriginWhiteouts(t *testing.T) {
+	src := t.TempDir()
+	origin := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "etc"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(origin, "etc"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(origin, "var", "cache"), 0755))
+	mkWhiteout(t, filepath.Join(origin, "etc", "deleted"))
+	mkOpaque(t, filepath.Join(origin, "var", "cache"))
+	dest := filepath.Join(t.TempDir(), "layer.tar")
+
+	TarLayer(src, origin, dest)
+
+	entries := tarEntries(t, dest)
+	assert.Contains(t, entries, "etc/.wh.deleted")
+	assert.Equal(t, byte(tar.TypeDir), entries["var/cache/"].Typeflag)
+	assert.Contains(t, entries, "var/cache/.wh..wh..opq")
+}
+
+func TestTarLayerKeepsOriginMetadata(t *testing.T) {
+	src := t.TempDir()
+	origin := t.TempDir()
+	for _, dir := range []string{src, origin} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "bin", "ping"), []byte("ping"), 0755))
+	}
+	if err := os.Lchown(filepath.Join(origin, "bin", "ping"), 1000, 1001); err != nil {
+		t.Skip("cannot change owner: ", err)
+	}
+	// cap_net_raw+ep
+	capability := []byte{1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if err := unix.Lsetxattr(filepath.Join(origin, "bin", "ping"), "security.capability", capability, 0); err != nil {
+		t.Skip("cannot set capability xattr: ", err)
+	}
+	dest := filepath.Join(t.TempDir(), "layer.tar")
+
+	TarLayer(src, origin, dest)
+
+	entries := tarEntries(t, dest)
+	ping := entries["bin/ping"]
+	assert.Equal(t, 1000, ping.Uid)
+	assert.Equal(t, 1001, ping.Gid)
+	assert.Equal(t, "", ping.Uname)
+	assert.Equal(t, string(capability), ping.PAXRecords["SCHILY.xattr.security.capability"])
+}
+
+func TestTarLayerKeepsHardlinks(t *testing.T) {
+	src := t.TempDir()
+	origin := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(origin, "a"), []byte("content"), 0644))
+	assert.NoError(t, os.Link(filepath.Join(origin, "a"), filepath.Join(origin, "b")))
+	// only b is accessed, a is an empty placeholder in the source directory
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "a"), []byte(""), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "b"), []byte("content"), 0644))
+	dest := filepath.Join(t.TempDir(), "layer.tar")
+
+	TarLayer(src, origin, dest)
+
+	entries := tarEntries(t, dest)
+	assert.Equal(t, byte(tar.TypeReg), entries["a"].Typeflag)
+	assert.Equal(t, int64(len("content")), entries["a"].Size)
+	assert.Equal(t, byte(tar.TypeLink), entries["b"].Typeflag)
+	assert.Equal(t, "a", entries["b"].Linkname)
+}
+
+func TestTarLayerKeepsOriginFifo(t *testing.T) {
+	src := t.TempDir()
+	origin := t.TempDir()
+	assert.NoError(t, unix.Mkfifo(filepath.Join(origin, "fifo"), 0600))
+	dest := filepath.Join(t.TempDir(), "layer.tar")
+
+	TarLayer(src, origin, dest)
+
+	entries := tarEntries(t, dest)
+	assert.Equal(t, byte(tar.TypeFifo), entries["fifo"].Typeflag)
+}
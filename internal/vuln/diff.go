@@ -0,0 +1,130 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package vuln
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+)
+
+// A Match is a vulnerability affecting a package of the original image.
+type Match struct {
+	ID           string   `json:"id"`
+	Aliases      []string `json:"aliases,omitempty"`
+	Summary      string   `json:"summary,omitempty"`
+	Manager      string   `json:"manager"`
+	Package      string   `json:"package"`
+	Version      string   `json:"version"`
+	State        string   `json:"state"` // state of the package in the debloated image
+	KeptFiles    int      `json:"kept_files"`
+	RemovedFiles int      `json:"removed_files"`
+	Reachable    bool     `json:"reachable"` // files of the package are still present in the debloated image
+}
+
+// A Diff compares the vulnerabilities of an original image with those still reachable in its debloated image.
+// Vulnerabilities are counted once per CVE, whatever the number of advisories and packages matching them.
+type Diff struct {
+	Image       string  `json:"image"`
+	OS          OS      `json:"os"`
+	Packages    int     `json:"packages"`
+	Original    int     `json:"original"`    // vulnerabilities affecting the original image
+	Debloated   int     `json:"debloated"`   // vulnerabilities still reachable in the debloated image
+	Unreachable int     `json:"unreachable"` // vulnerabilities whose packages are fully removed
+	Matches     []Match `json:"matches"`
+}
+
+// New matches vulnerabilities against the packages of the original layers of a stack,
+// and checks which of them are still present in the kept dirs.
+// A vulnerability is no longer reachable only if all the files of all the packages it affects are removed,
+// as advisories do not tell which files of a package are vulnerable.
+func New(imgName string, stack image.LayerStack, vulns []Vuln) Diff {
+	id, versionId := pkgdb.OSRelease(stack)
+	d := Diff{Image: imgName, OS: OS{ID: id, VersionID: versionId}}
+	statuses := pkgdb.Check(stack, pkgdb.Read(stack))
+	d.Packages = len(statuses)
+
+	reachable := map[string]bool{}
+	for _, v := range vulns {
+		for _, s := range statuses {
+			if !v.Affects(s.Package, d.OS) {
+				continue
+			}
+			m := Match{ID: v.ID, Aliases: v.Aliases, Summary: v.Summary, Manager: s.Manager, Package: s.ID(), Version: s.Version,
+				State: s.State, KeptFiles: len(s.Kept), RemovedFiles: len(s.Removed), Reachable: s.State != pkgdb.StateRemoved}
+			d.Matches = append(d.Matches, m)
+			reachable[v.Key()] = reachable[v.Key()] || m.Reachable
+		}
+	}
+	for _, r := range reachable {
+		d.Original++
+		if r {
+			d.Debloated++
+		} else {
+			d.Unreachable++
+		}
+	}
+	sort.SliceStable(d.Matches, func(i, j int) bool {
+		if d.Matches[i].Reachable != d.Matches[j].Reachable {
+			return !d.Matches[i].Reachable
+		}
+		return d.Matches[i].ID < d.Matches[j].ID
+	})
+	return d
+}
+
+// WriteJSON writes the diff as indented JSON.
+func (d *Diff) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// WriteText writes the diff as a human-readable summary, followed by the vulnerabilities of each package.
+func (d *Diff) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Image: %s\n", d.Image)
+	if d.OS.ID != "" {
+		fmt.Fprintf(w, "OS: %s %s\n", d.OS.ID, d.OS.VersionID)
+	}
+	fmt.Fprintf(w, "Packages: %d\n", d.Packages)
+	percent := 0.0
+	if d.Original > 0 {
+		percent = float64(d.Unreachable) / float64(d.Original) * 100
+	}
+	fmt.Fprintf(w, "Vulnerabilities: %d in the original image, %d still reachable, %d no longer reachable (%.1f%%)\n",
+		d.Original, d.Debloated, d.Unreachable, percent)
+	if len(d.Matches) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%-24s %-40s %-30s %-15s %s\n", "ID", "PACKAGE", "VERSION", "STATE", "REACHABLE")
+	for _, m := range d.Matches {
+		reachable := "no"
+		if m.Reachable {
+			reachable = "yes"
+		}
+		fmt.Fprintf(w, "%-24s %-40s %-30s %-15s %s\n", m.ID, m.Package, m.Version, m.State, reachable)
+	}
+}
@@ -0,0 +1,246 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package vuln
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+)
+
+// A Vuln is a vulnerability in the OSV format, see https://ossf.github.io/osv-schema/.
+// Only the fields needed to match packages are parsed.
+type Vuln struct {
+	ID        string     `json:"id"`
+	Aliases   []string   `json:"aliases,omitempty"`
+	Summary   string     `json:"summary,omitempty"`
+	Withdrawn string     `json:"withdrawn,omitempty"`
+	Affected  []Affected `json:"affected,omitempty"`
+}
+
+// Affected lists the affected versions of a package.
+type Affected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges   []Range  `json:"ranges,omitempty"`
+	Versions []string `json:"versions,omitempty"`
+}
+
+// A Range is a list of events that introduce and fix a vulnerability, in the order of versions.
+type Range struct {
+	Type   string  `json:"type"`
+	Events []Event `json:"events"`
+}
+
+// An Event is one of the versions of a range, exactly one of its fields is set.
+type Event struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+	Limit        string `json:"limit,omitempty"`
+}
+
+// Key returns the CVE id of a vulnerability if it has one, so that advisories of the same CVE are counted once.
+func (v *Vuln) Key() string {
+	if strings.HasPrefix(v.ID, "CVE-") {
+		return v.ID
+	}
+	for _, alias := range v.Aliases {
+		if strings.HasPrefix(alias, "CVE-") {
+			return alias
+		}
+	}
+	return v.ID
+}
+
+// Load reads the vulnerabilities of all .json files under a directory, e.g. an extracted OSV database dump.
+// A file holds one vulnerability or an array of them, withdrawn vulnerabilities are skipped.
+func Load(dir string) ([]Vuln, error) {
+	var vulns []Vuln
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var found []Vuln
+		if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+			err = json.Unmarshal(data, &found)
+		} else {
+			var v Vuln
+			err = json.Unmarshal(data, &v)
+			found = []Vuln{v}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		for _, v := range found {
+			if v.ID != "" && v.Withdrawn == "" {
+				vulns = append(vulns, v)
+			}
+		}
+		return nil
+	})
+	sort.Slice(vulns, func(i, j int) bool {
+		return vulns[i].ID < vulns[j].ID
+	})
+	return vulns, err
+}
+
+// ecosystems maps the os-release ids of distributions to OSV ecosystems.
+var ecosystems = map[string]string{
+	"debian":              "Debian",
+	"ubuntu":              "Ubuntu",
+	"alpine":              "Alpine",
+	"wolfi":               "Wolfi",
+	"chainguard":          "Chainguard",
+	"rhel":                "Red Hat",
+	"rocky":               "Rocky Linux",
+	"almalinux":           "AlmaLinux",
+	"opensuse-leap":       "openSUSE",
+	"opensuse-tumbleweed": "openSUSE",
+	"sles":                "SUSE",
+}
+
+// defaultEcosystems are used for images without os-release, or of distributions unknown to OSV.
+var defaultEcosystems = map[string]string{pkgdb.Dpkg: "Debian", pkgdb.Apk: "Alpine", pkgdb.Rpm: "Red Hat"}
+
+// An OS identifies the distribution of an image, from its os-release.
+type OS struct {
+	ID        string
+	VersionID string
+}
+
+// ecosystem returns the OSV ecosystem of the packages of a package manager in a distribution.
+func (o OS) ecosystem(manager string) string {
+	if e, ok := ecosystems[o.ID]; ok {
+		return e
+	}
+	return defaultEcosystems[manager]
+}
+
+// matchEcosystem tells if an OSV ecosystem such as Debian:12 or Alpine:v3.19 is the one of the packages.
+// The release is only checked for Debian, Ubuntu and Alpine, whose releases match the VERSION_ID of os-release.
+func (o OS) matchEcosystem(ecosystem string, manager string) bool {
+	name, release, _ := strings.Cut(ecosystem, ":")
+	if name != o.ecosystem(manager) {
+		return false
+	}
+	if release == "" || o.VersionID == "" || (name != "Debian" && name != "Ubuntu" && name != "Alpine") {
+		return true
+	}
+	release, _, _ = strings.Cut(strings.TrimPrefix(release, "v"), ":")
+	return o.VersionID == release || strings.HasPrefix(o.VersionID, release+".")
+}
+
+// Affects tells if a vulnerability affects a package installed in a distribution.
+// Packages are matched by name or by source package, as Debian and Alpine advisories name source packages.
+func (v *Vuln) Affects(p pkgdb.Package, o OS) bool {
+	for _, a := range v.Affected {
+		if a.Package.Name != p.Name && (p.Source == "" || a.Package.Name != p.Source) {
+			continue
+		}
+		if !o.matchEcosystem(a.Package.Ecosystem, p.Manager) {
+			continue
+		}
+		if a.affects(p.Manager, p.Version) {
+			return true
+		}
+	}
+	return false
+}
+
+// affects tells if a version is listed or in an ECOSYSTEM range of affected versions.
+func (a *Affected) affects(manager string, version string) bool {
+	for _, v := range a.Versions {
+		if v == version {
+			return true
+		}
+	}
+	for _, r := range a.Ranges {
+		if r.Type == "ECOSYSTEM" && r.affects(manager, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// affects walks the events of a range in the order of versions, as described by the OSV schema.
+func (r *Range) affects(manager string, version string) bool {
+	eventVersion := func(e Event) string {
+		for _, v := range []string{e.Introduced, e.Fixed, e.LastAffected, e.Limit} {
+			if v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	compare := func(a string, b string) int {
+		// introduced 0 is before any version
+		switch {
+		case a == "0" && b == "0":
+			return 0
+		case a == "0":
+			return -1
+		case b == "0":
+			return 1
+		}
+		return CompareVersions(manager, a, b)
+	}
+	events := append([]Event{}, r.Events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return compare(eventVersion(events[i]), eventVersion(events[j])) < 0
+	})
+
+	affected := false
+	for _, e := range events {
+		switch {
+		case e.Introduced != "":
+			if compare(version, e.Introduced) >= 0 {
+				affected = true
+			}
+		case e.Fixed != "":
+			if compare(version, e.Fixed) >= 0 {
+				affected = false
+			}
+		case e.LastAffected != "":
+			if compare(version, e.LastAffected) > 0 {
+				affected = false
+			}
+		}
+	}
+	return affected
+}
@@ -0,0 +1,281 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package vuln
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+)
+
+// CompareVersions compares two versions of a package manager, it returns -1, 0 or 1.
+func CompareVersions(manager string, a string, b string) int {
+	switch manager {
+	case pkgdb.Apk:
+		return compareApk(a, b)
+	case pkgdb.Rpm:
+		return compareRpm(a, b)
+	default:
+		return compareDpkg(a, b)
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// splitEpoch splits an epoch from a version, a missing epoch is 0.
+func splitEpoch(v string) (int, string) {
+	if e, rest, ok := strings.Cut(v, ":"); ok {
+		if epoch, err := strconv.Atoi(e); err == nil {
+			return epoch, rest
+		}
+	}
+	return 0, v
+}
+
+// compareDpkg compares [epoch:]upstream[-revision] versions as dpkg does.
+func compareDpkg(a string, b string) int {
+	ea, a := splitEpoch(a)
+	eb, b := splitEpoch(b)
+	if ea != eb {
+		return sign(ea - eb)
+	}
+	ua, ra := a, ""
+	if i := strings.LastIndex(a, "-"); i >= 0 {
+		ua, ra = a[:i], a[i+1:]
+	}
+	ub, rb := b, ""
+	if i := strings.LastIndex(b, "-"); i >= 0 {
+		ub, rb = b[:i], b[i+1:]
+	}
+	if c := verrevcmp(ua, ub); c != 0 {
+		return c
+	}
+	return verrevcmp(ra, rb)
+}
+
+// dpkgOrder orders the non-digit characters of dpkg versions: ~ before the end, the end before letters,
+// letters before other characters.
+func dpkgOrder(s string) int {
+	switch {
+	case s == "" || isDigit(s[0]):
+		return 0
+	case s[0] == '~':
+		return -1
+	case isAlpha(s[0]):
+		return int(s[0])
+	}
+	return int(s[0]) + 256
+}
+
+// verrevcmp compares alternating non-digit and digit parts of two versions, as in dpkg.
+func verrevcmp(a string, b string) int {
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			if oa, ob := dpkgOrder(a), dpkgOrder(b); oa != ob {
+				return sign(oa - ob)
+			}
+			if a != "" {
+				a = a[1:]
+			}
+			if b != "" {
+				b = b[1:]
+			}
+		}
+		a = strings.TrimLeft(a, "0")
+		b = strings.TrimLeft(b, "0")
+		firstDiff := 0
+		for a != "" && isDigit(a[0]) && b != "" && isDigit(b[0]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a != "" && isDigit(a[0]) {
+			return 1
+		}
+		if b != "" && isDigit(b[0]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+	return 0
+}
+
+// compareRpm compares [epoch:]version[-release] versions as rpm does.
+func compareRpm(a string, b string) int {
+	ea, a := splitEpoch(a)
+	eb, b := splitEpoch(b)
+	if ea != eb {
+		return sign(ea - eb)
+	}
+	va, ra, hasRa := strings.Cut(a, "-")
+	vb, rb, hasRb := strings.Cut(b, "-")
+	if c := rpmvercmp(va, vb); c != 0 || !hasRa || !hasRb {
+		return c
+	}
+	return rpmvercmp(ra, rb)
+}
+
+// rpmvercmp compares alternating alphabetic and numeric segments of two versions, as in rpm.
+// ~ sorts before anything, ^ after the end but before anything else.
+func rpmvercmp(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	separator := func(c byte) bool {
+		return !isDigit(c) && !isAlpha(c) && c != '~' && c != '^'
+	}
+	for a != "" || b != "" {
+		for a != "" && separator(a[0]) {
+			a = a[1:]
+		}
+		for b != "" && separator(b[0]) {
+			b = b[1:]
+		}
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			switch {
+			case a == "":
+				return -1
+			case b == "":
+				return 1
+			case !strings.HasPrefix(a, "^"):
+				return 1
+			case !strings.HasPrefix(b, "^"):
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if a == "" || b == "" {
+			break
+		}
+		isNum := isDigit(a[0])
+		segment := func(s string) (string, string) {
+			i := 0
+			for i < len(s) && (isNum && isDigit(s[i]) || !isNum && isAlpha(s[i])) {
+				i++
+			}
+			return s[:i], s[i:]
+		}
+		var sa, sb string
+		sa, a = segment(a)
+		sb, b = segment(b)
+		if sb == "" {
+			// numeric segments are newer than alphabetic ones
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+		if isNum {
+			sa = strings.TrimLeft(sa, "0")
+			sb = strings.TrimLeft(sb, "0")
+			if len(sa) != len(sb) {
+				return sign(len(sa) - len(sb))
+			}
+		}
+		if c := strings.Compare(sa, sb); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// apkSuffixes orders the suffixes of apk versions relative to no suffix.
+var apkSuffixes = map[string]int{"alpha": -4, "beta": -3, "pre": -2, "rc": -1, "cvs": 1, "svn": 2, "git": 3, "hg": 4, "p": 5}
+
+// compareApk compares version[_suffix[n]]...[-rN] versions of apk.
+// The version before the suffixes is compared as in dpkg, which orders digits and letters the same way.
+func compareApk(a string, b string) int {
+	va, ra := splitApkRevision(a)
+	vb, rb := splitApkRevision(b)
+	sa := strings.Split(va, "_")
+	sb := strings.Split(vb, "_")
+	if c := verrevcmp(sa[0], sb[0]); c != 0 {
+		return c
+	}
+	for i := 1; i < len(sa) || i < len(sb); i++ {
+		oa, na := apkSuffix(sa, i)
+		ob, nb := apkSuffix(sb, i)
+		if oa != ob {
+			return sign(oa - ob)
+		}
+		if na != nb {
+			return sign(na - nb)
+		}
+	}
+	return sign(ra - rb)
+}
+
+func splitApkRevision(v string) (string, int) {
+	if i := strings.LastIndex(v, "-r"); i >= 0 {
+		if r, err := strconv.Atoi(v[i+2:]); err == nil {
+			return v[:i], r
+		}
+	}
+	return v, 0
+}
+
+// apkSuffix returns the order and the number of the i-th suffix of a version, 0 and 0 if missing.
+func apkSuffix(suffixes []string, i int) (int, int) {
+	if i >= len(suffixes) {
+		return 0, 0
+	}
+	name := strings.TrimRight(suffixes[i], "0123456789")
+	n, _ := strconv.Atoi(suffixes[i][len(name):])
+	return apkSuffixes[name], n
+}
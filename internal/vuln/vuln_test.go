@@ -0,0 +1,137 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package vuln
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/negativa-ai/BLAFS/internal/image/imagetest"
+	"github.com/negativa-ai/BLAFS/internal/pkgdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		manager string
+		a, b    string
+		want    int
+	}{
+		{pkgdb.Dpkg, "1.0", "1.0", 0},
+		{pkgdb.Dpkg, "1.0~rc1", "1.0", -1},
+		{pkgdb.Dpkg, "1.0a", "1.0", 1},
+		{pkgdb.Dpkg, "1:1.0", "2.0", 1},
+		{pkgdb.Dpkg, "2.36-9+deb12u4", "2.36-9+deb12u10", -1},
+		{pkgdb.Dpkg, "1.10", "1.9", 1},
+		{pkgdb.Rpm, "5.2-1.el9", "5.2-1.el9", 0},
+		{pkgdb.Rpm, "5.2-1.el9", "5.2-2.el9", -1},
+		{pkgdb.Rpm, "1.0~rc1", "1.0", -1},
+		{pkgdb.Rpm, "1.0^1", "1.0", 1},
+		{pkgdb.Rpm, "1.10", "1.9", 1},
+		{pkgdb.Rpm, "1:1.0-1", "2.0-1", 1},
+		{pkgdb.Apk, "1.2.4-r2", "1.2.4-r10", -1},
+		{pkgdb.Apk, "1.2.4_rc1-r0", "1.2.4-r0", -1},
+		{pkgdb.Apk, "1.2.4_p1-r0", "1.2.4-r0", 1},
+		{pkgdb.Apk, "3.1.4-r5", "3.1.4-r5", 0},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, CompareVersions(c.manager, c.a, c.b), "%s %s %s", c.manager, c.a, c.b)
+		assert.Equal(t, -c.want, CompareVersions(c.manager, c.b, c.a), "%s %s %s", c.manager, c.b, c.a)
+	}
+}
+
+func TestAffects(t *testing.T) {
+	v := Vuln{ID: "DSA-1", Aliases: []string{"CVE-2024-1"}, Affected: []Affected{{
+		Ranges: []Range{{Type: "ECOSYSTEM", Events: []Event{{Fixed: "1.2-1"}, {Introduced: "0"}}}},
+	}}}
+	v.Affected[0].Package.Ecosystem = "Debian:12"
+	v.Affected[0].Package.Name = "openssl"
+	debian12 := OS{ID: "debian", VersionID: "12"}
+
+	assert.Equal(t, "CVE-2024-1", v.Key())
+	assert.True(t, v.Affects(pkgdb.Package{Manager: pkgdb.Dpkg, Name: "libssl3", Source: "openssl", Version: "1.1-1"}, debian12))
+	assert.False(t, v.Affects(pkgdb.Package{Manager: pkgdb.Dpkg, Name: "openssl", Version: "1.2-1"}, debian12))
+	assert.False(t, v.Affects(pkgdb.Package{Manager: pkgdb.Dpkg, Name: "openssl", Version: "1.1-1"}, OS{ID: "debian", VersionID: "11"}))
+	assert.False(t, v.Affects(pkgdb.Package{Manager: pkgdb.Dpkg, Name: "openssl", Version: "1.1-1"}, OS{ID: "ubuntu", VersionID: "12"}))
+	// without os-release, dpkg packages are matched against Debian
+	assert.True(t, v.Affects(pkgdb.Package{Manager: pkgdb.Dpkg, Name: "openssl", Version: "1.1-1"}, OS{}))
+
+	lastAffected := Range{Type: "ECOSYSTEM", Events: []Event{{Introduced: "1.0-r0"}, {LastAffected: "1.1-r0"}}}
+	assert.False(t, lastAffected.affects(pkgdb.Apk, "0.9-r0"))
+	assert.True(t, lastAffected.affects(pkgdb.Apk, "1.1-r0"))
+	assert.False(t, lastAffected.affects(pkgdb.Apk, "1.1-r1"))
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	imagetest.WriteFile(t, filepath.Join(dir, "Debian/DSA-1.json"), `{"id": "DSA-1", "affected": [{"package": {"ecosystem": "Debian", "name": "openssl"}, "versions": ["1.1-1"]}]}`)
+	imagetest.WriteFile(t, filepath.Join(dir, "all.json"), `[{"id": "ALPINE-1"}, {"id": "ALPINE-2", "withdrawn": "2024-01-01T00:00:00Z"}]`)
+	imagetest.WriteFile(t, filepath.Join(dir, "README.md"), "not json")
+
+	vulns, err := Load(dir)
+	assert.NoError(t, err)
+	assert.Len(t, vulns, 2)
+	assert.Equal(t, "ALPINE-1", vulns[0].ID)
+	assert.Equal(t, []string{"1.1-1"}, vulns[1].Affected[0].Versions)
+
+	imagetest.WriteFile(t, filepath.Join(dir, "broken.json"), "{")
+	_, err = Load(dir)
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	stack := imagetest.NewStack(t, 1)
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "etc/os-release"), "ID=alpine\nVERSION_ID=3.19.1\n")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "lib/apk/db/installed"),
+		"P:musl\nV:1.2.4-r2\nA:x86_64\nF:lib\nR:libc.so\n\nP:curl\nV:8.5.0-r0\nA:x86_64\nF:usr/bin\nR:curl\n\n")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "lib/libc.so"), "libc")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Kept, "lib/libc.so"), "libc")
+	imagetest.WriteFile(t, filepath.Join(stack[0].Origin, "usr/bin/curl"), "curl")
+
+	affected := func(name string, fixed string) []Affected {
+		a := Affected{Ranges: []Range{{Type: "ECOSYSTEM", Events: []Event{{Introduced: "0"}, {Fixed: fixed}}}}}
+		a.Package.Ecosystem = "Alpine:v3.19"
+		a.Package.Name = name
+		return []Affected{a}
+	}
+	vulns := []Vuln{
+		{ID: "ALPINE-CVE-2024-1", Aliases: []string{"CVE-2024-1"}, Affected: affected("musl", "1.2.4-r3")},
+		{ID: "CVE-2024-2", Affected: affected("curl", "8.6.0-r0")},
+		{ID: "CVE-2024-3", Affected: affected("curl", "8.5.0-r0")},
+	}
+
+	d := New("img", stack, vulns)
+	assert.Equal(t, 2, d.Packages)
+	assert.Equal(t, 2, d.Original)
+	assert.Equal(t, 1, d.Debloated)
+	assert.Equal(t, 1, d.Unreachable)
+	assert.Len(t, d.Matches, 2)
+	assert.Equal(t, "CVE-2024-2", d.Matches[0].ID)
+	assert.False(t, d.Matches[0].Reachable)
+	assert.Equal(t, pkgdb.StateRemoved, d.Matches[0].State)
+	assert.True(t, d.Matches[1].Reachable)
+
+	var buf bytes.Buffer
+	d.WriteText(&buf)
+	assert.Contains(t, buf.String(), "Vulnerabilities: 2 in the original image, 1 still reachable, 1 no longer reachable (50.0%)")
+}
@@ -0,0 +1,154 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package workload
+
+import (
+	"fmt"
+	"io"
+)
+
+// A Check compares one probe or step between the original and the debloated image.
+type Check struct {
+	Kind      string `json:"kind"` // probe, step or container
+	Name      string `json:"name"`
+	Original  string `json:"original"`
+	Debloated string `json:"debloated"`
+	Passed    bool   `json:"passed"`
+}
+
+// A Comparison is the outcome of running the same workloads against the original and the debloated image.
+type Comparison struct {
+	Original  Result  `json:"original"`
+	Debloated Result  `json:"debloated"`
+	Checks    []Check `json:"checks"`
+}
+
+// Regressions returns the checks where the debloated image behaves differently from the original one.
+func (c *Comparison) Regressions() []Check {
+	var regressions []Check
+	for _, check := range c.Checks {
+		if !check.Passed {
+			regressions = append(regressions, check)
+		}
+	}
+	return regressions
+}
+
+func probeState(p *ProbeResult) string {
+	if p == nil {
+		return "skipped"
+	}
+	if p.Ready {
+		return "ready"
+	}
+	return "not ready"
+}
+
+func stepState(s *StepResult) string {
+	if s == nil {
+		return "skipped"
+	}
+	if s.Error != "" {
+		return "error: " + s.Error
+	}
+	return fmt.Sprintf("exit %d", s.ExitCode)
+}
+
+// Compare compares the results of the original and the debloated image.
+// The debloated image regresses if it fails to start, a probe is not ready, or a step exits differently.
+// Stdout and stderr of a step must be the same, unless the step ignores its output.
+func Compare(config Config, original Result, debloated Result) Comparison {
+	c := Comparison{Original: original, Debloated: debloated}
+	if original.Error != "" || debloated.Error != "" {
+		c.Checks = append(c.Checks, Check{
+			Kind:      "container",
+			Name:      "start",
+			Original:  original.Error,
+			Debloated: debloated.Error,
+			Passed:    debloated.Error == "" || original.Error != "",
+		})
+	}
+
+	for i, p := range config.Probes {
+		var o, d *ProbeResult
+		if i < len(original.Probes) {
+			o = &original.Probes[i]
+		}
+		if i < len(debloated.Probes) {
+			d = &debloated.Probes[i]
+		}
+		c.Checks = append(c.Checks, Check{
+			Kind:      "probe",
+			Name:      p.Name,
+			Original:  probeState(o),
+			Debloated: probeState(d),
+			Passed:    o == nil || !o.Ready || (d != nil && d.Ready),
+		})
+	}
+
+	for i, s := range config.Workloads {
+		var o, d *StepResult
+		if i < len(original.Steps) {
+			o = &original.Steps[i]
+		}
+		if i < len(debloated.Steps) {
+			d = &debloated.Steps[i]
+		}
+		check := Check{Kind: "step", Name: s.Name, Original: stepState(o), Debloated: stepState(d), Passed: true}
+		switch {
+		case o == nil:
+			// skipped in the original image, nothing to compare with
+		case d == nil:
+			check.Passed = false
+		case o.ExitCode != d.ExitCode || (o.Error == "") != (d.Error == ""):
+			check.Passed = false
+		case !s.IgnoreOutput && o.StdoutDigest != d.StdoutDigest:
+			check.Passed = false
+			check.Debloated += ", stdout differs"
+		case !s.IgnoreOutput && o.StderrDigest != d.StderrDigest:
+			check.Passed = false
+			check.Debloated += ", stderr differs"
+		}
+		c.Checks = append(c.Checks, check)
+	}
+	return c
+}
+
+// Report writes a pass/fail report of the comparison.
+func (c *Comparison) Report(w io.Writer) {
+	fmt.Fprintf(w, "Original image:  %s\n", c.Original.Image)
+	fmt.Fprintf(w, "Debloated image: %s\n\n", c.Debloated.Image)
+	fmt.Fprintf(w, "%-6s %-9s %-30s %-20s %s\n", "RESULT", "KIND", "NAME", "ORIGINAL", "DEBLOATED")
+	for _, check := range c.Checks {
+		result := "PASS"
+		if !check.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%-6s %-9s %-30s %-20s %s\n", result, check.Kind, check.Name, check.Original, check.Debloated)
+	}
+	regressions := len(c.Regressions())
+	if regressions == 0 {
+		fmt.Fprintf(w, "\nValidation passed: %d checks, no regressions\n", len(c.Checks))
+	} else {
+		fmt.Fprintf(w, "\nValidation failed: %d of %d checks regressed\n", regressions, len(c.Checks))
+	}
+}
@@ -0,0 +1,134 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package workload
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+A Config describes how to profile an image, it extends examples/{example}/config.yml:
+
+	image: redis:7.4.1
+	containers:            # containers started from the image
+	  - name: redis
+	    command: ["redis-server"]
+	    env: ["KEY=value"]
+	    ports: ["6379:6379"]
+	    volumes: ["/tmp/data:/data"]
+	probes:                # readiness probes, all must pass before the workloads run
+	  - name: redis-port
+	    type: tcp          # tcp | http | exec
+	    address: localhost:6379
+	    timeout: 30s
+	workloads:             # steps run in order
+	  - name: ping
+	    container: redis   # run inside this container, or on the host if empty
+	    command: ["redis-cli", "ping"]
+	    expect_exit: 0
+	    timeout: 10s
+*/
+
+type Config struct {
+	Image      string      `yaml:"image"`
+	Containers []Container `yaml:"containers"`
+	Probes     []Probe     `yaml:"probes"`
+	Workloads  []Step      `yaml:"workloads"`
+}
+
+// A Container is started from the image of the config, unless Image is set.
+type Container struct {
+	Name       string   `yaml:"name"`
+	Image      string   `yaml:"image"`
+	Entrypoint []string `yaml:"entrypoint"`
+	Command    []string `yaml:"command"`
+	Env        []string `yaml:"env"`
+	Ports      []string `yaml:"ports"`   // host_port:container_port[/proto]
+	Volumes    []string `yaml:"volumes"` // host_path:container_path[:mode]
+	Network    string   `yaml:"network"` // network mode, e.g., host
+}
+
+// Probe types
+const (
+	ProbeTCP  = "tcp"
+	ProbeHTTP = "http"
+	ProbeExec = "exec"
+)
+
+// A Probe is retried every Interval until it passes or Timeout is reached.
+type Probe struct {
+	Name      string        `yaml:"name"`
+	Type      string        `yaml:"type"`
+	Address   string        `yaml:"address"`   // for tcp probes
+	URL       string        `yaml:"url"`       // for http probes, 2xx and 3xx responses pass
+	Container string        `yaml:"container"` // for exec probes, run on the host if empty
+	Command   []string      `yaml:"command"`   // for exec probes, exit code 0 passes
+	Timeout   time.Duration `yaml:"timeout"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+// A Step is a workload command, it passes if it exits with ExpectExit within Timeout.
+type Step struct {
+	Name       string        `yaml:"name"`
+	Container  string        `yaml:"container"` // run inside this container, or on the host if empty
+	Command    []string      `yaml:"command"`
+	Env        []string      `yaml:"env"`
+	ExpectExit int           `yaml:"expect_exit"`
+	Timeout    time.Duration `yaml:"timeout"`
+	// IgnoreOutput skips comparing stdout and stderr when validating, e.g., for outputs with timestamps
+	IgnoreOutput bool `yaml:"ignore_output"`
+}
+
+const (
+	defaultProbeTimeout  = 30 * time.Second
+	defaultProbeInterval = 1 * time.Second
+	defaultStepTimeout   = 5 * time.Minute
+)
+
+// LoadConfig reads a config from a yaml file and fills in defaults.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	for i := range config.Probes {
+		if config.Probes[i].Timeout == 0 {
+			config.Probes[i].Timeout = defaultProbeTimeout
+		}
+		if config.Probes[i].Interval == 0 {
+			config.Probes[i].Interval = defaultProbeInterval
+		}
+	}
+	for i := range config.Workloads {
+		if config.Workloads[i].Timeout == 0 {
+			config.Workloads[i].Timeout = defaultStepTimeout
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,358 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package workload
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	log "github.com/sirupsen/logrus"
+)
+
+// A ProbeResult is the outcome of a readiness probe.
+type ProbeResult struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+// A StepResult is the outcome of a workload step.
+type StepResult struct {
+	Name         string        `json:"name"`
+	ExitCode     int           `json:"exit_code"`
+	StdoutDigest string        `json:"stdout_digest"`
+	StderrDigest string        `json:"stderr_digest"`
+	Stdout       string        `json:"-"`
+	Stderr       string        `json:"-"`
+	Duration     time.Duration `json:"duration"`
+	Passed       bool          `json:"passed"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// A Result is the outcome of running all containers, probes and workload steps against an image.
+type Result struct {
+	Image  string        `json:"image"`
+	Error  string        `json:"error,omitempty"` // set if the containers cannot be started
+	Probes []ProbeResult `json:"probes"`
+	Steps  []StepResult  `json:"steps"`
+}
+
+// Passed returns true if all probes are ready and all steps passed.
+func (r *Result) Passed() bool {
+	if r.Error != "" {
+		return false
+	}
+	for _, p := range r.Probes {
+		if !p.Ready {
+			return false
+		}
+	}
+	for _, s := range r.Steps {
+		if !s.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// A Runner runs the workloads of a config through the docker client.
+type Runner struct {
+	config Config
+	cli    *client.Client
+	ctx    *context.Context
+	// container name in config -> container id
+	containers map[string]string
+	// suffix of the docker names of the containers, unique per run
+	runID string
+}
+
+// NewRunner creates a runner of a config.
+func NewRunner(config Config, cli *client.Client, ctx *context.Context) *Runner {
+	return &Runner{config: config, cli: cli, ctx: ctx, containers: map[string]string{}}
+}
+
+// Run starts all containers from imgName, waits for the probes and runs the workload steps.
+// Steps are skipped if a probe fails. Containers are removed at the end.
+func (r *Runner) Run(imgName string) Result {
+	result := Result{Image: imgName}
+	r.runID = newRunID()
+	defer r.removeContainers()
+
+	for _, c := range r.config.Containers {
+		if err := r.startContainer(c, imgName); err != nil {
+			log.Error("Failed to start container ", c.Name, ": ", err)
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	ready := true
+	for _, p := range r.config.Probes {
+		pr := r.waitProbe(p)
+		if !pr.Ready {
+			log.Error("Probe ", p.Name, " failed: ", pr.Error)
+			ready = false
+		}
+		result.Probes = append(result.Probes, pr)
+	}
+	if !ready {
+		return result
+	}
+
+	for _, s := range r.config.Workloads {
+		sr := r.runStep(s)
+		if sr.Passed {
+			log.Info("Step ", s.Name, " passed in ", sr.Duration)
+		} else {
+			log.Error("Step ", s.Name, " failed: exit code ", sr.ExitCode, ", expected ", s.ExpectExit, " ", sr.Error)
+			log.Debug("stdout: ", sr.Stdout, " stderr: ", sr.Stderr)
+		}
+		result.Steps = append(result.Steps, sr)
+	}
+	return result
+}
+
+// newRunID returns a random suffix, so that the containers of a run never conflict with those of other runs,
+// e.g., left over by an interrupted run or run concurrently.
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// containerName returns the docker name of a container in the config for the current run.
+func (r *Runner) containerName(name string) string {
+	return "baffs-" + name + "-" + r.runID
+}
+
+func (r *Runner) startContainer(c Container, imgName string) error {
+	if c.Image != "" {
+		imgName = c.Image
+	}
+	exposed, bindings, err := nat.ParsePortSpecs(c.Ports)
+	if err != nil {
+		return err
+	}
+	config := &container.Config{
+		Image:        imgName,
+		Env:          c.Env,
+		ExposedPorts: exposed,
+	}
+	if len(c.Command) > 0 {
+		config.Cmd = c.Command
+	}
+	if len(c.Entrypoint) > 0 {
+		config.Entrypoint = c.Entrypoint
+	}
+	hostConfig := &container.HostConfig{
+		Binds:        c.Volumes,
+		PortBindings: bindings,
+		NetworkMode:  container.NetworkMode(c.Network),
+	}
+
+	log.Info("Starting container ", r.containerName(c.Name), " from ", imgName)
+	resp, err := r.cli.ContainerCreate(*r.ctx, config, hostConfig, nil, nil, r.containerName(c.Name))
+	if err != nil {
+		return err
+	}
+	r.containers[c.Name] = resp.ID
+	return r.cli.ContainerStart(*r.ctx, resp.ID, container.StartOptions{})
+}
+
+func (r *Runner) removeContainers() {
+	for name, id := range r.containers {
+		log.Debug("Removing container ", name)
+		if err := r.cli.ContainerRemove(*r.ctx, id, container.RemoveOptions{Force: true}); err != nil {
+			log.Warn("Failed to remove container ", name, ": ", err)
+		}
+	}
+	r.containers = map[string]string{}
+}
+
+// waitProbe retries a probe until it passes or times out.
+func (r *Runner) waitProbe(p Probe) ProbeResult {
+	result := ProbeResult{Name: p.Name}
+	deadline := time.Now().Add(p.Timeout)
+	for {
+		err := r.probe(p)
+		if err == nil {
+			result.Ready = true
+			return result
+		}
+		if time.Now().Add(p.Interval).After(deadline) {
+			result.Error = err.Error()
+			return result
+		}
+		time.Sleep(p.Interval)
+	}
+}
+
+// probe runs a probe once.
+func (r *Runner) probe(p Probe) error {
+	switch p.Type {
+	case ProbeTCP:
+		conn, err := net.DialTimeout("tcp", p.Address, p.Interval)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case ProbeHTTP:
+		httpClient := http.Client{Timeout: p.Interval}
+		resp, err := httpClient.Get(p.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		return nil
+	case ProbeExec:
+		exitCode, _, _, err := r.exec(p.Container, p.Command, nil, p.Interval)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("exit code %d", exitCode)
+		}
+		return nil
+	default:
+		return errors.New("unknown probe type: " + p.Type)
+	}
+}
+
+// runStep runs a workload step and checks its exit code.
+func (r *Runner) runStep(s Step) StepResult {
+	log.Info("Running step ", s.Name)
+	start := time.Now()
+	exitCode, stdout, stderr, err := r.exec(s.Container, s.Command, s.Env, s.Timeout)
+	result := StepResult{
+		Name:         s.Name,
+		ExitCode:     exitCode,
+		Stdout:       string(stdout),
+		Stderr:       string(stderr),
+		StdoutDigest: fmt.Sprintf("%x", sha256.Sum256(stdout)),
+		StderrDigest: fmt.Sprintf("%x", sha256.Sum256(stderr)),
+		Duration:     time.Since(start),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Passed = exitCode == s.ExpectExit
+	return result
+}
+
+// exec runs a command inside the container of the config with the given name, or on the host if name is empty.
+// It returns the exit code, stdout and stderr.
+func (r *Runner) exec(name string, command []string, env []string, timeout time.Duration) (int, []byte, []byte, error) {
+	if len(command) == 0 {
+		return -1, nil, nil, errors.New("empty command")
+	}
+	ctx, cancel := context.WithTimeout(*r.ctx, timeout)
+	defer cancel()
+	if name == "" {
+		return execHost(ctx, command, env)
+	}
+	id, ok := r.containers[name]
+	if !ok {
+		return -1, nil, nil, errors.New("unknown container: " + name)
+	}
+	return execContainer(ctx, r.cli, id, command, env)
+}
+
+// execHost runs a command on the host.
+func execHost(ctx context.Context, command []string, env []string) (int, []byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	if len(env) > 0 {
+		cmd.Env = append(cmd.Environ(), env...)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return -1, stdout.Bytes(), stderr.Bytes(), ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), stdout.Bytes(), stderr.Bytes(), nil
+	}
+	if err != nil {
+		return -1, stdout.Bytes(), stderr.Bytes(), err
+	}
+	return 0, stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// execContainer runs a command inside a running container.
+func execContainer(ctx context.Context, cli *client.Client, id string, command []string, env []string) (int, []byte, []byte, error) {
+	execResp, err := cli.ContainerExecCreate(ctx, id, container.ExecOptions{
+		Cmd:          command,
+		Env:          env,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	attach, err := cli.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	defer attach.Close()
+
+	var stdout, stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(&stdout, &stderr, attach.Reader)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return -1, stdout.Bytes(), stderr.Bytes(), err
+		}
+	case <-ctx.Done():
+		return -1, stdout.Bytes(), stderr.Bytes(), ctx.Err()
+	}
+
+	inspect, err := cli.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return -1, stdout.Bytes(), stderr.Bytes(), err
+	}
+	return inspect.ExitCode, stdout.Bytes(), stderr.Bytes(), nil
+}
@@ -0,0 +1,168 @@
+// MIT License
+
+// Copyright (c) [2025] [jzh18]
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package workload
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig("../../examples/redis/config.yml")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "redis:7.4.1", config.Image)
+	assert.Equal(t, "redis", config.Containers[0].Name)
+	assert.Equal(t, ProbeExec, config.Probes[0].Type)
+	assert.Equal(t, 30*time.Second, config.Probes[0].Timeout)
+	assert.Equal(t, defaultProbeInterval, config.Probes[0].Interval)
+	assert.Equal(t, 10*time.Second, config.Workloads[0].Timeout)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, os.WriteFile(path, []byte("image: a\nworkloads:\n  - name: s\n    command: [\"true\"]\n"), 0644))
+
+	config, err := LoadConfig(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultStepTimeout, config.Workloads[0].Timeout)
+	assert.Equal(t, 0, config.Workloads[0].ExpectExit)
+}
+
+func TestRunHostSteps(t *testing.T) {
+	ctx := context.Background()
+	config := Config{Workloads: []Step{
+		{Name: "echo", Command: []string{"echo", "hello"}, Timeout: 5 * time.Second},
+		{Name: "fail", Command: []string{"sh", "-c", "exit 3"}, ExpectExit: 3, Timeout: 5 * time.Second},
+		{Name: "unexpected", Command: []string{"sh", "-c", "exit 1"}, Timeout: 5 * time.Second},
+		{Name: "timeout", Command: []string{"sleep", "5"}, Timeout: 100 * time.Millisecond},
+	}}
+
+	result := NewRunner(config, nil, &ctx).Run("img")
+
+	assert.False(t, result.Passed())
+	assert.True(t, result.Steps[0].Passed)
+	assert.Equal(t, "hello\n", result.Steps[0].Stdout)
+	assert.True(t, result.Steps[1].Passed)
+	assert.False(t, result.Steps[2].Passed)
+	assert.Equal(t, 1, result.Steps[2].ExitCode)
+	assert.False(t, result.Steps[3].Passed)
+	assert.NotEmpty(t, result.Steps[3].Error)
+}
+
+func TestContainerNamePerRun(t *testing.T) {
+	ctx := context.Background()
+	r := NewRunner(Config{}, nil, &ctx)
+	r.Run("img")
+	first := r.containerName("redis")
+	r.Run("img-baffs")
+	assert.True(t, strings.HasPrefix(first, "baffs-redis-"))
+	assert.NotEqual(t, first, r.containerName("redis"))
+}
+
+func TestProbes(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	config := Config{
+		Probes: []Probe{
+			{Name: "tcp", Type: ProbeTCP, Address: listener.Addr().String(), Timeout: time.Second, Interval: 100 * time.Millisecond},
+			{Name: "exec", Type: ProbeExec, Command: []string{"false"}, Timeout: 300 * time.Millisecond, Interval: 100 * time.Millisecond},
+		},
+		Workloads: []Step{{Name: "skipped", Command: []string{"true"}, Timeout: time.Second}},
+	}
+
+	result := NewRunner(config, nil, &ctx).Run("img")
+
+	assert.True(t, result.Probes[0].Ready)
+	assert.False(t, result.Probes[1].Ready)
+	assert.Empty(t, result.Steps)
+	assert.False(t, result.Passed())
+}
+
+func TestCompare(t *testing.T) {
+	config := Config{
+		Probes: []Probe{{Name: "tcp"}},
+		Workloads: []Step{
+			{Name: "same"},
+			{Name: "exit"},
+			{Name: "output"},
+			{Name: "ignored", IgnoreOutput: true},
+		},
+	}
+	original := Result{
+		Image:  "img",
+		Probes: []ProbeResult{{Name: "tcp", Ready: true}},
+		Steps: []StepResult{
+			{Name: "same", StdoutDigest: "a"},
+			{Name: "exit"},
+			{Name: "output", StdoutDigest: "a"},
+			{Name: "ignored", StdoutDigest: "a"},
+		},
+	}
+	debloated := Result{
+		Image:  "img-baffs",
+		Probes: []ProbeResult{{Name: "tcp", Ready: true}},
+		Steps: []StepResult{
+			{Name: "same", StdoutDigest: "a"},
+			{Name: "exit", ExitCode: 127},
+			{Name: "output", StdoutDigest: "b"},
+			{Name: "ignored", StdoutDigest: "b"},
+		},
+	}
+
+	c := Compare(config, original, debloated)
+
+	regressions := c.Regressions()
+	assert.Len(t, c.Checks, 5)
+	assert.Len(t, regressions, 2)
+	assert.Equal(t, "exit", regressions[0].Name)
+	assert.Equal(t, "output", regressions[1].Name)
+}
+
+func TestCompareNotStarted(t *testing.T) {
+	config := Config{
+		Probes:    []Probe{{Name: "tcp"}},
+		Workloads: []Step{{Name: "step"}},
+	}
+	original := Result{
+		Probes: []ProbeResult{{Name: "tcp", Ready: true}},
+		Steps:  []StepResult{{Name: "step"}},
+	}
+	debloated := Result{Error: "exec: no such file"}
+
+	c := Compare(config, original, debloated)
+
+	assert.Len(t, c.Regressions(), 3)
+	var report strings.Builder
+	c.Report(&report)
+	assert.Contains(t, report.String(), "Validation failed: 3 of 3 checks regressed")
+}
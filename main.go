@@ -22,19 +22,29 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"fmt"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/alexflint/go-arg"
 	"github.com/docker/docker/client"
 	"github.com/negativa-ai/BLAFS/internal/builder"
+	"github.com/negativa-ai/BLAFS/internal/engine"
 	"github.com/negativa-ai/BLAFS/internal/image"
+	"github.com/negativa-ai/BLAFS/internal/journal"
 	"github.com/negativa-ai/BLAFS/internal/mount"
+	"github.com/negativa-ai/BLAFS/internal/profile"
+	"github.com/negativa-ai/BLAFS/internal/report"
+	"github.com/negativa-ai/BLAFS/internal/rules"
+	"github.com/negativa-ai/BLAFS/internal/state"
 	"github.com/negativa-ai/BLAFS/internal/util"
+	"github.com/negativa-ai/BLAFS/internal/version"
+	"github.com/negativa-ai/BLAFS/internal/vuln"
+	"github.com/negativa-ai/BLAFS/internal/workload"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -42,65 +52,220 @@ type ShadowCmd struct {
 	Images      string `arg:"-i,--images" help:"Images to shadow, separated by comma"`
 	DebloatedFs string `arg:"-d,--debloatedfs" help:"Path to debloated_fs binary" default:"/usr/bin/debloated_fs"`
 }
+type ExportArgs struct {
+	Top          int      `arg:"-t,--top" help:"Top N layers to debloat" default:"-1"`
+	Keep         []string `arg:"--keep,separate" help:"Keep files matching the glob even if not accessed, can be repeated"`
+	Drop         []string `arg:"--drop,separate" help:"Drop files matching the glob even if accessed, can be repeated"`
+	Rules        string   `arg:"--rules" help:"File of keep and drop rules, one 'keep|drop <glob>' per line"`
+	KeepDirs     bool     `arg:"--keep-dirs" help:"Keep all directories of the original image, even empty ones"`
+	NoELF        bool     `arg:"--no-elf" help:"Do not keep shared libraries needed by kept ELF files"`
+	RewritePkgDB bool     `arg:"--rewrite-pkgdb" help:"Rewrite the dpkg and apk databases so that they only list the kept files, images with rpm databases are rejected"`
+	SBOM         bool     `arg:"--sbom" help:"Write SPDX and CycloneDX SBOMs of the debloated image next to its tar"`
+	Licenses     bool     `arg:"--keep-licenses" help:"Keep license files of packages and directories with kept files, and write a license manifest"`
+	OSV          string   `arg:"--osv" help:"Directory of vulnerabilities in OSV JSON format, write those no longer reachable in the debloated image next to its tar"`
+}
 type DebloatCmd struct {
 	Images string `arg:"-i,--images" help:"Images to debloat separated by comma"`
-	Top    int    `arg:"-t,--top" help:"Top N layers to debloat" default:"-1"`
+	ExportArgs
+}
+type RestoreCmd struct {
+	Images string `arg:"-i,--images" help:"Images to restore separated by comma"`
+}
+type ProfileExportCmd struct {
+	Image  string `arg:"-i,--image,required" help:"Shadowed image to export the profile of"`
+	Output string `arg:"-o,--output" help:"Path of the profile" default:"profile.json"`
+}
+type ProfileCmd struct {
+	Config      string            `arg:"-c,--config" help:"Config of the image and its profiling workloads, see examples/redis/config.yml"`
+	DebloatedFs string            `arg:"-d,--debloatedfs" help:"Path to debloated_fs binary" default:"/usr/bin/debloated_fs"`
+	NoDebloat   bool              `arg:"--no-debloat" help:"Only shadow and profile the image, do not debloat it"`
+	Export      *ProfileExportCmd `arg:"subcommand:export" help:"Export the files accessed in each layer of a shadowed image"`
+	ExportArgs
+}
+type ValidateCmd struct {
+	Config    string `arg:"-c,--config,required" help:"Config of the image and its workloads, see examples/redis/config.yml"`
+	Debloated string `arg:"--debloated" help:"Debloated image to validate, default to {image}-baffs"`
+	Json      string `arg:"--json" help:"Also write the comparison as json to this path"`
+}
+type ReportCmd struct {
+	Image  string `arg:"positional,required" help:"Shadowed or debloated image"`
+	Format string `arg:"-f,--format" help:"Output format: text|json|markdown|html" default:"text"`
+	Output string `arg:"-o,--output" help:"Path of the report, default to stdout"`
+	Top    int    `arg:"--top" help:"Number of directories and file types to report" default:"10"`
+}
+type VulndiffCmd struct {
+	Image  string `arg:"positional,required" help:"Image debloated with --osv"`
+	Format string `arg:"-f,--format" help:"Output format: text|json" default:"text"`
+	Output string `arg:"-o,--output" help:"Path of the report, default to stdout"`
+}
+type StatusCmd struct {
+	Images []string `arg:"positional" help:"Images to show, default to all images recorded"`
+	Format string   `arg:"-f,--format" help:"Output format: text|json" default:"text"`
+}
+type ApplyCmd struct {
+	Tar     string `arg:"--tar,required" help:"Image tar saved by docker save"`
+	Profile string `arg:"--profile,required" help:"Profile exported by baffs profile export"`
+	Output  string `arg:"-o,--output" help:"Path of the debloated image tar, default to {tar}.debloated"`
 }
 
 var args struct {
-	Shadow  *ShadowCmd  `arg:"subcommand:shadow" help:"Shadow images"`
-	Debloat *DebloatCmd `arg:"subcommand:debloat" help:"Debloat images"`
+	Recover       string        `arg:"--recover" help:"Recover an unfinished operation without asking: forward|back"`
+	Engine        string        `arg:"--engine" help:"Container engine storing the images: docker|podman|containerd" default:"docker"`
+	StorageRoot   string        `arg:"--storage-root" help:"Storage root of podman, or root of the overlayfs snapshotter of containerd"`
+	Address       string        `arg:"--address" help:"Address of containerd" default:"/run/containerd/containerd.sock"`
+	Namespace     string        `arg:"--namespace" help:"Namespace of containerd, e.g., k8s.io for kubernetes or moby for docker" default:"default"`
+	Reload        string        `arg:"--reload" help:"How to restart docker: systemd|sysv|openrc|pidfile|command" default:"systemd"`
+	ReloadService string        `arg:"--reload-service" help:"Service of docker, for systemd, sysv and openrc" default:"docker"`
+	ReloadPidfile string        `arg:"--reload-pidfile" help:"Pidfile of dockerd, for pidfile" default:"/var/run/docker.pid"`
+	ReloadSignal  string        `arg:"--reload-signal" help:"Signal stopping dockerd, for pidfile" default:"TERM"`
+	ReloadCommand string        `arg:"--reload-command" help:"Shell command restarting docker for command, or starting dockerd again for pidfile"`
+	ReloadTimeout time.Duration `arg:"--reload-timeout" help:"Time to wait for docker to stop and to be healthy again" default:"60s"`
+	Live          bool          `arg:"--live" help:"Redirect layers of docker by their l/ links, without restarting docker"`
+	Shadow        *ShadowCmd    `arg:"subcommand:shadow" help:"Shadow images"`
+	Debloat       *DebloatCmd   `arg:"subcommand:debloat" help:"Debloat images"`
+	Restore       *RestoreCmd   `arg:"subcommand:restore" help:"Restore shadowed images without debloating"`
+	Profile       *ProfileCmd   `arg:"subcommand:profile" help:"Manage profiles of shadowed images"`
+	Apply         *ApplyCmd     `arg:"subcommand:apply" help:"Debloat an image tar offline with an exported profile"`
+	Validate      *ValidateCmd  `arg:"subcommand:validate" help:"Compare the original and the debloated image under the same workloads"`
+	Report        *ReportCmd    `arg:"subcommand:report" help:"Report what debloating removed from an image"`
+	Vulndiff      *VulndiffCmd  `arg:"subcommand:vulndiff" help:"Report the vulnerabilities no longer reachable in a debloated image"`
+	Status        *StatusCmd    `arg:"subcommand:status" help:"Show the images shadowed, debloated and restored, as recorded in the work dir"`
+}
+
+// exportOptions merges the rules given on the command line and in the rules file.
+func (a *ExportArgs) exportOptions() builder.ExportOptions {
+	opts := builder.ExportOptions{TopN: a.Top, Rules: rules.Rules{Keep: a.Keep, Drop: a.Drop}, KeepDirs: a.KeepDirs, NoELF: a.NoELF, RewritePkgDB: a.RewritePkgDB, SBOM: a.SBOM, Licenses: a.Licenses, OSV: a.OSV}
+	if a.OSV != "" {
+		if _, err := os.Stat(a.OSV); err != nil {
+			panic(err)
+		}
+	}
+	if a.Rules != "" {
+		r, err := rules.Load(a.Rules)
+		if err != nil {
+			panic(err)
+		}
+		opts.Rules.Merge(r)
+	}
+	return opts
+}
+
+// debloatJournalOptions records the export options in the journal header, so that debloat can be rolled forward.
+func debloatJournalOptions(opts builder.ExportOptions) map[string]string {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		panic(err)
+	}
+	return map[string]string{"export": string(data)}
 }
 
-func restartDocker() {
-	log.Debug("Restarting docker")
-	cmd := exec.Command("systemctl", "restart", "docker")
-	stdout, err := cmd.Output()
+// storageRoot returns the storage root given on the command line, or the default one of the engine.
+func storageRoot(defaultRoot string) string {
+	if args.StorageRoot != "" {
+		return args.StorageRoot
+	}
+	return defaultRoot
+}
+
+// reload reloads the engine, so that it reads the layer metadata changed by shadowing or debloating.
+func reload(eng engine.Engine, ctx *context.Context) {
+	if err := eng.Reload(*ctx); err != nil {
+		panic(err)
+	}
+}
+
+// redirect points the engine to a shadow layer, or back to the original layer if undo is set.
+func redirect(eng engine.Engine, l image.ShadowLayer, undo bool, j *journal.Journal) {
+	var err error
+	if undo {
+		err = eng.Unredirect(l, j)
+	} else {
+		err = eng.Redirect(l, j)
+	}
 	if err != nil {
 		panic(err)
 	}
-	log.Debug("Restarted docker: ", string(stdout))
 }
 
-func shadow(imgName []string, workDir string, overlayPath string,
-	dockerRootDir string, cli *client.Client, ctx *context.Context, debloatedFs string) {
+// beginJournal starts a journal for an operation, it panics if an unfinished operation is recorded.
+func beginJournal(workDir string, op string, imgNames []string, options map[string]string) *journal.Journal {
+	j, err := journal.Begin(workDir, journal.Header{Op: op, Images: imgNames, Options: options})
+	if err != nil {
+		panic(err)
+	}
+	return j
+}
+
+// openState opens the state database in the work dir and records images shadowed before it existed.
+func openState(workDir string, eng engine.Engine, ctx *context.Context) *state.DB {
+	db, err := state.Open(workDir)
+	if err != nil {
+		panic(err)
+	}
+	builder.AdoptShadowedImages(db, workDir, eng, ctx)
+	return db
+}
+
+// saveState saves the state database, recording the previous version in the journal j.
+func saveState(db *state.DB, j *journal.Journal) {
+	if err := db.Save(j); err != nil {
+		panic(err)
+	}
+}
+
+// shadow shadows images. Already shadowed images are only mounted again if needed.
+// Layers shared with already shadowed images are reused, not shadowed again.
+// All changes to the docker storage are recorded in the journal j, which is committed at the end.
+func shadow(imgName []string, workDir string, eng engine.Engine, ctx *context.Context, debloatedFs string, j *journal.Journal) {
 	log.Info("Shadowing images: ", imgName)
+	db := openState(workDir, eng, ctx)
 	var allShadowLayers [][]image.ShadowLayer
 	var allImgMounts [][]mount.Mount
 	for _, imgName := range imgName {
 
-		shadowed, originalLayers, shadowLayers := builder.ShadowImage(imgName, workDir, overlayPath, dockerRootDir, cli, ctx, "")
+		shadowed, originalLayers, shadowLayers, newLayers := builder.ShadowImage(imgName, workDir, eng, ctx, "", db, j)
 		if !shadowed {
-			allShadowLayers = append(allShadowLayers, shadowLayers)
-			mounts := builder.CreateMounts(debloatedFs, originalLayers, shadowLayers)
-			allImgMounts = append(allImgMounts, mounts)
+			if len(newLayers) > 0 {
+				allShadowLayers = append(allShadowLayers, newLayers)
+			}
 		} else {
 			log.Info("Image ", imgName, " already shadowed")
 		}
+		mounts := builder.CreateMounts(debloatedFs, originalLayers, shadowLayers)
+		allImgMounts = append(allImgMounts, mounts)
 	}
 
 	for _, shadowLayers := range allShadowLayers {
 		for _, l := range shadowLayers {
-			l.Dump()
+			l.Dump(j)
+			redirect(eng, l, false, j)
 		}
 	}
 
-	time.Sleep(3 * time.Second)
-	restartDocker()
+	if len(allShadowLayers) > 0 {
+		reload(eng, ctx)
+	}
 	log.Info("Mounting debloated_fs")
 	for _, mounts := range allImgMounts {
 		for _, m := range mounts {
+			j.Record(journal.Mount(m.GetMountPoint()))
 			m.Mount()
+			db.SetMountPID(m.GetMountPoint(), m.PID())
 		}
 	}
+	saveState(db, j)
+	j.Commit()
 }
 
-func debloat(imgNames []string, workDir string, overlayPath string, dockerRootDir string, cli *client.Client, ctx *context.Context, topN int) {
+// debloat debloats images and loads the debloated images.
+// All changes to the docker storage are recorded in the journal j, which is committed at the end.
+func debloat(imgNames []string, workDir string, eng engine.Engine, ctx *context.Context, opts builder.ExportOptions, j *journal.Journal) {
 	log.Info("Debloating images: ", imgNames)
+	db := openState(workDir, eng, ctx)
 	var imgPaths []string
 	var allShadowLayers [][]image.ShadowLayer
 	for _, imgName := range imgNames {
-		shadowed, imgTarPath, shadowLayers := builder.ExportImg(imgName, workDir, overlayPath, dockerRootDir, cli, ctx, topN)
+		shadowed, imgTarPath, shadowLayers := builder.ExportImg(imgName, workDir, eng, ctx, opts, db, j)
 		if shadowed {
 			imgPaths = append(imgPaths, imgTarPath)
 			allShadowLayers = append(allShadowLayers, shadowLayers)
@@ -109,17 +274,345 @@ func debloat(imgNames []string, workDir string, overlayPath string, dockerRootDi
 
 	for _, shadowLayers := range allShadowLayers {
 		for _, l := range shadowLayers {
-			l.Restore()
+			l.Restore(j)
+			redirect(eng, l, true, j)
 		}
 	}
+	saveState(db, j)
+	j.Record(journal.Checkpoint(checkpointRestored))
 
-	restartDocker()
-	time.Sleep(3 * time.Second)
+	reload(eng, ctx)
 	log.Info("Loading debloated images")
 	for _, imgTarPath := range imgPaths {
-		builder.LoadImage(imgTarPath, cli)
+		builder.LoadImage(imgTarPath, eng, ctx)
+	}
+	j.Commit()
+}
+
+// checkpointRestored is recorded by debloat and restore once all cache-ids are restored.
+// Afterwards, the debloated images only need to be loaded, or the shadow layers removed.
+const checkpointRestored = "restored"
+
+// askRecoverMode asks the user how to recover an unfinished operation.
+func askRecoverMode() string {
+	fmt.Print("Roll the unfinished operation forward or back? [forward/back/abort]: ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "abort"
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "f", "forward":
+		return "forward"
+	case "b", "back":
+		return "back"
+	default:
+		return "abort"
+	}
+}
+
+// recoverJournal rolls an unfinished operation recorded in the work dir forward or back.
+// Rolling forward runs the operation again, rolling back undoes all recorded changes.
+func recoverJournal(workDir string, mode string, eng engine.Engine, ctx *context.Context) {
+	j, err := journal.Open(workDir)
+	if err != nil {
+		panic(err)
+	}
+	log.Warn("Found an unfinished ", j.Header.Op, " of images ", j.Header.Images, ", started at ", j.Header.Time)
+	if mode == "" {
+		mode = askRecoverMode()
+	}
+
+	switch mode {
+	case "forward":
+		log.Info("Rolling forward ", j.Header.Op)
+		if j, err = journal.Resume(workDir); err != nil {
+			panic(err)
+		}
+		switch j.Header.Op {
+		case "shadow":
+			shadow(j.Header.Images, workDir, eng, ctx, j.Header.Options["debloatedfs"], j)
+		case "debloat":
+			if j.HasCheckpoint(checkpointRestored) {
+				reload(eng, ctx)
+				for _, imgName := range j.Header.Images {
+					if util.PathExist(builder.DebloatedTarPath(imgName)) {
+						builder.LoadImage(builder.DebloatedTarPath(imgName), eng, ctx)
+					}
+				}
+				j.Commit()
+			} else {
+				var opts builder.ExportOptions
+				if err := json.Unmarshal([]byte(j.Header.Options["export"]), &opts); err != nil {
+					panic(err)
+				}
+				debloat(j.Header.Images, workDir, eng, ctx, opts, j)
+			}
+		case "restore":
+			if j.HasCheckpoint(checkpointRestored) {
+				reload(eng, ctx)
+				db := openState(workDir, eng, ctx)
+				var restored []string
+				for _, imgName := range j.Header.Images {
+					if rec := db.Lookup(imgName); rec != nil && rec.Status == state.Restored {
+						restored = append(restored, imgName)
+					}
+				}
+				removeShadowLayers(restored, workDir, eng, ctx, db)
+				j.Commit()
+			} else {
+				restore(j.Header.Images, workDir, eng, ctx, j)
+			}
+		default:
+			panic("unknown operation in journal: " + j.Header.Op)
+		}
+	case "back":
+		log.Info("Rolling back ", j.Header.Op)
+		j.Rollback()
+		reload(eng, ctx)
+	default:
+		log.Error("Unfinished ", j.Header.Op, " is not recovered, run with --recover=forward|back")
+		os.Exit(1)
+	}
+}
+
+// restore undoes shadowing of images without debloating them.
+// All changes to the storage are recorded in the journal j, which is committed at the end.
+func restore(imgNames []string, workDir string, eng engine.Engine, ctx *context.Context, j *journal.Journal) {
+	log.Info("Restoring images: ", imgNames)
+	db := openState(workDir, eng, ctx)
+	var restoredImgs []string
+	var allShadowLayers [][]image.ShadowLayer
+	for _, imgName := range imgNames {
+		shadowed, shadowLayers, err := builder.RestoreImg(imgName, eng, ctx, db, j)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if shadowed {
+			restoredImgs = append(restoredImgs, imgName)
+			allShadowLayers = append(allShadowLayers, shadowLayers)
+		}
+	}
+
+	for _, shadowLayers := range allShadowLayers {
+		for _, l := range shadowLayers {
+			l.Restore(j)
+			redirect(eng, l, true, j)
+		}
+	}
+	saveState(db, j)
+	j.Record(journal.Checkpoint(checkpointRestored))
+
+	reload(eng, ctx)
+	removeShadowLayers(restoredImgs, workDir, eng, ctx, db)
+	j.Commit()
+}
+
+// removeShadowLayers removes the shadow layers and the backups of restored images.
+// Shadow layers cannot be restored once removed, so they are only removed after the restored checkpoint.
+func removeShadowLayers(imgNames []string, workDir string, eng engine.Engine, ctx *context.Context, db *state.DB) {
+	log.Info("Removing shadow layers")
+	for _, imgName := range imgNames {
+		builder.RemoveShadowLayers(imgName, eng, ctx, db)
+		builder.RemoveBackup(imgName, workDir)
+	}
+}
+
+// profileImage shadows the image of a config, runs its workloads and debloats it.
+func profileImage(configPath string, debloatedFs string, opts builder.ExportOptions, noDebloat bool, workDir string,
+	eng engine.Engine, cli *client.Client, ctx *context.Context) {
+	config, err := workload.LoadConfig(configPath)
+	if err != nil {
+		panic(err)
 	}
+	images := []string{config.Image}
 
+	j := beginJournal(workDir, "shadow", images, map[string]string{"debloatedfs": debloatedFs})
+	shadow(images, workDir, eng, ctx, debloatedFs, j)
+
+	log.Info("Running profiling workloads against ", config.Image)
+	result := workload.NewRunner(config, cli, ctx).Run(config.Image)
+	if !result.Passed() {
+		log.Error("Profiling workloads failed, the image stays shadowed. Run `baffs restore` to undo shadowing")
+		os.Exit(1)
+	}
+	if noDebloat {
+		log.Info("Profiling finished, the image stays shadowed")
+		return
+	}
+
+	j = beginJournal(workDir, "debloat", images, debloatJournalOptions(opts))
+	debloat(images, workDir, eng, ctx, opts, j)
+}
+
+// validate runs the workloads of a config against the original and the debloated image,
+// it exits with 1 if the debloated image regresses.
+func validate(configPath string, debloatedImg string, jsonPath string, cli *client.Client, ctx *context.Context) {
+	config, err := workload.LoadConfig(configPath)
+	if err != nil {
+		panic(err)
+	}
+	if debloatedImg == "" {
+		debloatedImg = config.Image + "-baffs"
+	}
+
+	log.Info("Running workloads against the original image ", config.Image)
+	original := workload.NewRunner(config, cli, ctx).Run(config.Image)
+	log.Info("Running workloads against the debloated image ", debloatedImg)
+	debloated := workload.NewRunner(config, cli, ctx).Run(debloatedImg)
+
+	comparison := workload.Compare(config, original, debloated)
+	comparison.Report(os.Stdout)
+	if jsonPath != "" {
+		data, err := json.MarshalIndent(comparison, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(jsonPath, data, 0644); err != nil {
+			panic(err)
+		}
+	}
+	if len(comparison.Regressions()) > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeReport reports what debloating removed from an image, per layer, directory and file type.
+func writeReport(imgName string, format string, output string, topN int, workDir string, eng engine.Engine, ctx *context.Context) {
+	if format != "text" && format != "json" && format != "markdown" && format != "md" && format != "html" {
+		log.Error("Unknown report format: ", format)
+		os.Exit(1)
+	}
+	shadowed, shadowLayers, diffIds := builder.ShadowLayersOf(imgName, eng, ctx, openState(workDir, eng, ctx))
+	if !shadowed {
+		os.Exit(1)
+	}
+	r := report.New(imgName, shadowLayers, diffIds, topN)
+
+	w := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch format {
+	case "text":
+		r.WriteText(w)
+	case "json":
+		if err := r.WriteJSON(w); err != nil {
+			panic(err)
+		}
+	case "markdown", "md":
+		r.WriteMarkdown(w)
+	case "html":
+		m := report.Metadata{Image: imgName, DebloatedImage: imgName + "-baffs", Version: version.Version, Time: time.Now().Format(time.RFC3339)}
+		if imgInfo, err := eng.Inspect(*ctx, imgName); err == nil {
+			m.OriginalDigest = imgInfo.ID
+		}
+		if imgInfo, err := eng.Inspect(*ctx, m.DebloatedImage); err == nil {
+			m.DebloatedDigest = imgInfo.ID
+		}
+		if err := report.WriteHTML(w, r, report.NewTree(shadowLayers), m); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// vulndiff writes the vulnerabilities no longer reachable in an image, as matched when it was debloated with --osv.
+func vulndiff(imgName string, format string, output string) {
+	if format != "text" && format != "json" {
+		log.Error("Unknown vulndiff format: ", format)
+		os.Exit(1)
+	}
+	if !util.PathExist(builder.VulndiffPath(imgName)) {
+		log.Error("No vulnerabilities recorded for image ", imgName, ", debloat it with --osv")
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(builder.VulndiffPath(imgName))
+	if err != nil {
+		panic(err)
+	}
+	var d vuln.Diff
+	if err := json.Unmarshal(data, &d); err != nil {
+		panic(err)
+	}
+
+	w := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch format {
+	case "text":
+		d.WriteText(w)
+	case "json":
+		if err := d.WriteJSON(w); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// status writes the records of images in the state database, with the mounts checked against the running ones.
+func status(imgNames []string, format string, workDir string, eng engine.Engine, ctx *context.Context) {
+	if format != "text" && format != "json" {
+		log.Error("Unknown status format: ", format)
+		os.Exit(1)
+	}
+	db := openState(workDir, eng, ctx)
+	var images []*state.Image
+	if len(imgNames) == 0 {
+		images = db.Sorted()
+	}
+	for _, imgName := range imgNames {
+		img := db.Lookup(imgName)
+		if img == nil {
+			log.Error("Image ", imgName, " not recorded")
+			os.Exit(1)
+		}
+		images = append(images, img)
+	}
+	for _, img := range images {
+		for i, l := range img.Layers {
+			if !mount.IsMountedWithType(l.MountPoint, mount.MountType) {
+				img.Layers[i].MountPID = 0
+			}
+		}
+	}
+
+	switch format {
+	case "text":
+		db.WriteText(os.Stdout, images)
+	case "json":
+		if err := state.WriteJSON(os.Stdout, images); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func exportProfile(imgName string, output string, workDir string, eng engine.Engine, ctx *context.Context) {
+	log.Info("Exporting profile of image: ", imgName)
+	shadowed, p := builder.ExportProfile(imgName, eng, ctx, openState(workDir, eng, ctx))
+	if !shadowed {
+		os.Exit(1)
+	}
+	p.Dump(output)
+	log.Info("Profile exported to: ", output)
+}
+
+func apply(imgTarPath string, profilePath string, output string) {
+	if output == "" {
+		output = imgTarPath + ".debloated"
+	}
+	log.Info("Applying profile ", profilePath, " to ", imgTarPath)
+	builder.ApplyProfile(imgTarPath, profile.Load(profilePath), output)
+	log.Info("Debloated image exported to: ", output)
 }
 
 func setLogger() {
@@ -153,6 +646,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	// apply works offline, it needs neither docker nor the work dir
+	if args.Apply != nil {
+		apply(args.Apply.Tar, args.Apply.Profile, args.Apply.Output)
+		return
+	}
+	if args.Profile != nil && args.Profile.Export == nil && args.Profile.Config == "" {
+		p.WriteHelpForSubcommand(os.Stdout, "profile")
+		os.Exit(1)
+	}
+
 	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -160,9 +663,27 @@ func main() {
 	}
 	defer cli.Close()
 
-	dockerInfo, _ := cli.Info(ctx)
-	dockerRootDir := dockerInfo.DockerRootDir
-	overlayPath := filepath.Join(dockerRootDir, "overlay2")
+	// containers of workloads always run through the docker api, images are handled by the engine
+	var eng engine.Engine
+	switch args.Engine {
+	case "docker":
+		restarter, err := engine.NewRestarter(engine.RestartOptions{Strategy: args.Reload, Service: args.ReloadService,
+			Pidfile: args.ReloadPidfile, Signal: args.ReloadSignal, Command: args.ReloadCommand, Timeout: args.ReloadTimeout})
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if eng, err = engine.NewDocker(ctx, cli, restarter, args.ReloadTimeout, args.Live); err != nil {
+			panic(err)
+		}
+	case "podman":
+		eng = engine.NewPodman(storageRoot(engine.DefaultPodmanRoot))
+	case "containerd":
+		eng = engine.NewContainerd(args.Address, args.Namespace, storageRoot(engine.DefaultContainerdRoot))
+	default:
+		log.Error("Unknown engine: ", args.Engine)
+		os.Exit(1)
+	}
 	workDir := "/usr/local/bafs"
 	if !util.PathExist(workDir) {
 		if err := os.Mkdir(workDir, 0755); err != nil {
@@ -170,13 +691,37 @@ func main() {
 		}
 	}
 
+	if journal.Pending(workDir) {
+		recoverJournal(workDir, args.Recover, eng, &ctx)
+	}
+
 	switch {
 	case args.Shadow != nil:
 		images := strings.Split(args.Shadow.Images, ",")
 		debloatedFs := args.Shadow.DebloatedFs
-		shadow(images, workDir, overlayPath, dockerRootDir, cli, &ctx, debloatedFs)
+		j := beginJournal(workDir, "shadow", images, map[string]string{"debloatedfs": debloatedFs})
+		shadow(images, workDir, eng, &ctx, debloatedFs, j)
 	case args.Debloat != nil:
 		images := strings.Split(args.Debloat.Images, ",")
-		debloat(images, workDir, overlayPath, dockerRootDir, cli, &ctx, args.Debloat.Top)
+		opts := args.Debloat.exportOptions()
+		j := beginJournal(workDir, "debloat", images, debloatJournalOptions(opts))
+		debloat(images, workDir, eng, &ctx, opts, j)
+	case args.Restore != nil:
+		images := strings.Split(args.Restore.Images, ",")
+		j := beginJournal(workDir, "restore", images, nil)
+		restore(images, workDir, eng, &ctx, j)
+	case args.Profile != nil && args.Profile.Export != nil:
+		exportProfile(args.Profile.Export.Image, args.Profile.Export.Output, workDir, eng, &ctx)
+	case args.Report != nil:
+		writeReport(args.Report.Image, args.Report.Format, args.Report.Output, args.Report.Top, workDir, eng, &ctx)
+	case args.Vulndiff != nil:
+		vulndiff(args.Vulndiff.Image, args.Vulndiff.Format, args.Vulndiff.Output)
+	case args.Status != nil:
+		status(args.Status.Images, args.Status.Format, workDir, eng, &ctx)
+	case args.Validate != nil:
+		validate(args.Validate.Config, args.Validate.Debloated, args.Validate.Json, cli, &ctx)
+	case args.Profile != nil:
+		profileImage(args.Profile.Config, args.Profile.DebloatedFs, args.Profile.exportOptions(), args.Profile.NoDebloat,
+			workDir, eng, cli, &ctx)
 	}
 }